@@ -0,0 +1,277 @@
+package vshard
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/youtube/vitess/go/cacheservice"
+)
+
+const (
+	// leaseFlag marks the empty placeholder items written by CachedStore
+	// while a loader is reading the backing store, they're never returned
+	// as values
+	leaseFlag = uint16(1 << 15)
+
+	defaultLeaseTimeout         = 10
+	defaultWriteBehindQueueSize = 1024
+)
+
+var (
+	// ErrWriteQueueFull defines the error when the write-behind queue can't take more writes
+	ErrWriteQueueFull = errors.New("error: write-behind queue is full")
+	// ErrCachedStoreClosed defines the error when writing to a closed CachedStore
+	ErrCachedStoreClosed = errors.New("error: cached store is closed")
+)
+
+// Loader reads values from the backing store, it must return ErrKeyNotFound
+// when the key doesn't exist
+type Loader interface {
+	Load(ctx context.Context, key string) ([]byte, error)
+}
+
+// Store writes values to the backing store
+type Store interface {
+	Store(ctx context.Context, key string, value []byte) error
+	Delete(ctx context.Context, key string) error
+}
+
+// WriteMode defines how CachedStore writes reach the cache and the backing store
+type WriteMode int
+
+const (
+	// WriteInvalidate updates the store, then deletes the cache entry (default)
+	WriteInvalidate WriteMode = iota
+	// WriteRefresh updates the store, then sets the new value in the cache.
+	// Concurrent writers to the same key may leave the older value cached.
+	WriteRefresh
+	// WriteBehind queues the store update, then sets the new value in the cache.
+	// Queued writes are served by Get until they reach the store.
+	WriteBehind
+)
+
+// CachedStore implements read-through and write-through caching on top of Pool.
+//
+// Misses take a lease: a placeholder is added to the cache before loading and
+// is swapped for the loaded value with Cas. Writes always update the store
+// before touching the cache, so a write racing with a load changes the
+// placeholder's CAS and the (possibly stale) loaded value is not cached.
+// Placeholders are flagged, so reading CachedStore keys straight from Pool.Get
+// may return an empty value while a load is in flight. Flags can't use
+// ReservedFlags.
+type CachedStore struct {
+	Pool                 *Pool
+	Loader               Loader
+	Store                Store
+	Flags                uint16
+	Timeout              uint64
+	LeaseTimeout         uint64
+	WriteMode            WriteMode
+	WriteBehindQueueSize int
+	OnWriteBehindError   func(key string, err error)
+	queue                chan *pendingWrite
+	pending              map[string]*pendingWrite
+	closed               bool
+	done                 chan struct{}
+	sync.Mutex
+}
+
+type pendingWrite struct {
+	key    string
+	value  []byte
+	delete bool
+}
+
+// Start initializes the CachedStore, starting the write-behind worker if needed
+func (c *CachedStore) Start() {
+	if c.LeaseTimeout == 0 {
+		c.LeaseTimeout = defaultLeaseTimeout
+	}
+	if c.WriteBehindQueueSize == 0 {
+		c.WriteBehindQueueSize = defaultWriteBehindQueueSize
+	}
+	if c.OnWriteBehindError == nil {
+		c.OnWriteBehindError = func(key string, err error) {
+			log.Printf("error: write-behind of %q failed: %s", key, err)
+		}
+	}
+
+	if c.WriteMode == WriteBehind {
+		c.queue = make(chan *pendingWrite, c.WriteBehindQueueSize)
+		c.pending = make(map[string]*pendingWrite)
+		c.done = make(chan struct{})
+		go c.writeBehind()
+	}
+}
+
+// Close stops accepting writes and waits for the write-behind queue to drain
+func (c *CachedStore) Close() {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return
+	}
+	c.closed = true
+	c.Unlock()
+
+	if c.queue != nil {
+		close(c.queue)
+		<-c.done
+	}
+}
+
+// Get returns the cached value for key, loading it from the backing store
+// and populating the cache on a miss
+func (c *CachedStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if write, ok := c.pendingWrite(key); ok {
+		if write.delete {
+			return nil, ErrKeyNotFound
+		}
+		return write.value, nil
+	}
+
+	results, err := c.Pool.Gets(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(results) > 0 {
+		if !isLease(results[0]) {
+			return results[0].Value, nil
+		}
+
+		// someone else is loading this key, don't race them for the cache
+		return c.Loader.Load(ctx, key)
+	}
+
+	cas, leased := c.lease(key)
+
+	value, err := c.Loader.Load(ctx, key)
+	if err != nil {
+		if leased {
+			c.Pool.Delete(key)
+		}
+		return nil, err
+	}
+
+	if leased {
+		c.Pool.Cas(key, c.Flags, c.Timeout, value, cas)
+	}
+
+	return value, nil
+}
+
+// Set writes value to the backing store and the cache, following WriteMode
+func (c *CachedStore) Set(ctx context.Context, key string, value []byte) error {
+	switch c.WriteMode {
+	case WriteBehind:
+		if err := c.enqueue(&pendingWrite{key: key, value: value}); err != nil {
+			return err
+		}
+		_, err := c.Pool.Set(key, c.Flags, c.Timeout, value)
+		return err
+	case WriteRefresh:
+		if err := c.Store.Store(ctx, key, value); err != nil {
+			return err
+		}
+		_, err := c.Pool.Set(key, c.Flags, c.Timeout, value)
+		return err
+	default:
+		if err := c.Store.Store(ctx, key, value); err != nil {
+			return err
+		}
+		_, err := c.Pool.Delete(key)
+		return err
+	}
+}
+
+// Delete removes key from the backing store and the cache
+func (c *CachedStore) Delete(ctx context.Context, key string) error {
+	if c.WriteMode == WriteBehind {
+		if err := c.enqueue(&pendingWrite{key: key, delete: true}); err != nil {
+			return err
+		}
+		_, err := c.Pool.Delete(key)
+		return err
+	}
+
+	if err := c.Store.Delete(ctx, key); err != nil {
+		return err
+	}
+
+	_, err := c.Pool.Delete(key)
+	return err
+}
+
+// lease adds a placeholder for key, returning its CAS if we got it
+func (c *CachedStore) lease(key string) (uint64, bool) {
+	ok, err := c.Pool.store(CommandAdd, key, storeAdd, true, leaseFlag, c.LeaseTimeout, []byte{}, 0)
+	if err != nil || !ok {
+		return 0, false
+	}
+
+	results, err := c.Pool.Gets(key)
+	if err != nil || len(results) < 1 || !isLease(results[0]) {
+		return 0, false
+	}
+
+	return results[0].Cas, true
+}
+
+// isLease tells if item is a CachedStore placeholder
+func isLease(item cacheservice.Result) bool {
+	return item.Flags&leaseFlag != 0 && len(item.Value) == 0
+}
+
+func (c *CachedStore) pendingWrite(key string) (*pendingWrite, bool) {
+	if c.WriteMode != WriteBehind {
+		return nil, false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	write, ok := c.pending[key]
+	return write, ok
+}
+
+func (c *CachedStore) enqueue(write *pendingWrite) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		return ErrCachedStoreClosed
+	}
+
+	select {
+	case c.queue <- write:
+		c.pending[write.key] = write
+		return nil
+	default:
+		return ErrWriteQueueFull
+	}
+}
+
+func (c *CachedStore) writeBehind() {
+	defer close(c.done)
+
+	for write := range c.queue {
+		var err error
+		if write.delete {
+			err = c.Store.Delete(context.Background(), write.key)
+		} else {
+			err = c.Store.Store(context.Background(), write.key, write.value)
+		}
+		if err != nil {
+			c.OnWriteBehindError(write.key, err)
+		}
+
+		c.Lock()
+		if c.pending[write.key] == write {
+			delete(c.pending, write.key)
+		}
+		c.Unlock()
+	}
+}
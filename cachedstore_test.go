@@ -0,0 +1,263 @@
+package vshard
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type memoryStore struct {
+	data   map[string][]byte
+	loads  int
+	onLoad func(key string)
+	block  chan struct{}
+	sync.Mutex
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{data: make(map[string][]byte)}
+}
+
+func (s *memoryStore) Load(ctx context.Context, key string) ([]byte, error) {
+	s.Lock()
+	s.loads++
+	value, ok := s.data[key]
+	onLoad := s.onLoad
+	s.onLoad = nil
+	s.Unlock()
+
+	if onLoad != nil {
+		onLoad(key)
+	}
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+
+	return value, nil
+}
+
+func (s *memoryStore) Store(ctx context.Context, key string, value []byte) error {
+	if s.block != nil {
+		<-s.block
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.data[key] = value
+
+	return nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, key string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.data, key)
+
+	return nil
+}
+
+func (s *memoryStore) get(key string) (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+	value, ok := s.data[key]
+
+	return string(value), ok
+}
+
+type CachedStoreTestSuite struct {
+	suite.Suite
+	Pool  *Pool
+	Store *memoryStore
+}
+
+func (suite *CachedStoreTestSuite) SetupSuite() {
+	suite.Pool = setupPool(suite.T())
+}
+
+func (suite *CachedStoreTestSuite) SetupTest() {
+	suite.Store = newMemoryStore()
+}
+
+func (suite *CachedStoreTestSuite) TearDownTest() {
+	tearDownPool(suite.T(), suite.Pool)
+}
+
+func (suite *CachedStoreTestSuite) newCachedStore(mode WriteMode) *CachedStore {
+	cached := &CachedStore{
+		Pool:      suite.Pool,
+		Loader:    suite.Store,
+		Store:     suite.Store,
+		WriteMode: mode,
+	}
+	cached.Start()
+
+	return cached
+}
+
+func (suite *CachedStoreTestSuite) TestReadThrough() {
+	cached := suite.newCachedStore(WriteInvalidate)
+	defer cached.Close()
+	suite.Store.data["read-key"] = []byte("stored-value")
+
+	for i := 0; i < 3; i++ {
+		value, err := cached.Get(context.Background(), "read-key")
+		suite.NoError(err)
+		suite.Equal("stored-value", string(value))
+	}
+	suite.Equal(1, suite.Store.loads, "only the first Get should reach the loader")
+
+	value, err := suite.Pool.Get("read-key")
+	suite.NoError(err)
+	suite.Equal("stored-value", string(value))
+}
+
+func (suite *CachedStoreTestSuite) TestReadThroughMissing() {
+	cached := suite.newCachedStore(WriteInvalidate)
+	defer cached.Close()
+
+	_, err := cached.Get(context.Background(), "missing-key")
+	suite.Equal(ErrKeyNotFound, err)
+
+	_, err = suite.Pool.Get("missing-key")
+	suite.Equal(ErrKeyNotFound, err, "the lease should be released")
+}
+
+func (suite *CachedStoreTestSuite) TestLoaderError() {
+	cached := suite.newCachedStore(WriteInvalidate)
+	defer cached.Close()
+	loaderErr := errors.New("store is down")
+	cached.Loader = loaderFunc(func(ctx context.Context, key string) ([]byte, error) {
+		return nil, loaderErr
+	})
+
+	_, err := cached.Get(context.Background(), "failing-key")
+	suite.Equal(loaderErr, err)
+}
+
+func (suite *CachedStoreTestSuite) TestWriteInvalidate() {
+	cached := suite.newCachedStore(WriteInvalidate)
+	defer cached.Close()
+	suite.Store.data["invalidate-key"] = []byte("old-value")
+	cached.Get(context.Background(), "invalidate-key")
+
+	err := cached.Set(context.Background(), "invalidate-key", []byte("new-value"))
+	suite.NoError(err)
+
+	stored, _ := suite.Store.get("invalidate-key")
+	suite.Equal("new-value", stored)
+	_, err = suite.Pool.Get("invalidate-key")
+	suite.Equal(ErrKeyNotFound, err)
+
+	value, err := cached.Get(context.Background(), "invalidate-key")
+	suite.NoError(err)
+	suite.Equal("new-value", string(value))
+}
+
+func (suite *CachedStoreTestSuite) TestWriteRefresh() {
+	cached := suite.newCachedStore(WriteRefresh)
+	defer cached.Close()
+
+	err := cached.Set(context.Background(), "refresh-key", []byte("new-value"))
+	suite.NoError(err)
+
+	stored, _ := suite.Store.get("refresh-key")
+	suite.Equal("new-value", stored)
+	value, err := suite.Pool.Get("refresh-key")
+	suite.NoError(err)
+	suite.Equal("new-value", string(value))
+}
+
+func (suite *CachedStoreTestSuite) TestDelete() {
+	cached := suite.newCachedStore(WriteInvalidate)
+	defer cached.Close()
+	suite.Store.data["delete-key"] = []byte("value")
+	cached.Get(context.Background(), "delete-key")
+
+	suite.NoError(cached.Delete(context.Background(), "delete-key"))
+
+	_, ok := suite.Store.get("delete-key")
+	suite.False(ok)
+	_, err := cached.Get(context.Background(), "delete-key")
+	suite.Equal(ErrKeyNotFound, err)
+}
+
+func (suite *CachedStoreTestSuite) TestStaleSetRace() {
+	cached := suite.newCachedStore(WriteInvalidate)
+	defer cached.Close()
+	suite.Store.data["race-key"] = []byte("old-value")
+
+	// a writer updates the store while the reader is still loading the old value
+	suite.Store.onLoad = func(key string) {
+		suite.Store.Lock()
+		suite.Store.data[key] = []byte("new-value")
+		suite.Store.Unlock()
+		suite.NoError(cached.Set(context.Background(), key, []byte("new-value")))
+	}
+
+	value, err := cached.Get(context.Background(), "race-key")
+	suite.NoError(err)
+	suite.Equal("old-value", string(value))
+
+	value, err = cached.Get(context.Background(), "race-key")
+	suite.NoError(err)
+	suite.Equal("new-value", string(value), "the stale value must not have been cached")
+}
+
+func (suite *CachedStoreTestSuite) TestWriteBehind() {
+	cached := suite.newCachedStore(WriteBehind)
+	suite.Store.block = make(chan struct{})
+
+	err := cached.Set(context.Background(), "behind-key", []byte("new-value"))
+	suite.NoError(err)
+
+	value, err := suite.Pool.Get("behind-key")
+	suite.NoError(err)
+	suite.Equal("new-value", string(value))
+
+	suite.Pool.Delete("behind-key")
+	value, err = cached.Get(context.Background(), "behind-key")
+	suite.NoError(err)
+	suite.Equal("new-value", string(value), "queued writes should be visible before reaching the store")
+
+	close(suite.Store.block)
+	cached.Close()
+
+	stored, ok := suite.Store.get("behind-key")
+	suite.True(ok)
+	suite.Equal("new-value", stored)
+	suite.Equal(ErrCachedStoreClosed, cached.Set(context.Background(), "behind-key", []byte("closed")))
+}
+
+func (suite *CachedStoreTestSuite) TestWriteBehindQueueFull() {
+	cached := &CachedStore{
+		Pool:                 suite.Pool,
+		Loader:               suite.Store,
+		Store:                suite.Store,
+		WriteMode:            WriteBehind,
+		WriteBehindQueueSize: 1,
+	}
+	cached.Start()
+	suite.Store.block = make(chan struct{})
+
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = cached.Set(context.Background(), "full-key", []byte("value"))
+	}
+	suite.Equal(ErrWriteQueueFull, err)
+
+	close(suite.Store.block)
+	cached.Close()
+}
+
+type loaderFunc func(ctx context.Context, key string) ([]byte, error)
+
+func (f loaderFunc) Load(ctx context.Context, key string) ([]byte, error) {
+	return f(ctx, key)
+}
+
+func TestCachedStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(CachedStoreTestSuite))
+}
@@ -1,22 +1,58 @@
 package vshard
 
-import "github.com/youtube/vitess/go/cacheservice"
+import (
+	"errors"
+
+	"github.com/youtube/vitess/go/cacheservice"
+	"github.com/youtube/vitess/go/pools"
+)
+
+// ReservedFlags are the item flags vshard uses itself, bit 14 marking
+// items set with tags and bit 15 CachedStore leases
+const ReservedFlags = tagsFlag | leaseFlag
+
+// ErrReservedFlags defines the error when storing an item with ReservedFlags
+var ErrReservedFlags = errors.New("error: flags use bits reserved by vshard")
+
+// Cache is the command surface shared by Pool and the types composing pools
+type Cache interface {
+	Get(key string) ([]byte, error)
+	Gets(keys ...string) ([]cacheservice.Result, error)
+	Set(key string, flags uint16, timeout uint64, value []byte) (bool, error)
+	Add(key string, flags uint16, timeout uint64, value []byte) (bool, error)
+	Replace(key string, flags uint16, timeout uint64, value []byte) (bool, error)
+	Append(key string, flags uint16, timeout uint64, value []byte) (bool, error)
+	Prepend(key string, flags uint16, timeout uint64, value []byte) (bool, error)
+	Cas(key string, flags uint16, timeout uint64, value []byte, cas uint64) (bool, error)
+	Delete(key string) (bool, error)
+	FlushAll() []error
+	// HashKey returns the name key is stored under, as found in Gets results
+	HashKey(key string) string
+}
 
 // Status returns all statistics exposed by the memcached driver
 func (v *Pool) Status() []*PoolStats {
-	stats := make([]*PoolStats, v.numServers)
+	v.RLock()
+	servers, weights, serverPools, down := v.Servers, v.weights, v.pool, v.down
+	v.RUnlock()
+
+	stats := make([]*PoolStats, len(serverPools))
 
-	for i, pool := range v.pool {
+	for i, pool := range serverPools {
 		capacity, available, maxCap, waitCount, waitTime, idleTimeout := pool.Stats()
 		status := &PoolStats{
 			Slot:        i,
-			Server:      v.Servers[i],
+			Server:      servers[i],
+			Weight:      weights[i],
 			Capacity:    capacity,
 			Available:   available,
 			MaxCap:      maxCap,
 			WaitCount:   waitCount,
 			WaitTime:    waitTime,
 			IdleTimeout: idleTimeout,
+			Down:        down != nil && down[i],
+			Failovers:   v.failoverCount(servers[i]),
+			Retries:     v.retryCount(servers[i]),
 		}
 
 		stats[i] = status
@@ -25,142 +61,355 @@ func (v *Pool) Status() []*PoolStats {
 	return stats
 }
 
-// Get returns a key from the memcached server
+// Get returns a key from the LocalCache when set, or from the memcached server
 func (v *Pool) Get(key string) ([]byte, error) {
-	resource, poolNum, err := v.GetConnection(key)
-	if err != nil {
-		return nil, err
+	if v.LocalCache != nil {
+		if value, ok := v.LocalCache.Get(key); ok {
+			return value, nil
+		}
+	}
+
+	// an invalidation during the read must keep its value out of the local tier
+	var generation uint64
+	if v.LocalCache != nil {
+		generation = v.localGeneration(key)
 	}
-	defer v.ReturnConnection(poolNum, resource)
 
-	result, err := resource.Get(v.HashKeyStrategy(key))
+	result, err := v.get(key)
 	if err != nil {
 		return nil, err
 	}
 
+	tagged := len(result) > 0 && isTagged(result[0])
+	if tagged {
+		result, err = v.checkTags(result)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if len(result) < 1 {
 		return nil, ErrKeyNotFound
 	}
 
+	// tag invalidations can't reach the local tier, so tagged items skip it
+	if v.LocalCache != nil && !tagged {
+		v.cacheLocally(key, result[0].Value, generation)
+	}
+
 	return result[0].Value, nil
 }
 
+// get reads key from its server, or the Failover pool when that fails.
+// Without a Failover, keys of down servers are misses. During a migration,
+// misses are read from the old owner.
+func (v *Pool) get(key string) ([]cacheservice.Result, error) {
+	results, err := v.getOwn(key)
+	if err == nil {
+		return v.readThrough([]string{key}, results), nil
+	}
+	if v.failRead(key, err) {
+		return v.Failover.get(key)
+	}
+	if err == ErrServerDown {
+		return nil, nil
+	}
+
+	return results, err
+}
+
+// getOwn reads key from its server, retried as RetryPolicy says
+func (v *Pool) getOwn(key string) ([]cacheservice.Result, error) {
+	var results []cacheservice.Result
+	err := v.retry(CommandGet, key, func() (err error) {
+		results, err = v.getOnce(key)
+		return err
+	})
+
+	return results, err
+}
+
+func (v *Pool) getOnce(key string) ([]cacheservice.Result, error) {
+	if v.Replicas > 1 {
+		return v.replicatedGets(key)
+	}
+
+	resource, _, err := v.GetConnection(key)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { v.release(resource, err) }()
+
+	results, err := resource.Get(v.HashKeyStrategy(key))
+
+	return results, err
+}
+
 // Gets returns cached data for given keys, it is an alternative Get api
 // for using with CAS. Gets returns a CAS identifier with the item. If
 // the item's CAS value has changed since you Gets'ed it, it will not be stored.
 func (v *Pool) Gets(keys ...string) ([]cacheservice.Result, error) {
-	mapping := v.GetKeyMapping(keys...)
+	results, err := v.gets(keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.checkTags(results)
+}
+
+func (v *Pool) gets(keys ...string) ([]cacheservice.Result, error) {
+	results, err := v.getsOwn(keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.readThrough(keys, results), nil
+}
+
+func (v *Pool) getsOwn(keys ...string) ([]cacheservice.Result, error) {
+	if v.Replicas > 1 {
+		return v.replicatedGets(keys...)
+	}
+
+	for {
+		results, err := v.getsFrom(keys...)
+		if err != pools.ErrClosed {
+			return results, err
+		}
+		// a server was just removed by UpdateServers, map the keys again
+	}
+}
+
+// getsFrom reads keys from their servers, keys of failed servers are read
+// from the Failover pool when there's one. Without it, keys of down servers
+// are misses.
+func (v *Pool) getsFrom(keys ...string) ([]cacheservice.Result, error) {
+	mapping, serverPools := v.keyMapping(keys...)
 	results := []cacheservice.Result{}
+	failed := []string{}
 
 	for poolNum, keys := range mapping {
-		if len(keys) > 0 {
-			connection, err := v.GetPoolConnection(poolNum)
-			if err != nil {
-				return nil, err
+		if len(keys) == 0 {
+			continue
+		}
+		if serverPools[poolNum] == nil {
+			if v.failRead(keys[0], ErrServerDown) {
+				failed = append(failed, keys...)
 			}
-			defer v.ReturnConnection(poolNum, connection)
+			continue
+		}
 
-			result, err := connection.Gets(keys...)
-			if err != nil {
+		var result []cacheservice.Result
+		err := v.retry(CommandGets, keys[0], func() (err error) {
+			result, err = v.getsOn(serverPools[poolNum], v.hashKeys(keys)...)
+			return err
+		})
+		if err == pools.ErrClosed {
+			return nil, err
+		}
+		if err != nil {
+			if !v.failRead(keys[0], err) {
 				return nil, err
 			}
+			failed = append(failed, keys...)
+			continue
+		}
 
-			results = append(results, result...)
+		results = append(results, result...)
+	}
+
+	if len(failed) > 0 {
+		result, err := v.Failover.gets(failed...)
+		if err != nil {
+			return nil, err
 		}
+		results = append(results, result...)
 	}
 
 	return results, nil
 }
 
-// Set set the value with specified cache key.
+// Set set the value with specified cache key. Flags can't use ReservedFlags.
 func (v *Pool) Set(key string, flags uint16, timeout uint64, value []byte) (bool, error) {
-	resource, poolNum, err := v.GetConnection(key)
-	if err != nil {
-		return false, err
+	if flags&ReservedFlags != 0 {
+		return false, ErrReservedFlags
 	}
-	defer v.ReturnConnection(poolNum, resource)
 
-	return resource.Set(v.HashKeyStrategy(key), flags, timeout, value)
+	return v.store(CommandSet, key, storeSet, false, flags, timeout, value, 0)
 }
 
-// Add store the value only if it does not already exist.
+// Add store the value only if it does not already exist. Flags can't use
+// ReservedFlags.
 func (v *Pool) Add(key string, flags uint16, timeout uint64, value []byte) (bool, error) {
-	resource, poolNum, err := v.GetConnection(key)
-	if err != nil {
-		return false, err
+	if flags&ReservedFlags != 0 {
+		return false, ErrReservedFlags
 	}
-	defer v.ReturnConnection(poolNum, resource)
 
-	return resource.Add(v.HashKeyStrategy(key), flags, timeout, value)
+	return v.store(CommandAdd, key, storeAdd, true, flags, timeout, value, 0)
 }
 
 // Replace replaces the value, only if the value already exists,
-// for the specified cache key.
+// for the specified cache key. Flags can't use ReservedFlags.
 func (v *Pool) Replace(key string, flags uint16, timeout uint64, value []byte) (bool, error) {
-	resource, poolNum, err := v.GetConnection(key)
-	if err != nil {
-		return false, err
+	if flags&ReservedFlags != 0 {
+		return false, ErrReservedFlags
 	}
-	defer v.ReturnConnection(poolNum, resource)
 
-	return resource.Replace(v.HashKeyStrategy(key), flags, timeout, value)
+	return v.store(CommandReplace, key, storeReplace, true, flags, timeout, value, 0)
 }
 
 // Append appends the value after the last bytes in an existing item.
 func (v *Pool) Append(key string, flags uint16, timeout uint64, value []byte) (bool, error) {
-	resource, poolNum, err := v.GetConnection(key)
-	if err != nil {
-		return false, err
-	}
-	defer v.ReturnConnection(poolNum, resource)
-
-	return resource.Append(v.HashKeyStrategy(key), flags, timeout, value)
+	return v.store(CommandAppend, key, storeAppend, false, flags, timeout, value, 0)
 }
 
 // Prepend prepends the value before existing value.
 func (v *Pool) Prepend(key string, flags uint16, timeout uint64, value []byte) (bool, error) {
-	resource, poolNum, err := v.GetConnection(key)
-	if err != nil {
-		return false, err
-	}
-	defer v.ReturnConnection(poolNum, resource)
-
-	return resource.Prepend(v.HashKeyStrategy(key), flags, timeout, value)
+	return v.store(CommandPrepend, key, storePrepend, false, flags, timeout, value, 0)
 }
 
 // Cas stores the value only if no one else has updated the data since you read it last.
+// Flags can't use ReservedFlags.
 func (v *Pool) Cas(key string, flags uint16, timeout uint64, value []byte, cas uint64) (bool, error) {
-	resource, poolNum, err := v.GetConnection(key)
+	if flags&ReservedFlags != 0 {
+		return false, ErrReservedFlags
+	}
+
+	return v.store(CommandCas, key, storeCas, true, flags, timeout, value, cas)
+}
+
+// storeFunc runs one of the memcached storage commands on a connection
+type storeFunc func(c *VitessResource, key string, flags uint16, timeout uint64, value []byte, cas uint64) (bool, error)
+
+func storeSet(c *VitessResource, key string, flags uint16, timeout uint64, value []byte, cas uint64) (bool, error) {
+	return c.Set(key, flags, timeout, value)
+}
+
+func storeAdd(c *VitessResource, key string, flags uint16, timeout uint64, value []byte, cas uint64) (bool, error) {
+	return c.Add(key, flags, timeout, value)
+}
+
+func storeReplace(c *VitessResource, key string, flags uint16, timeout uint64, value []byte, cas uint64) (bool, error) {
+	return c.Replace(key, flags, timeout, value)
+}
+
+func storeAppend(c *VitessResource, key string, flags uint16, timeout uint64, value []byte, cas uint64) (bool, error) {
+	return c.Append(key, flags, timeout, value)
+}
+
+func storePrepend(c *VitessResource, key string, flags uint16, timeout uint64, value []byte, cas uint64) (bool, error) {
+	return c.Prepend(key, flags, timeout, value)
+}
+
+func storeCas(c *VitessResource, key string, flags uint16, timeout uint64, value []byte, cas uint64) (bool, error) {
+	return c.Cas(key, flags, timeout, value, cas)
+}
+
+// store runs a storage command on the server owning key, retried as
+// RetryPolicy says for command, conditional commands depend on the value
+// already stored
+func (v *Pool) store(command Command, key string, store storeFunc, conditional bool, flags uint16, timeout uint64, value []byte, cas uint64) (bool, error) {
+	var stored bool
+	err := v.retry(command, key, func() (err error) {
+		stored, err = v.storeOwn(key, store, conditional, flags, timeout, value, cas)
+		return err
+	})
+	if err == nil {
+		stored = v.storeOld(command, key, store, conditional, stored, flags, timeout, value, cas)
+	}
+	if v.failWrite(key, err) {
+		stored, err = v.Failover.store(command, key, store, conditional, flags, timeout, value, cas)
+		if err == nil && stored {
+			v.invalidate(key)
+		}
+	}
+
+	return stored, err
+}
+
+func (v *Pool) storeOwn(key string, store storeFunc, conditional bool, flags uint16, timeout uint64, value []byte, cas uint64) (bool, error) {
+	if v.Replicas > 1 {
+		return v.replicatedStore(key, store, conditional, flags, timeout, value, cas)
+	}
+
+	resource, _, err := v.GetConnection(key)
 	if err != nil {
 		return false, err
 	}
-	defer v.ReturnConnection(poolNum, resource)
+	defer func() { v.release(resource, err) }()
 
-	return resource.Cas(v.HashKeyStrategy(key), flags, timeout, value, cas)
+	stored, err := store(resource, v.HashKeyStrategy(key), flags, timeout, value, cas)
+	if err == nil && stored {
+		v.invalidate(key)
+	}
+
+	return stored, err
 }
 
 // Delete delete the value for the specified cache key.
 func (v *Pool) Delete(key string) (bool, error) {
-	resource, poolNum, err := v.GetConnection(key)
+	deleted, err := v.deleteOwn(key)
+	deleted, err = v.deleteOld(key, deleted, err)
+	if v.Failover == nil {
+		return deleted, err
+	}
+
+	return v.deleteFailover(key, deleted, err)
+}
+
+// deleteOwn deletes key from its server, retried as RetryPolicy says
+func (v *Pool) deleteOwn(key string) (bool, error) {
+	var deleted bool
+	err := v.retry(CommandDelete, key, func() (err error) {
+		deleted, err = v.deleteOnce(key)
+		return err
+	})
+
+	return deleted, err
+}
+
+func (v *Pool) deleteOnce(key string) (bool, error) {
+	if v.Replicas > 1 {
+		return v.replicatedDelete(key)
+	}
+
+	resource, _, err := v.GetConnection(key)
 	if err != nil {
 		return false, err
 	}
-	defer v.ReturnConnection(poolNum, resource)
+	defer func() { v.release(resource, err) }()
+
+	deleted, err := resource.Delete(v.HashKeyStrategy(key))
+	if err == nil {
+		v.invalidate(key)
+	}
 
-	return resource.Delete(v.HashKeyStrategy(key))
+	return deleted, err
 }
 
 // FlushAll purges the entire cache on all servers.
 func (v *Pool) FlushAll() []error {
 	errs := []error{}
+	defer v.invalidateAll()
+
+	v.RLock()
+	serverPools, down := v.pool, v.down
+	// servers only in the old topology of a migration are flushed too
+	serverPools = append(append([]*pools.ResourcePool{}, serverPools...), v.oldOnlyPools()...)
+	v.RUnlock()
+
+	for poolNum, pool := range serverPools {
+		if down != nil && poolNum < len(down) && down[poolNum] {
+			errs = append(errs, ErrServerDown)
+			continue
+		}
 
-	for poolNum := range v.pool {
-		resource, err := v.GetPoolConnection(poolNum)
+		resource, err := getConnection(pool)
 		if err != nil {
 			errs = append(errs, err)
 			continue
 		}
-		defer v.ReturnConnection(poolNum, resource)
+		defer func() { v.release(resource, err) }()
 
 		err = resource.FlushAll()
 		if err != nil {
@@ -0,0 +1,414 @@
+package vshard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is the declarative form of a Pool, as read from a JSON file by
+// NewPoolFromConfig. Strategies are referred to by the names they were
+// registered under, durations are strings like "500ms" or "2s", and
+// missing settings take the same defaults as Pool.
+type Config struct {
+	Servers           []string           `json:"servers"`
+	Weights           []int              `json:"weights,omitempty"`
+	Capacity          int                `json:"capacity,omitempty"`
+	MaxCapacity       int                `json:"max_capacity,omitempty"`
+	ServerStrategy    string             `json:"server_strategy,omitempty"`
+	TopologyStrategy  string             `json:"topology_strategy,omitempty"`
+	HashKeyStrategy   string             `json:"hash_key_strategy,omitempty"`
+	HashTagStrategy   string             `json:"hash_tag_strategy,omitempty"`
+	IdleTimeout       Duration           `json:"idle_timeout,omitempty"`
+	ConnectionTimeout Duration           `json:"connection_timeout,omitempty"`
+	TTLJitter         float64            `json:"ttl_jitter,omitempty"`
+	Replicas          int                `json:"replicas,omitempty"`
+	HealthCheck       *HealthCheckConfig `json:"health_check,omitempty"`
+	Retry             *RetryConfig       `json:"retry,omitempty"`
+	FailoverServers   []string           `json:"failover_servers,omitempty"`
+	FailoverWrites    bool               `json:"failover_writes,omitempty"`
+	MirrorDeletes     bool               `json:"mirror_deletes,omitempty"`
+}
+
+// HealthCheckConfig is the declarative form of HealthCheck, Policy being
+// "miss" or "rehash"
+type HealthCheckConfig struct {
+	Interval      Duration `json:"interval,omitempty"`
+	FailureLimit  int      `json:"failure_limit,omitempty"`
+	RetryInterval Duration `json:"retry_interval,omitempty"`
+	Policy        string   `json:"policy,omitempty"`
+}
+
+// RetryConfig is the declarative form of RetryPolicy, Commands naming the
+// commands retried, such as "get" or "set"
+type RetryConfig struct {
+	MaxAttempts int      `json:"max_attempts,omitempty"`
+	Backoff     Duration `json:"backoff,omitempty"`
+	MaxBackoff  Duration `json:"max_backoff,omitempty"`
+	Commands    []string `json:"commands,omitempty"`
+}
+
+// Duration is a time.Duration written as a string in JSON, like "500ms"
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"500ms\", got %s", data)
+	}
+
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+
+	return nil
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+var (
+	strategies         sync.RWMutex
+	serverStrategies   = map[string]ServerStrategy{}
+	topologyStrategies = map[string]TopologyStrategy{}
+	hashKeyStrategies  = map[string]HashKeyStrategy{}
+	hashTagStrategies  = map[string]HashTagStrategy{}
+	ejectPolicies      = map[string]EjectPolicy{"miss": EjectAsMiss, "rehash": EjectRehash}
+)
+
+func init() {
+	RegisterServerStrategy("xxh64", XXH64ShardServerStrategy)
+	RegisterServerStrategy("md5", MD5ShardServerStrategy)
+	RegisterServerStrategy("farmhash", FarmhashShardServerStrategy)
+
+	RegisterTopologyStrategy("xxh64", XXH64WeightedServerStrategy)
+	RegisterTopologyStrategy("md5", MD5WeightedServerStrategy)
+	RegisterTopologyStrategy("farmhash", FarmhashWeightedServerStrategy)
+	RegisterTopologyStrategy("ketama", KetamaServerStrategy)
+	RegisterTopologyStrategy("twemproxy-ketama", TwemproxyKetamaServerStrategy)
+	RegisterTopologyStrategy("rendezvous", RendezvousServerStrategy)
+	RegisterTopologyStrategy("maglev", MaglevServerStrategy)
+	RegisterTopologyStrategy("vbucket", VBucketServerStrategy)
+
+	RegisterHashKeyStrategy("xxh64", XXH64KeyStrategy)
+	RegisterHashKeyStrategy("md5", MD5KeyStrategy)
+	RegisterHashKeyStrategy("farmhash", FarmhashKeyStrategy)
+	RegisterHashKeyStrategy("none", NoKeyStrategy)
+
+	RegisterHashTagStrategy("brace", BraceHashTagStrategy)
+}
+
+// RegisterServerStrategy makes a ServerStrategy available to configs under
+// name. Like database/sql drivers, registering a nil strategy or a name
+// twice panics.
+func RegisterServerStrategy(name string, strategy ServerStrategy) {
+	strategies.Lock()
+	defer strategies.Unlock()
+
+	if strategy == nil {
+		panic("vshard: nil server strategy " + name)
+	}
+	if _, ok := serverStrategies[name]; ok {
+		panic("vshard: server strategy " + name + " registered twice")
+	}
+	serverStrategies[name] = strategy
+}
+
+// RegisterTopologyStrategy makes a TopologyStrategy available to configs
+// under name, panicking like RegisterServerStrategy
+func RegisterTopologyStrategy(name string, strategy TopologyStrategy) {
+	strategies.Lock()
+	defer strategies.Unlock()
+
+	if strategy == nil {
+		panic("vshard: nil topology strategy " + name)
+	}
+	if _, ok := topologyStrategies[name]; ok {
+		panic("vshard: topology strategy " + name + " registered twice")
+	}
+	topologyStrategies[name] = strategy
+}
+
+// RegisterHashKeyStrategy makes a HashKeyStrategy available to configs
+// under name, panicking like RegisterServerStrategy
+func RegisterHashKeyStrategy(name string, strategy HashKeyStrategy) {
+	strategies.Lock()
+	defer strategies.Unlock()
+
+	if strategy == nil {
+		panic("vshard: nil hash key strategy " + name)
+	}
+	if _, ok := hashKeyStrategies[name]; ok {
+		panic("vshard: hash key strategy " + name + " registered twice")
+	}
+	hashKeyStrategies[name] = strategy
+}
+
+// RegisterHashTagStrategy makes a HashTagStrategy available to configs
+// under name, panicking like RegisterServerStrategy
+func RegisterHashTagStrategy(name string, strategy HashTagStrategy) {
+	strategies.Lock()
+	defer strategies.Unlock()
+
+	if strategy == nil {
+		panic("vshard: nil hash tag strategy " + name)
+	}
+	if _, ok := hashTagStrategies[name]; ok {
+		panic("vshard: hash tag strategy " + name + " registered twice")
+	}
+	hashTagStrategies[name] = strategy
+}
+
+// NewPoolFromConfig reads the JSON config at path and returns the Pool it
+// describes, not started yet so settings without a JSON form, like
+// LocalCache, can still be filled in before Start.
+func NewPoolFromConfig(path string) (*Pool, error) {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return config.NewPool()
+}
+
+// LoadConfig reads and validates the JSON config at path. Unknown fields
+// are errors, so typos don't go unnoticed.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseConfig(data, "config "+path)
+}
+
+// ParseConfig reads and validates a JSON config
+func ParseConfig(data []byte) (*Config, error) {
+	return parseConfig(data, "config")
+}
+
+func parseConfig(data []byte, name string) (*Config, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	config := &Config{}
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("error: %s: %s", name, err)
+	}
+	if problems := config.problems(); len(problems) > 0 {
+		return nil, fmt.Errorf("error: %s: %s", name, strings.Join(problems, "; "))
+	}
+
+	return config, nil
+}
+
+// Validate checks the config, reporting every problem found at once
+func (c *Config) Validate() error {
+	if problems := c.problems(); len(problems) > 0 {
+		return fmt.Errorf("error: config: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+func (c *Config) problems() []string {
+	problems := []string{}
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if err := validateServers(c.Servers); err != nil {
+		problem("servers: %s", strings.TrimPrefix(err.Error(), "error: "))
+	} else if _, err := checkWeights(c.Servers, c.Weights); err != nil {
+		problem("weights: %s", strings.TrimPrefix(err.Error(), "error: "))
+	}
+	if weighted(c.Weights) && c.ServerStrategy != "" && c.TopologyStrategy == "" {
+		problem("weights: need a topology_strategy along with server_strategy")
+	}
+	if c.Capacity < 0 {
+		problem("capacity: must not be negative")
+	}
+	if c.MaxCapacity < 0 {
+		problem("max_capacity: must not be negative")
+	}
+	// compare the capacities the pool ends up with, unset ones defaulted
+	capacity, maxCapacity := c.Capacity, c.MaxCapacity
+	if capacity == 0 {
+		capacity = defaultCapacity
+	}
+	if maxCapacity == 0 {
+		maxCapacity = defaultMaxCapacity
+	}
+	if capacity > 0 && maxCapacity > 0 && maxCapacity < capacity {
+		problem("max_capacity: %d is below capacity %d", maxCapacity, capacity)
+	}
+	if c.IdleTimeout < 0 {
+		problem("idle_timeout: must not be negative")
+	}
+	if c.ConnectionTimeout < 0 {
+		problem("connection_timeout: must not be negative")
+	}
+	if !validJitter(c.TTLJitter) {
+		problem("ttl_jitter: must be at least 0 and below 1")
+	}
+	if c.Replicas < 0 {
+		problem("replicas: must not be negative")
+	}
+	if c.Replicas > len(c.Servers) {
+		problem("replicas: %d is more than the %d servers", c.Replicas, len(c.Servers))
+	}
+	if len(c.FailoverServers) > 0 {
+		if err := validateServers(c.FailoverServers); err != nil {
+			problem("failover_servers: %s", strings.TrimPrefix(err.Error(), "error: "))
+		}
+	} else if c.FailoverWrites || c.MirrorDeletes {
+		problem("failover_servers: required by failover_writes and mirror_deletes")
+	}
+
+	strategies.RLock()
+	if _, ok := serverStrategies[c.ServerStrategy]; !ok && c.ServerStrategy != "" {
+		problem("server_strategy: unknown strategy %q, registered: %s", c.ServerStrategy, registered(serverStrategies))
+	}
+	if _, ok := topologyStrategies[c.TopologyStrategy]; !ok && c.TopologyStrategy != "" {
+		problem("topology_strategy: unknown strategy %q, registered: %s", c.TopologyStrategy, registered(topologyStrategies))
+	}
+	if _, ok := hashKeyStrategies[c.HashKeyStrategy]; !ok && c.HashKeyStrategy != "" {
+		problem("hash_key_strategy: unknown strategy %q, registered: %s", c.HashKeyStrategy, registered(hashKeyStrategies))
+	}
+	if _, ok := hashTagStrategies[c.HashTagStrategy]; !ok && c.HashTagStrategy != "" {
+		problem("hash_tag_strategy: unknown strategy %q, registered: %s", c.HashTagStrategy, registered(hashTagStrategies))
+	}
+	strategies.RUnlock()
+
+	if h := c.HealthCheck; h != nil {
+		if h.Interval < 0 {
+			problem("health_check.interval: must not be negative")
+		}
+		if h.FailureLimit < 0 {
+			problem("health_check.failure_limit: must not be negative")
+		}
+		if h.RetryInterval < 0 {
+			problem("health_check.retry_interval: must not be negative")
+		}
+		if _, ok := ejectPolicies[h.Policy]; !ok && h.Policy != "" {
+			problem("health_check.policy: unknown policy %q, expected %s", h.Policy, registered(ejectPolicies))
+		}
+	}
+
+	if r := c.Retry; r != nil {
+		if r.MaxAttempts < 0 {
+			problem("retry.max_attempts: must not be negative")
+		}
+		if r.Backoff < 0 {
+			problem("retry.backoff: must not be negative")
+		}
+		if r.MaxBackoff < 0 {
+			problem("retry.max_backoff: must not be negative")
+		}
+		for _, name := range r.Commands {
+			if _, ok := retryCommands[name]; !ok {
+				problem("retry.commands: unknown command %q, expected %s", name, registered(retryCommands))
+			}
+		}
+	}
+
+	return problems
+}
+
+// registered lists the names of a registry, sorted
+func registered(registry interface{}) string {
+	names := []string{}
+	switch registry := registry.(type) {
+	case map[string]ServerStrategy:
+		for name := range registry {
+			names = append(names, name)
+		}
+	case map[string]TopologyStrategy:
+		for name := range registry {
+			names = append(names, name)
+		}
+	case map[string]HashKeyStrategy:
+		for name := range registry {
+			names = append(names, name)
+		}
+	case map[string]HashTagStrategy:
+		for name := range registry {
+			names = append(names, name)
+		}
+	case map[string]EjectPolicy:
+		for name := range registry {
+			names = append(names, name)
+		}
+	case map[string]Command:
+		for name := range registry {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
+
+// NewPool validates the config and returns the Pool it describes, not
+// started yet
+func (c *Config) NewPool() (*Pool, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	strategies.RLock()
+	defer strategies.RUnlock()
+
+	pool := &Pool{
+		Servers:           append([]string{}, c.Servers...),
+		Weights:           append([]int{}, c.Weights...),
+		Capacity:          c.Capacity,
+		MaxCapacity:       c.MaxCapacity,
+		ServerStrategy:    serverStrategies[c.ServerStrategy],
+		TopologyStrategy:  topologyStrategies[c.TopologyStrategy],
+		HashKeyStrategy:   hashKeyStrategies[c.HashKeyStrategy],
+		HashTagStrategy:   hashTagStrategies[c.HashTagStrategy],
+		IdleTimeout:       time.Duration(c.IdleTimeout),
+		ConnectionTimeout: time.Duration(c.ConnectionTimeout),
+		TTLJitter:         c.TTLJitter,
+		Replicas:          c.Replicas,
+		FailoverServers:   c.FailoverServers,
+		FailoverPolicy: FailoverPolicy{
+			Writes:        c.FailoverWrites,
+			MirrorDeletes: c.MirrorDeletes,
+		},
+	}
+	if len(c.Weights) == 0 {
+		pool.Weights = nil
+	}
+	if h := c.HealthCheck; h != nil {
+		pool.HealthCheck = &HealthCheck{
+			Interval:      time.Duration(h.Interval),
+			FailureLimit:  h.FailureLimit,
+			RetryInterval: time.Duration(h.RetryInterval),
+			Policy:        ejectPolicies[h.Policy],
+		}
+	}
+	if r := c.Retry; r != nil {
+		pool.RetryPolicy = &RetryPolicy{
+			MaxAttempts: r.MaxAttempts,
+			Backoff:     time.Duration(r.Backoff),
+			MaxBackoff:  time.Duration(r.MaxBackoff),
+		}
+		for _, name := range r.Commands {
+			pool.RetryPolicy.Commands |= retryCommands[name]
+		}
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,204 @@
+package vshard
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ConfigTestSuite struct {
+	suite.Suite
+	Dir string
+}
+
+var registerTestStrategies sync.Once
+
+func (suite *ConfigTestSuite) SetupSuite() {
+	registerTestStrategies.Do(func() {
+		RegisterServerStrategy("first", func(key string, numServers int) int { return 0 })
+		RegisterHashKeyStrategy("prefixed", func(key string) string { return "app:" + key })
+	})
+}
+
+func (suite *ConfigTestSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "vshard")
+	suite.Require().NoError(err)
+	suite.Dir = dir
+}
+
+func (suite *ConfigTestSuite) TearDownTest() {
+	os.RemoveAll(suite.Dir)
+}
+
+func (suite *ConfigTestSuite) writeConfig(content string) string {
+	path := filepath.Join(suite.Dir, "vshard.json")
+	suite.Require().NoError(ioutil.WriteFile(path, []byte(content), 0644))
+
+	return path
+}
+
+func (suite *ConfigTestSuite) TestNewPoolFromConfig() {
+	path := suite.writeConfig(`{
+		"servers": ["127.0.0.1:21210", "127.0.0.1:21211", "127.0.0.1:21212"],
+		"weights": [1, 2, 1],
+		"capacity": 4,
+		"max_capacity": 8,
+		"topology_strategy": "ketama",
+		"hash_key_strategy": "none",
+		"hash_tag_strategy": "brace",
+		"idle_timeout": "2s",
+		"connection_timeout": "150ms",
+		"ttl_jitter": 0.1,
+		"health_check": {"interval": "100ms", "failure_limit": 2, "policy": "rehash"},
+		"retry": {"max_attempts": 2, "backoff": "2ms", "commands": ["get", "gets", "add"]}
+	}`)
+
+	pool, err := NewPoolFromConfig(path)
+	suite.Require().NoError(err)
+
+	suite.Equal(getTestServers()[:3], pool.Servers)
+	suite.Equal([]int{1, 2, 1}, pool.Weights)
+	suite.Equal(4, pool.Capacity)
+	suite.Equal(8, pool.MaxCapacity)
+	suite.Equal(time.Second*2, pool.IdleTimeout)
+	suite.Equal(time.Millisecond*150, pool.ConnectionTimeout)
+	suite.Equal(0.1, pool.TTLJitter)
+	suite.Equal(&HealthCheck{Interval: time.Millisecond * 100, FailureLimit: 2, Policy: EjectRehash}, pool.HealthCheck)
+	suite.Equal(&RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond * 2, Commands: CommandGet | CommandGets | CommandAdd}, pool.RetryPolicy)
+	suite.Equal("key", pool.HashKeyStrategy("key"))
+	suite.Equal("123", pool.HashTagStrategy("user:{123}"))
+	suite.Nil(pool.ServerStrategy)
+
+	pool.Start()
+	defer pool.Close()
+
+	_, err = pool.Set("key", 0, 0, []byte("value"))
+	suite.NoError(err)
+	value, err := pool.Get("key")
+	suite.NoError(err)
+	suite.Equal("value", string(value))
+	tearDownPool(suite.T(), pool)
+}
+
+func (suite *ConfigTestSuite) TestDefaults() {
+	config, err := ParseConfig([]byte(`{"servers": ["127.0.0.1:21210"]}`))
+	suite.Require().NoError(err)
+
+	pool, err := config.NewPool()
+	suite.Require().NoError(err)
+	pool.Start()
+	defer pool.Close()
+
+	suite.Equal(defaultCapacity, pool.Capacity)
+	suite.Equal(defaultIdleTimeout, pool.IdleTimeout)
+	suite.Equal(XXH64KeyStrategy("key"), pool.HashKeyStrategy("key"))
+	suite.Nil(pool.HealthCheck)
+	suite.Nil(pool.RetryPolicy)
+	suite.Nil(pool.Weights)
+}
+
+func (suite *ConfigTestSuite) TestNamedStrategies() {
+	for _, name := range []string{"xxh64", "md5", "farmhash"} {
+		_, err := ParseConfig([]byte(`{"servers": ["127.0.0.1:21210"], "server_strategy": "` + name + `"}`))
+		suite.NoError(err, name)
+	}
+	for _, name := range []string{"xxh64", "md5", "farmhash", "none"} {
+		_, err := ParseConfig([]byte(`{"servers": ["127.0.0.1:21210"], "hash_key_strategy": "` + name + `"}`))
+		suite.NoError(err, name)
+	}
+}
+
+func (suite *ConfigTestSuite) TestCustomStrategies() {
+	config, err := ParseConfig([]byte(`{
+		"servers": ["127.0.0.1:21210", "127.0.0.1:21211"],
+		"server_strategy": "first",
+		"hash_key_strategy": "prefixed"
+	}`))
+	suite.Require().NoError(err)
+
+	pool, err := config.NewPool()
+	suite.Require().NoError(err)
+	suite.Equal(0, pool.ServerStrategy("key", 2))
+	suite.Equal("app:key", pool.HashKey("key"))
+
+	suite.Panics(func() { RegisterServerStrategy("first", XXH64ShardServerStrategy) })
+	suite.Panics(func() { RegisterHashKeyStrategy("nil", nil) })
+}
+
+func (suite *ConfigTestSuite) TestValidation() {
+	_, err := ParseConfig([]byte(`{
+		"servers": ["127.0.0.1:21210", "127.0.0.1"],
+		"capacity": 10,
+		"max_capacity": 5,
+		"server_strategy": "crc32",
+		"ttl_jitter": 1.5,
+		"replicas": 3,
+		"health_check": {"policy": "ignore"},
+		"retry": {"max_attempts": -1, "commands": ["incr"]}
+	}`))
+	suite.Require().Error(err)
+
+	for _, problem := range []string{
+		`servers: invalid server "127.0.0.1"`,
+		"max_capacity: 5 is below capacity 10",
+		`server_strategy: unknown strategy "crc32", registered: farmhash, first, md5, xxh64`,
+		"ttl_jitter: must be at least 0 and below 1",
+		"replicas: 3 is more than the 2 servers",
+		`health_check.policy: unknown policy "ignore", expected miss, rehash`,
+		"retry.max_attempts: must not be negative",
+		`retry.commands: unknown command "incr", expected add, append, cas, delete, get, gets, prepend, replace, set, update`,
+	} {
+		suite.Contains(err.Error(), problem)
+	}
+
+	// unset capacities are compared with their defaults
+	_, err = ParseConfig([]byte(`{"servers": ["127.0.0.1:21210"], "capacity": 10}`))
+	suite.Error(err)
+	suite.Contains(err.Error(), "max_capacity: 5 is below capacity 10")
+	_, err = ParseConfig([]byte(`{"servers": ["127.0.0.1:21210"], "max_capacity": 2}`))
+	suite.Error(err)
+	suite.Contains(err.Error(), "max_capacity: 2 is below capacity 5")
+
+	_, err = ParseConfig([]byte(`{"servers": ["127.0.0.1:21210"], "weights": [1, 2]}`))
+	suite.Error(err)
+	_, err = ParseConfig([]byte(`{"servers": ["127.0.0.1:21210"], "weights": [2], "server_strategy": "md5"}`))
+	suite.Error(err)
+	_, err = ParseConfig([]byte(`{"servers": ["127.0.0.1:21210"], "weights": [2], "server_strategy": "md5", "topology_strategy": "ketama"}`))
+	suite.NoError(err)
+	_, err = ParseConfig([]byte(`{"servers": ["127.0.0.1:21210"], "weights": [1], "server_strategy": "md5"}`))
+	suite.NoError(err)
+	_, err = ParseConfig([]byte(`{"servers": ["127.0.0.1:21210", "127.0.0.1:21211"], "weights": [1, 0]}`))
+	suite.Error(err)
+	_, err = ParseConfig([]byte(`{"servers": []}`))
+	suite.Error(err)
+	_, err = ParseConfig([]byte(`{"servers": ["127.0.0.1:21210"], "failover_writes": true}`))
+	suite.Error(err)
+}
+
+func (suite *ConfigTestSuite) TestDecodingErrors() {
+	_, err := ParseConfig([]byte(`{"servers": ["127.0.0.1:21210"], "capacty": 4}`))
+	suite.Require().Error(err)
+	suite.Contains(err.Error(), "capacty")
+
+	_, err = ParseConfig([]byte(`{"servers": ["127.0.0.1:21210"], "idle_timeout": 500}`))
+	suite.Require().Error(err)
+	suite.Contains(err.Error(), `duration must be a string like "500ms"`)
+
+	path := suite.writeConfig(`{"servers": `)
+	_, err = NewPoolFromConfig(path)
+	suite.Require().Error(err)
+	suite.True(strings.HasPrefix(err.Error(), "error: config "+path+": "), err.Error())
+
+	_, err = NewPoolFromConfig(filepath.Join(suite.Dir, "missing.json"))
+	suite.Error(err)
+}
+
+func TestConfigTestSuite(t *testing.T) {
+	suite.Run(t, new(ConfigTestSuite))
+}
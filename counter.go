@@ -0,0 +1,56 @@
+package vshard
+
+import (
+	"context"
+	"errors"
+	"strconv"
+)
+
+var errCounterRefused = errors.New("error: counter update refused")
+
+// addCounter atomically adds delta to the decimal counter stored in key,
+// never letting it go below floor, and returns the new value
+func (v *Pool) addCounter(key string, delta, floor, timeout uint64) (uint64, error) {
+	value, _, err := v.updateCounter(key, timeout, func(current uint64) (uint64, bool) {
+		if current+delta < floor {
+			return floor, true
+		}
+		return current + delta, true
+	})
+
+	return value, err
+}
+
+// updateCounter atomically replaces the decimal counter stored in key (zero
+// when missing) with the value returned by fn, which can refuse the update.
+// The memcached driver has no incr, so counters are updated with Update.
+// It returns the new value, or the current one when refused.
+func (v *Pool) updateCounter(key string, timeout uint64, fn func(current uint64) (uint64, bool)) (uint64, bool, error) {
+	var current uint64
+
+	encoded, err := v.Update(context.Background(), key, timeout, func(old []byte, exists bool) ([]byte, error) {
+		current = 0
+		if exists {
+			var err error
+			if current, err = strconv.ParseUint(string(old), 10, 64); err != nil {
+				return nil, err
+			}
+		}
+
+		value, ok := fn(current)
+		if !ok {
+			return nil, errCounterRefused
+		}
+
+		return []byte(strconv.FormatUint(value, 10)), nil
+	})
+	if err == errCounterRefused {
+		return current, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	value, err := strconv.ParseUint(string(encoded), 10, 64)
+	return value, err == nil, err
+}
@@ -0,0 +1,412 @@
+package vshard
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDiscoveryInterval = time.Second * 10
+	defaultDiscoveryDebounce = time.Second * 5
+	defaultDiscoveryTimeout  = time.Second * 5
+)
+
+// Discoverer finds the servers of a pool, along with their weights, which
+// are nil when all servers weigh the same
+type Discoverer interface {
+	Discover(ctx context.Context) ([]string, []int, error)
+}
+
+// Discovery configures how a Pool follows the servers found by a
+// Discoverer. Every Interval the servers are discovered again, and a new
+// list is applied with UpdateWeightedServers once it stayed the same for
+// Debounce, so servers coming and going during a scaling burst only move
+// keys once. Lists with invalid addresses or weights, duplicates, or fewer
+// than MinServers servers are refused. Errors go to OnError, or the log.
+//
+// A Pool started without Servers takes them from the Discoverer.
+//
+// Discovered servers are added and removed anywhere in the list, which
+// reshuffles most keys under strategies picking servers by position, such
+// as the default jump hash. A Pool with Discovery and no strategy set
+// defaults TopologyStrategy to RendezvousServerStrategy, a ServerStrategy
+// or TopologyStrategy set along with Discovery should rank servers by
+// address too, as rendezvous hashing and ketama do.
+type Discovery struct {
+	Discoverer Discoverer
+	Interval   time.Duration
+	Debounce   time.Duration
+	MinServers int
+	OnError    func(err error)
+}
+
+type discoveryWatcher struct {
+	Discovery
+	debouncer
+	stop chan struct{}
+	done chan struct{}
+}
+
+// debouncer holds a discovered server list back until it stays the same
+// for a while
+type debouncer struct {
+	wait    time.Duration
+	servers []string
+	weights []int
+	since   time.Time
+}
+
+// observe records a discovered server list that differs from the one in
+// use, telling if it's been stable long enough to be applied
+func (d *debouncer) observe(servers []string, weights []int, now time.Time) bool {
+	if !sameServers(d.servers, d.weights, servers, weights) {
+		d.servers, d.weights, d.since = servers, weights, now
+	}
+
+	return now.Sub(d.since) >= d.wait
+}
+
+// reset forgets the list held back, once the one in use matches it
+func (d *debouncer) reset() {
+	d.servers, d.weights = nil, nil
+}
+
+func sameServers(servers []string, weights []int, others []string, otherWeights []int) bool {
+	if len(servers) != len(others) || servers == nil || others == nil {
+		return false
+	}
+
+	for i := range servers {
+		if servers[i] != others[i] || weights[i] != otherWeights[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// discover returns the servers found by the Discoverer, with their weights
+// normalized, or an error when the list isn't valid
+func (d *Discovery) discover() ([]string, []int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDiscoveryTimeout)
+	defer cancel()
+
+	servers, weights, err := d.Discoverer.Discover(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := validateServers(servers); err != nil {
+		return nil, nil, err
+	}
+	if len(servers) < d.MinServers {
+		return nil, nil, fmt.Errorf("error: discovered %d servers, at least %d required", len(servers), d.MinServers)
+	}
+
+	weights, err = checkWeights(servers, weights)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return servers, weights, nil
+}
+
+// validateServers checks servers is a list of distinct host:port addresses
+// or unix socket paths
+func validateServers(servers []string) error {
+	if len(servers) == 0 {
+		return ErrNoServers
+	}
+
+	seen := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		if seen[server] {
+			return fmt.Errorf("error: duplicate server %s", server)
+		}
+		seen[server] = true
+
+		// memcache.Connect dials addresses with a slash over a unix socket
+		if strings.Contains(server, "/") {
+			continue
+		}
+
+		host, port, err := net.SplitHostPort(server)
+		if err != nil {
+			return fmt.Errorf("error: invalid server %q: %s", server, err)
+		}
+		if host == "" {
+			return fmt.Errorf("error: invalid server %q: missing host", server)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return fmt.Errorf("error: invalid server %q: bad port", server)
+		}
+	}
+
+	return nil
+}
+
+// discoverServers fills Servers and Weights from the Discoverer when a pool
+// is started without servers
+func (v *Pool) discoverServers() {
+	if v.Discovery == nil || len(v.Servers) > 0 {
+		return
+	}
+
+	servers, weights, err := v.Discovery.discover()
+	if err != nil {
+		log.Fatalf("Can't discover memcached servers: %s", err)
+	}
+	v.Servers, v.Weights = servers, weights
+}
+
+// startDiscovery starts following the servers found by the Discoverer
+func (v *Pool) startDiscovery() {
+	watcher := &discoveryWatcher{
+		Discovery: *v.Discovery,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if watcher.Interval == 0 {
+		watcher.Interval = defaultDiscoveryInterval
+	}
+	watcher.wait = watcher.Debounce
+	if watcher.wait == 0 {
+		watcher.wait = defaultDiscoveryDebounce
+	}
+
+	v.update.Lock()
+	v.discovery = watcher
+	v.update.Unlock()
+
+	go v.runDiscovery(watcher)
+}
+
+func (v *Pool) runDiscovery(watcher *discoveryWatcher) {
+	defer close(watcher.done)
+
+	ticker := time.NewTicker(watcher.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-watcher.stop:
+			return
+		case <-ticker.C:
+			if err := v.refreshServers(watcher, time.Now()); err != nil {
+				watcher.error(err)
+			}
+		}
+	}
+}
+
+// refreshServers discovers the servers again, applying the list found once
+// it's been stable for the debounce period
+func (v *Pool) refreshServers(watcher *discoveryWatcher, now time.Time) error {
+	servers, weights, err := watcher.discover()
+	if err != nil {
+		return err
+	}
+
+	v.RLock()
+	current := sameServers(v.Servers, v.weights, servers, weights)
+	v.RUnlock()
+
+	if current {
+		watcher.reset()
+		return nil
+	}
+	if !watcher.observe(servers, weights, now) {
+		return nil
+	}
+
+	if err := v.UpdateWeightedServers(servers, weights); err != nil {
+		return err
+	}
+	watcher.reset()
+
+	return nil
+}
+
+func (w *discoveryWatcher) error(err error) {
+	if w.OnError != nil {
+		w.OnError(err)
+		return
+	}
+
+	log.Printf("vshard: server discovery failed: %s", err)
+}
+
+// FileDiscoverer reads the servers from a file, either a JSON list of
+// addresses or of {"server": ..., "weight": ...} objects, or plain text
+// with an address per line, optionally followed by its weight. Blank lines
+// and lines starting with # are skipped. The file is only read again when
+// its modification time or size changes.
+type FileDiscoverer struct {
+	Path    string
+	modTime time.Time
+	size    int64
+	servers []string
+	weights []int
+}
+
+type fileServer struct {
+	Server string `json:"server"`
+	Weight int    `json:"weight"`
+}
+
+// Discover returns the servers listed in the file
+func (f *FileDiscoverer) Discover(ctx context.Context) ([]string, []int, error) {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size && f.servers != nil {
+		return f.servers, f.weights, nil
+	}
+
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	servers, weights, err := parseServers(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error: can't parse %s: %s", f.Path, err)
+	}
+	f.modTime, f.size, f.servers, f.weights = info.ModTime(), info.Size(), servers, weights
+
+	return servers, weights, nil
+}
+
+// parseServers reads a server list in any of the formats of FileDiscoverer
+func parseServers(data []byte) ([]string, []int, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		return parseJSONServers(data)
+	}
+
+	servers, weights := []string{}, []int{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, nil, fmt.Errorf("bad line %q", scanner.Text())
+		}
+
+		weight := 1
+		if len(fields) == 2 {
+			var err error
+			if weight, err = strconv.Atoi(fields[1]); err != nil {
+				return nil, nil, fmt.Errorf("bad weight in line %q", scanner.Text())
+			}
+		}
+		servers = append(servers, fields[0])
+		weights = append(weights, weight)
+	}
+
+	return servers, weights, scanner.Err()
+}
+
+func parseJSONServers(data []byte) ([]string, []int, error) {
+	servers := []string{}
+	if err := json.Unmarshal(data, &servers); err == nil {
+		return servers, nil, nil
+	}
+
+	entries := []fileServer{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, nil, err
+	}
+
+	servers = make([]string, 0, len(entries))
+	weights := make([]int, len(entries))
+	for i, entry := range entries {
+		servers = append(servers, entry.Server)
+		weights[i] = entry.Weight
+		if weights[i] == 0 {
+			weights[i] = 1
+		}
+	}
+
+	return servers, weights, nil
+}
+
+// SRVResolver looks up DNS SRV records, as net.Resolver does
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// SRVDiscoverer finds the servers in the SRV records of
+// _Service._Proto.Name, like _memcache._tcp.cache.example.com. Only the
+// records with the lowest priority are used, the others being backups, and
+// their SRV weights become the server weights. Resolver defaults to
+// net.DefaultResolver.
+type SRVDiscoverer struct {
+	Service  string
+	Proto    string
+	Name     string
+	Resolver SRVResolver
+}
+
+// Discover returns the servers found in the SRV records, sorted by address
+func (s *SRVDiscoverer) Discover(ctx context.Context) ([]string, []int, error) {
+	var resolver SRVResolver = net.DefaultResolver
+	if s.Resolver != nil {
+		resolver = s.Resolver
+	}
+
+	_, records, err := resolver.LookupSRV(ctx, s.Service, s.Proto, s.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil, ErrNoServers
+	}
+
+	priority := records[0].Priority
+	for _, record := range records {
+		if record.Priority < priority {
+			priority = record.Priority
+		}
+	}
+
+	selected := []*net.SRV{}
+	for _, record := range records {
+		if record.Priority == priority {
+			selected = append(selected, record)
+		}
+	}
+
+	servers := make([]string, len(selected))
+	weights := make([]int, len(selected))
+	sort.Slice(selected, func(i, j int) bool {
+		if selected[i].Target != selected[j].Target {
+			return selected[i].Target < selected[j].Target
+		}
+		return selected[i].Port < selected[j].Port
+	})
+	for i, record := range selected {
+		host := strings.TrimSuffix(record.Target, ".")
+		servers[i] = net.JoinHostPort(host, strconv.Itoa(int(record.Port)))
+		weights[i] = int(record.Weight)
+		if weights[i] == 0 {
+			weights[i] = 1
+		}
+	}
+
+	return servers, weights, nil
+}
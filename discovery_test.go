@@ -0,0 +1,244 @@
+package vshard
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type DiscoveryTestSuite struct {
+	suite.Suite
+	Dir string
+}
+
+func (suite *DiscoveryTestSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "vshard")
+	suite.Require().NoError(err)
+	suite.Dir = dir
+}
+
+func (suite *DiscoveryTestSuite) TearDownTest() {
+	os.RemoveAll(suite.Dir)
+}
+
+// writeServers writes a server list file, returning its path
+func (suite *DiscoveryTestSuite) writeServers(content string) string {
+	path := filepath.Join(suite.Dir, "servers")
+	suite.Require().NoError(ioutil.WriteFile(path+".tmp", []byte(content), 0644))
+	suite.Require().NoError(os.Rename(path+".tmp", path))
+
+	return path
+}
+
+// fakeResolver answers SRV lookups with records, or err
+type fakeResolver struct {
+	lock    sync.Mutex
+	records []*net.SRV
+	err     error
+	lookups []string
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.lookups = append(r.lookups, "_"+service+"._"+proto+"."+name)
+
+	return "", r.records, r.err
+}
+
+func (r *fakeResolver) set(records ...*net.SRV) {
+	r.lock.Lock()
+	r.records = records
+	r.lock.Unlock()
+}
+
+func srv(server string, priority, weight uint16) *net.SRV {
+	host, port, _ := net.SplitHostPort(server)
+	n, _ := net.LookupPort("tcp", port)
+
+	return &net.SRV{Target: host + ".", Port: uint16(n), Priority: priority, Weight: weight}
+}
+
+func (suite *DiscoveryTestSuite) TestParseServers() {
+	formats := map[string][]int{
+		"127.0.0.1:21210\n# comment\n\n127.0.0.1:21211 3\n":                           {1, 3},
+		`["127.0.0.1:21210", "127.0.0.1:21211"]`:                                      nil,
+		`[{"server": "127.0.0.1:21210"}, {"server": "127.0.0.1:21211", "weight": 3}]`: {1, 3},
+	}
+
+	for content, weights := range formats {
+		servers, parsedWeights, err := parseServers([]byte(content))
+		suite.NoError(err, content)
+		suite.Equal(getTestServers()[:2], servers, content)
+		suite.Equal(weights, parsedWeights, content)
+	}
+
+	for _, content := range []string{"127.0.0.1:21210 x", "127.0.0.1:21210 1 2", `[{"server": 1}]`} {
+		_, _, err := parseServers([]byte(content))
+		suite.Error(err, content)
+	}
+}
+
+func (suite *DiscoveryTestSuite) TestValidation() {
+	for _, servers := range [][]string{
+		{},
+		{"127.0.0.1"},
+		{":21210"},
+		{"127.0.0.1:0"},
+		{"127.0.0.1:memcache"},
+		{"127.0.0.1:21210", "127.0.0.1:21210"},
+	} {
+		suite.Error(validateServers(servers), strings.Join(servers, ","))
+	}
+	suite.NoError(validateServers([]string{"cache-1.example.com:11211", "[::1]:11211", "/var/run/memcached.sock"}))
+	suite.Error(validateServers([]string{"/var/run/memcached.sock", "/var/run/memcached.sock"}))
+
+	discovery := &Discovery{
+		Discoverer: &FileDiscoverer{Path: suite.writeServers("127.0.0.1:21210\n")},
+		MinServers: 2,
+	}
+	_, _, err := discovery.discover()
+	suite.Error(err)
+}
+
+func (suite *DiscoveryTestSuite) TestDebounce() {
+	d := &debouncer{wait: time.Second}
+	start := time.Now()
+	servers, weights := getTestServers()[:2], []int{1, 1}
+
+	suite.False(d.observe(servers, weights, start))
+	suite.False(d.observe(servers, weights, start.Add(time.Millisecond*500)))
+
+	// a different list starts over
+	suite.False(d.observe(getTestServers()[:3], []int{1, 1, 1}, start.Add(time.Millisecond*800)))
+	suite.False(d.observe(getTestServers()[:3], []int{1, 1, 1}, start.Add(time.Millisecond*1500)))
+	suite.True(d.observe(getTestServers()[:3], []int{1, 1, 1}, start.Add(time.Millisecond*1800)))
+
+	// so does a weight change
+	suite.False(d.observe(getTestServers()[:3], []int{1, 2, 1}, start.Add(time.Millisecond*1900)))
+}
+
+func (suite *DiscoveryTestSuite) TestFileDiscovery() {
+	path := suite.writeServers("127.0.0.1:21210\n127.0.0.1:21211\n")
+
+	var lock sync.Mutex
+	errs := []error{}
+	pool := &Pool{
+		Discovery: &Discovery{
+			Discoverer: &FileDiscoverer{Path: path},
+			Interval:   time.Millisecond * 10,
+			Debounce:   time.Millisecond * 50,
+			OnError: func(err error) {
+				lock.Lock()
+				errs = append(errs, err)
+				lock.Unlock()
+			},
+		},
+	}
+	pool.Start()
+	defer pool.Close()
+
+	suite.Equal(getTestServers()[:2], pool.Servers)
+
+	suite.writeServers("127.0.0.1:21210\n127.0.0.1:21211\n127.0.0.1:21212 2\n")
+	suite.True(waitFor(func() bool { return len(pool.Status()) == 3 }))
+	suite.Equal(2, pool.Status()[2].Weight)
+
+	// invalid lists are refused
+	suite.writeServers("127.0.0.1:21210\n127.0.0.1:21210\n")
+	suite.True(waitFor(func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(errs) > 0
+	}))
+	suite.Len(pool.Status(), 3)
+}
+
+func (suite *DiscoveryTestSuite) TestSRVDiscoverer() {
+	servers := getTestServers()
+	resolver := &fakeResolver{}
+	resolver.set(srv(servers[1], 10, 2), srv(servers[0], 10, 0), srv(servers[2], 20, 1))
+
+	discoverer := &SRVDiscoverer{Service: "memcache", Proto: "tcp", Name: "cache.local", Resolver: resolver}
+	found, weights, err := discoverer.Discover(context.Background())
+	suite.NoError(err)
+	suite.Equal(servers[:2], found)
+	suite.Equal([]int{1, 2}, weights)
+	suite.Equal([]string{"_memcache._tcp.cache.local"}, resolver.lookups)
+
+	resolver.set()
+	_, _, err = discoverer.Discover(context.Background())
+	suite.Equal(ErrNoServers, err)
+
+	resolver.err = errors.New("no such host")
+	_, _, err = discoverer.Discover(context.Background())
+	suite.Error(err)
+}
+
+func (suite *DiscoveryTestSuite) TestSRVDiscovery() {
+	servers := getTestServers()
+	resolver := &fakeResolver{}
+	resolver.set(srv(servers[0], 0, 0), srv(servers[1], 0, 0))
+
+	pool := &Pool{
+		Discovery: &Discovery{
+			Discoverer: &SRVDiscoverer{Service: "memcache", Proto: "tcp", Name: "cache.local", Resolver: resolver},
+			Interval:   time.Millisecond * 10,
+			Debounce:   time.Millisecond * 50,
+		},
+	}
+	pool.Start()
+	defer pool.Close()
+
+	suite.Equal(servers[:2], pool.Servers)
+
+	resolver.set(srv(servers[0], 0, 0))
+	suite.True(waitFor(func() bool { return len(pool.Status()) == 1 }))
+}
+
+func (suite *DiscoveryTestSuite) TestRemovedServerOnlyMovesItsKeys() {
+	path := suite.writeServers("127.0.0.1:21210\n127.0.0.1:21211\n127.0.0.1:21212\n")
+
+	pool := &Pool{
+		Discovery: &Discovery{
+			Discoverer: &FileDiscoverer{Path: path},
+			Interval:   time.Millisecond * 10,
+			Debounce:   time.Millisecond * 50,
+		},
+	}
+	pool.Start()
+	defer pool.Close()
+	suite.NotNil(pool.TopologyStrategy)
+
+	owners := map[string]string{}
+	pool.RLock()
+	for _, key := range testKeys(200) {
+		owners[key] = pool.Servers[pool.locate(key)]
+	}
+	pool.RUnlock()
+
+	suite.writeServers("127.0.0.1:21210\n127.0.0.1:21212\n")
+	suite.True(waitFor(func() bool { return len(pool.Status()) == 2 }))
+
+	pool.RLock()
+	defer pool.RUnlock()
+	for key, owner := range owners {
+		if owner != getTestServers()[1] {
+			suite.Equal(owner, pool.Servers[pool.locate(key)], key)
+		}
+	}
+}
+
+func TestDiscoveryTestSuite(t *testing.T) {
+	suite.Run(t, new(DiscoveryTestSuite))
+}
@@ -0,0 +1,142 @@
+package vshard
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// maxRelativeTimeout is the largest timeout memcached reads as seconds from
+// now, anything above it is read as an absolute Unix timestamp
+const maxRelativeTimeout = 60 * 60 * 24 * 30
+
+var (
+	// ErrInvalidExpiration defines the error for negative TTLs and expiration times in the past
+	ErrInvalidExpiration = errors.New("error: invalid expiration")
+)
+
+// DurationTimeout converts a TTL into a memcached timeout, zero means the item
+// never expires. TTLs are rounded up to whole seconds and TTLs longer than
+// 30 days are sent as absolute timestamps, as memcached expects.
+func DurationTimeout(ttl time.Duration) (uint64, error) {
+	if ttl < 0 {
+		return 0, ErrInvalidExpiration
+	}
+
+	seconds := uint64((ttl + time.Second - 1) / time.Second)
+	if seconds > maxRelativeTimeout {
+		return uint64(time.Now().Unix()) + seconds, nil
+	}
+
+	return seconds, nil
+}
+
+// TimeTimeout converts an expiration time into a memcached timeout, the zero
+// time means the item never expires
+func TimeTimeout(expiration time.Time) (uint64, error) {
+	if expiration.IsZero() {
+		return 0, nil
+	}
+	if !expiration.After(time.Now()) {
+		return 0, ErrInvalidExpiration
+	}
+
+	return uint64(expiration.Unix()), nil
+}
+
+// validJitter tells if jitter is a valid TTLJitter, a fraction in [0, 1)
+func validJitter(jitter float64) bool {
+	return jitter >= 0 && jitter < 1
+}
+
+// ttlTimeout converts ttl into a timeout, taking up to TTLJitter of it off
+// at random so keys written together don't expire together
+func (v *Pool) ttlTimeout(ttl time.Duration) (uint64, error) {
+	if ttl > 0 && v.TTLJitter > 0 {
+		ttl -= time.Duration(rand.Float64() * v.TTLJitter * float64(ttl))
+	}
+
+	return DurationTimeout(ttl)
+}
+
+// SetFor sets the value with specified cache key, expiring it after ttl
+func (v *Pool) SetFor(key string, flags uint16, ttl time.Duration, value []byte) (bool, error) {
+	timeout, err := v.ttlTimeout(ttl)
+	if err != nil {
+		return false, err
+	}
+
+	return v.Set(key, flags, timeout, value)
+}
+
+// SetUntil sets the value with specified cache key, expiring it at expiration
+func (v *Pool) SetUntil(key string, flags uint16, expiration time.Time, value []byte) (bool, error) {
+	timeout, err := TimeTimeout(expiration)
+	if err != nil {
+		return false, err
+	}
+
+	return v.Set(key, flags, timeout, value)
+}
+
+// AddFor store the value only if it does not already exist, expiring it after ttl
+func (v *Pool) AddFor(key string, flags uint16, ttl time.Duration, value []byte) (bool, error) {
+	timeout, err := v.ttlTimeout(ttl)
+	if err != nil {
+		return false, err
+	}
+
+	return v.Add(key, flags, timeout, value)
+}
+
+// AddUntil store the value only if it does not already exist, expiring it at expiration
+func (v *Pool) AddUntil(key string, flags uint16, expiration time.Time, value []byte) (bool, error) {
+	timeout, err := TimeTimeout(expiration)
+	if err != nil {
+		return false, err
+	}
+
+	return v.Add(key, flags, timeout, value)
+}
+
+// ReplaceFor replaces the value only if it already exists, expiring it after ttl
+func (v *Pool) ReplaceFor(key string, flags uint16, ttl time.Duration, value []byte) (bool, error) {
+	timeout, err := v.ttlTimeout(ttl)
+	if err != nil {
+		return false, err
+	}
+
+	return v.Replace(key, flags, timeout, value)
+}
+
+// ReplaceUntil replaces the value only if it already exists, expiring it at expiration
+func (v *Pool) ReplaceUntil(key string, flags uint16, expiration time.Time, value []byte) (bool, error) {
+	timeout, err := TimeTimeout(expiration)
+	if err != nil {
+		return false, err
+	}
+
+	return v.Replace(key, flags, timeout, value)
+}
+
+// CasFor stores the value only if no one else has updated the data since you
+// read it last, expiring it after ttl
+func (v *Pool) CasFor(key string, flags uint16, ttl time.Duration, value []byte, cas uint64) (bool, error) {
+	timeout, err := v.ttlTimeout(ttl)
+	if err != nil {
+		return false, err
+	}
+
+	return v.Cas(key, flags, timeout, value, cas)
+}
+
+// CasUntil stores the value only if no one else has updated the data since you
+// read it last, expiring it at expiration
+func (v *Pool) CasUntil(key string, flags uint16, expiration time.Time, value []byte, cas uint64) (bool, error) {
+	timeout, err := TimeTimeout(expiration)
+	if err != nil {
+		return false, err
+	}
+
+	return v.Cas(key, flags, timeout, value, cas)
+}
@@ -0,0 +1,152 @@
+package vshard
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ExpirationTestSuite struct {
+	suite.Suite
+	Pool *Pool
+}
+
+func (suite *ExpirationTestSuite) SetupSuite() {
+	suite.Pool = setupPool(suite.T())
+}
+
+func (suite *ExpirationTestSuite) TearDownTest() {
+	suite.Pool.TTLJitter = 0
+	tearDownPool(suite.T(), suite.Pool)
+}
+
+func (suite *ExpirationTestSuite) TestDurationTimeout() {
+	timeout, err := DurationTimeout(0)
+	suite.NoError(err)
+	suite.Equal(uint64(0), timeout)
+
+	timeout, err = DurationTimeout(time.Millisecond)
+	suite.NoError(err)
+	suite.Equal(uint64(1), timeout)
+
+	timeout, err = DurationTimeout(time.Hour * 24 * 30)
+	suite.NoError(err)
+	suite.Equal(uint64(maxRelativeTimeout), timeout)
+
+	timeout, err = DurationTimeout(time.Hour * 24 * 31)
+	suite.NoError(err)
+	expected := time.Now().Add(time.Hour * 24 * 31).Unix()
+	suite.InDelta(expected, int64(timeout), 2, "TTLs over 30 days should become timestamps")
+
+	_, err = DurationTimeout(-time.Second)
+	suite.Equal(ErrInvalidExpiration, err)
+}
+
+func (suite *ExpirationTestSuite) TestTimeTimeout() {
+	timeout, err := TimeTimeout(time.Time{})
+	suite.NoError(err)
+	suite.Equal(uint64(0), timeout)
+
+	expiration := time.Now().Add(time.Hour)
+	timeout, err = TimeTimeout(expiration)
+	suite.NoError(err)
+	suite.Equal(uint64(expiration.Unix()), timeout)
+
+	_, err = TimeTimeout(time.Now().Add(-time.Hour))
+	suite.Equal(ErrInvalidExpiration, err)
+}
+
+func (suite *ExpirationTestSuite) TestSetFor() {
+	ok, err := suite.Pool.SetFor("set-for-short", 0, time.Second, []byte("value"))
+	suite.True(ok)
+	suite.NoError(err)
+
+	ok, err = suite.Pool.SetFor("set-for-long", 0, time.Hour*24*31, []byte("value"))
+	suite.True(ok)
+	suite.NoError(err)
+
+	time.Sleep(time.Millisecond * 2100)
+
+	_, err = suite.Pool.Get("set-for-short")
+	suite.Equal(ErrKeyNotFound, err)
+
+	value, err := suite.Pool.Get("set-for-long")
+	suite.NoError(err, "a 31 days TTL must not be read as a date in 1970")
+	suite.Equal("value", string(value))
+
+	ok, err = suite.Pool.SetFor("set-for-negative", 0, -time.Second, []byte("value"))
+	suite.False(ok)
+	suite.Equal(ErrInvalidExpiration, err)
+}
+
+func (suite *ExpirationTestSuite) TestSetUntil() {
+	ok, err := suite.Pool.SetUntil("set-until", 0, time.Now().Add(time.Hour), []byte("value"))
+	suite.True(ok)
+	suite.NoError(err)
+
+	value, err := suite.Pool.Get("set-until")
+	suite.NoError(err)
+	suite.Equal("value", string(value))
+
+	ok, err = suite.Pool.SetUntil("set-until-past", 0, time.Now().Add(-time.Hour), []byte("value"))
+	suite.False(ok)
+	suite.Equal(ErrInvalidExpiration, err)
+}
+
+func (suite *ExpirationTestSuite) TestAddReplaceCas() {
+	ok, err := suite.Pool.AddFor("add-for", 0, time.Hour, []byte("added"))
+	suite.True(ok)
+	suite.NoError(err)
+
+	ok, err = suite.Pool.AddUntil("add-for", 0, time.Now().Add(time.Hour), []byte("again"))
+	suite.False(ok)
+	suite.NoError(err)
+
+	ok, err = suite.Pool.ReplaceFor("add-for", 0, time.Hour, []byte("replaced"))
+	suite.True(ok)
+	suite.NoError(err)
+
+	results, err := suite.Pool.Gets("add-for")
+	suite.NoError(err)
+	if suite.Len(results, 1) {
+		ok, err = suite.Pool.CasUntil("add-for", 0, time.Now().Add(time.Hour), []byte("cas"), results[0].Cas)
+		suite.True(ok)
+		suite.NoError(err)
+	}
+
+	value, err := suite.Pool.Get("add-for")
+	suite.NoError(err)
+	suite.Equal("cas", string(value))
+}
+
+func (suite *ExpirationTestSuite) TestTTLJitter() {
+	suite.Pool.TTLJitter = 0.5
+	seen := make(map[uint64]bool)
+
+	for i := 0; i < 100; i++ {
+		timeout, err := suite.Pool.ttlTimeout(time.Second * 1000)
+		suite.NoError(err)
+		suite.True(timeout >= 500 && timeout <= 1000, "jitter should stay within half the TTL")
+		seen[timeout] = true
+	}
+	suite.True(len(seen) > 1, "timeouts should be spread")
+
+	timeout, err := suite.Pool.ttlTimeout(0)
+	suite.NoError(err)
+	suite.Equal(uint64(0), timeout, "keys without TTL must not get one")
+}
+
+func (suite *ExpirationTestSuite) TestValidJitter() {
+	for _, jitter := range []float64{0, 0.1, 0.99} {
+		suite.True(validJitter(jitter), "jitter %v", jitter)
+	}
+	for _, jitter := range []float64{-0.1, 1, 1.5, math.NaN()} {
+		suite.False(validJitter(jitter), "jitter %v", jitter)
+	}
+}
+
+func TestExpirationTestSuite(t *testing.T) {
+	suite.Run(t, new(ExpirationTestSuite))
+}
@@ -0,0 +1,114 @@
+package vshard
+
+// FailoverPolicy decides which commands go to a Pool's Failover. Reads
+// always fail over.
+type FailoverPolicy struct {
+	// Writes sends storage commands and deletes to the Failover too
+	Writes bool
+	// MirrorDeletes deletes keys from both the primary and the Failover,
+	// so values written to the Failover during an outage aren't served
+	// stale during the next one
+	MirrorDeletes bool
+}
+
+// startFailover starts a Failover pool for FailoverServers, with the same
+// routing, retry and connection settings as the primary. Weights apply when
+// FailoverServers pair with Servers one to one.
+func (v *Pool) startFailover() {
+	if v.Failover != nil || len(v.FailoverServers) == 0 {
+		return
+	}
+
+	v.Failover = &Pool{
+		Servers:           v.FailoverServers,
+		Capacity:          v.Capacity,
+		MaxCapacity:       v.MaxCapacity,
+		ServerStrategy:    v.ServerStrategy,
+		TopologyStrategy:  v.TopologyStrategy,
+		HashKeyStrategy:   v.HashKeyStrategy,
+		HashTagStrategy:   v.HashTagStrategy,
+		IdleTimeout:       v.IdleTimeout,
+		ConnectionTimeout: v.ConnectionTimeout,
+		UpdatePolicy:      v.UpdatePolicy,
+		RetryPolicy:       v.RetryPolicy,
+		TTLJitter:         v.TTLJitter,
+		HealthCheck:       v.HealthCheck,
+		Replicas:          v.Replicas,
+	}
+	if len(v.Weights) == len(v.FailoverServers) {
+		v.Failover.Weights = v.Weights
+	}
+	v.Failover.Start()
+	v.ownsFailover = true
+}
+
+// failedServer tells if err means the server couldn't serve the request at
+// all, a network or I/O failure, as opposed to a miss, a refused write or an
+// error replied by a healthy server
+func failedServer(err error) bool {
+	return err == ErrServerDown || transientError(err)
+}
+
+// failRead tells if a read of key failing with err goes to the Failover,
+// recording it
+func (v *Pool) failRead(key string, err error) bool {
+	if v.Failover == nil || !failedServer(err) {
+		return false
+	}
+	v.recordFailover(key)
+
+	return true
+}
+
+// failWrite tells if a write of key failing with err goes to the Failover,
+// recording it
+func (v *Pool) failWrite(key string, err error) bool {
+	if !v.FailoverPolicy.Writes {
+		return false
+	}
+
+	return v.failRead(key, err)
+}
+
+// deleteFailover completes a delete of key on the Failover, as the policy says
+func (v *Pool) deleteFailover(key string, deleted bool, err error) (bool, error) {
+	switch {
+	case v.FailoverPolicy.MirrorDeletes:
+		mirrored, mirrorErr := v.Failover.Delete(key)
+		if failedServer(err) {
+			v.recordFailover(key)
+			return mirrored, mirrorErr
+		}
+		if err == nil {
+			err = mirrorErr
+		}
+
+		return deleted || mirrored, err
+	case v.failWrite(key, err):
+		return v.Failover.Delete(key)
+	}
+
+	return deleted, err
+}
+
+// recordFailover counts a failover for the server owning key
+func (v *Pool) recordFailover(key string) {
+	v.RLock()
+	server := v.Servers[v.locate(key)]
+	v.RUnlock()
+
+	v.failoverLock.Lock()
+	if v.failovers == nil {
+		v.failovers = make(map[string]int64)
+	}
+	v.failovers[server]++
+	v.failoverLock.Unlock()
+}
+
+// failoverCount returns how many requests for server went to the Failover
+func (v *Pool) failoverCount(server string) int64 {
+	v.failoverLock.Lock()
+	defer v.failoverLock.Unlock()
+
+	return v.failovers[server]
+}
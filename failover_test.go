@@ -0,0 +1,255 @@
+package vshard
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/youtube/vitess/go/memcache"
+)
+
+type FailoverTestSuite struct {
+	suite.Suite
+	All   *Pool
+	Pool  *Pool
+	Proxy *flakyProxy
+}
+
+func (suite *FailoverTestSuite) SetupSuite() {
+	suite.All = setupPool(suite.T())
+}
+
+func (suite *FailoverTestSuite) SetupTest() {
+	proxy, err := newFlakyProxy(getTestServers()[9])
+	suite.Require().NoError(err)
+	suite.Proxy = proxy
+}
+
+func (suite *FailoverTestSuite) TearDownTest() {
+	if suite.Pool != nil {
+		suite.Proxy.SetUp(true)
+		suite.Pool.Close()
+		suite.Pool = nil
+	}
+	suite.Proxy.Close()
+	tearDownPool(suite.T(), suite.All)
+}
+
+func (suite *FailoverTestSuite) startPool(policy FailoverPolicy, healthCheck *HealthCheck) {
+	suite.Pool = &Pool{
+		Servers:         []string{suite.Proxy.Addr(), getTestServers()[0]},
+		FailoverServers: []string{getTestServers()[1], getTestServers()[2]},
+		FailoverPolicy:  policy,
+		HealthCheck:     healthCheck,
+	}
+	suite.Pool.Start()
+}
+
+// proxyKey returns a key owned by the proxied server
+func (suite *FailoverTestSuite) proxyKey() string {
+	suite.Pool.RLock()
+	defer suite.Pool.RUnlock()
+
+	for _, key := range testKeys(100) {
+		if suite.Pool.locate(key) == 0 {
+			return key
+		}
+	}
+
+	return ""
+}
+
+func (suite *FailoverTestSuite) TestReadFailsOverOnError() {
+	suite.startPool(FailoverPolicy{}, nil)
+	key := suite.proxyKey()
+
+	_, err := suite.Pool.Failover.Set(key, 0, 0, []byte("failover"))
+	suite.NoError(err)
+
+	suite.Proxy.SetUp(false)
+
+	value, err := suite.Pool.Get(key)
+	suite.NoError(err)
+	suite.Equal("failover", string(value))
+	suite.Equal(int64(1), suite.Pool.Status()[0].Failovers)
+	suite.Equal(int64(0), suite.Pool.Status()[1].Failovers)
+
+	results, err := suite.Pool.Gets(key, "missing")
+	suite.NoError(err)
+	suite.Len(results, 1)
+	suite.Equal(int64(2), suite.Pool.Status()[0].Failovers)
+}
+
+func (suite *FailoverTestSuite) TestReadFailsOverWhenEjected() {
+	suite.startPool(FailoverPolicy{}, &HealthCheck{
+		Interval:      time.Millisecond * 20,
+		FailureLimit:  1,
+		RetryInterval: time.Millisecond * 100,
+	})
+	key := suite.proxyKey()
+
+	_, err := suite.Pool.Failover.Set(key, 0, 0, []byte("failover"))
+	suite.NoError(err)
+
+	suite.Proxy.SetUp(false)
+	suite.True(waitFor(func() bool { return suite.Pool.Status()[0].Down }))
+
+	value, err := suite.Pool.Get(key)
+	suite.NoError(err)
+	suite.Equal("failover", string(value))
+}
+
+func (suite *FailoverTestSuite) TestWritesStayByDefault() {
+	suite.startPool(FailoverPolicy{}, nil)
+	key := suite.proxyKey()
+
+	suite.Proxy.SetUp(false)
+
+	_, err := suite.Pool.Set(key, 0, 0, []byte("value"))
+	suite.Error(err)
+
+	_, err = suite.Pool.Failover.Get(key)
+	suite.Equal(ErrKeyNotFound, err)
+}
+
+func (suite *FailoverTestSuite) TestWritesFailOver() {
+	suite.startPool(FailoverPolicy{Writes: true}, nil)
+	key := suite.proxyKey()
+
+	suite.Proxy.SetUp(false)
+
+	stored, err := suite.Pool.Set(key, 0, 0, []byte("value"))
+	suite.NoError(err)
+	suite.True(stored)
+
+	value, err := suite.Pool.Failover.Get(key)
+	suite.NoError(err)
+	suite.Equal("value", string(value))
+
+	deleted, err := suite.Pool.Delete(key)
+	suite.NoError(err)
+	suite.True(deleted)
+	suite.Equal(int64(2), suite.Pool.Status()[0].Failovers)
+}
+
+func (suite *FailoverTestSuite) TestMirrorDeletes() {
+	suite.startPool(FailoverPolicy{MirrorDeletes: true}, nil)
+	key := suite.proxyKey()
+
+	_, err := suite.Pool.Set(key, 0, 0, []byte("primary"))
+	suite.NoError(err)
+	_, err = suite.Pool.Failover.Set(key, 0, 0, []byte("failover"))
+	suite.NoError(err)
+
+	deleted, err := suite.Pool.Delete(key)
+	suite.NoError(err)
+	suite.True(deleted)
+
+	_, err = suite.Pool.Get(key)
+	suite.Equal(ErrKeyNotFound, err)
+	_, err = suite.Pool.Failover.Get(key)
+	suite.Equal(ErrKeyNotFound, err)
+	suite.Equal(int64(0), suite.Pool.Status()[0].Failovers)
+}
+
+func (suite *FailoverTestSuite) TestSettingsCopied() {
+	retryPolicy := &RetryPolicy{MaxAttempts: 2}
+	updatePolicy := &UpdatePolicy{MaxRetries: 2}
+	suite.Pool = &Pool{
+		Servers:          []string{suite.Proxy.Addr(), getTestServers()[0]},
+		FailoverServers:  []string{getTestServers()[1], getTestServers()[2]},
+		Weights:          []int{1, 3},
+		TopologyStrategy: RendezvousServerStrategy,
+		RetryPolicy:      retryPolicy,
+		UpdatePolicy:     updatePolicy,
+		TTLJitter:        0.1,
+		Replicas:         2,
+	}
+	suite.Pool.Start()
+
+	failover := suite.Pool.Failover
+	suite.Equal([]int{1, 3}, failover.Weights)
+	suite.NotNil(failover.TopologyStrategy)
+	suite.NotNil(failover.locator)
+	suite.NotNil(failover.ServerStrategy)
+	suite.Equal(retryPolicy, failover.RetryPolicy)
+	suite.Equal(updatePolicy, failover.UpdatePolicy)
+	suite.Equal(0.1, failover.TTLJitter)
+	suite.Equal(2, failover.Replicas)
+
+	// keys land where the primary would put them on the same servers
+	mirror := &Pool{
+		Servers:          suite.Pool.FailoverServers,
+		Weights:          []int{1, 3},
+		TopologyStrategy: RendezvousServerStrategy,
+	}
+	mirror.Start()
+	defer mirror.Close()
+	for _, key := range testKeys(50) {
+		suite.Equal(mirror.locate(key), failover.locate(key), key)
+	}
+}
+
+func (suite *FailoverTestSuite) TestHashTagsFailOver() {
+	suite.Pool = &Pool{
+		Servers:         []string{suite.Proxy.Addr(), getTestServers()[0]},
+		FailoverServers: []string{getTestServers()[1], getTestServers()[2]},
+		FailoverPolicy:  FailoverPolicy{Writes: true},
+		HashTagStrategy: BraceHashTagStrategy,
+	}
+	suite.Pool.Start()
+
+	tag := ""
+	for _, candidate := range testKeys(100) {
+		if suite.Pool.locate(candidate) == 0 {
+			tag = candidate
+			break
+		}
+	}
+	keys := []string{}
+	for i := 0; i < 10; i++ {
+		keys = append(keys, fmt.Sprintf("{%s}:%d", tag, i))
+	}
+
+	suite.Proxy.SetUp(false)
+	for _, key := range keys {
+		_, err := suite.Pool.Set(key, 0, 0, []byte(key))
+		suite.Require().NoError(err)
+	}
+
+	// every key landed on the Failover server owning the tag
+	failover := suite.Pool.Failover
+	slot := failover.locate(tag)
+	resource, err := failover.GetPoolConnection(slot)
+	suite.Require().NoError(err)
+	defer failover.ReturnConnection(slot, resource)
+
+	for _, key := range keys {
+		suite.Equal(slot, failover.locate(key), key)
+		results, err := resource.Get(failover.HashKeyStrategy(key))
+		suite.NoError(err)
+		suite.Len(results, 1, key)
+	}
+
+	results, err := suite.Pool.Gets(keys...)
+	suite.NoError(err)
+	suite.Len(results, len(keys))
+}
+
+func (suite *FailoverTestSuite) TestFailedServer() {
+	suite.True(failedServer(ErrServerDown))
+	suite.True(failedServer(memcache.NewError("%s", io.EOF)))
+	suite.True(failedServer(memcache.NewError("read tcp 127.0.0.1:50000->127.0.0.1:21210: i/o timeout")))
+
+	// a healthy server replying with an error keeps the request
+	suite.False(failedServer(memcache.NewError("Server error")))
+	suite.False(failedServer(memcache.NewError("Malformed response: %s", "VALUE")))
+	suite.False(failedServer(ErrKeyNotFound))
+	suite.False(failedServer(nil))
+}
+
+func TestFailoverTestSuite(t *testing.T) {
+	suite.Run(t, new(FailoverTestSuite))
+}
@@ -0,0 +1,134 @@
+package vshard
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type HashTagTestSuite struct {
+	suite.Suite
+	Pool *Pool
+}
+
+func (suite *HashTagTestSuite) SetupSuite() {
+	suite.Pool = &Pool{
+		Servers:         getTestServers(),
+		Capacity:        10,
+		MaxCapacity:     10,
+		IdleTimeout:     time.Second * 5,
+		HashTagStrategy: BraceHashTagStrategy,
+	}
+	suite.Pool.Start()
+}
+
+func (suite *HashTagTestSuite) TearDownTest() {
+	tearDownPool(suite.T(), suite.Pool)
+}
+
+func (suite *HashTagTestSuite) TestBraceHashTagStrategy() {
+	tags := map[string]string{
+		"user:{123}:profile": "123",
+		"{user:123}:profile": "user:123",
+		"user:{123}:{456}":   "123",
+		"user:{}:profile":    "user:{}:profile",
+		"user:{123":          "user:{123",
+		"user:}123{":         "user:}123{",
+		"user:123":           "user:123",
+		"{}{123}":            "{}{123}",
+	}
+
+	for key, tag := range tags {
+		suite.Equal(tag, BraceHashTagStrategy(key), key)
+	}
+}
+
+func (suite *HashTagTestSuite) TestTaggedKeysShareServer() {
+	keys := []string{}
+	for _, field := range []string{"profile", "settings", "friends", "avatar", "sessions"} {
+		keys = append(keys, "user:{123}:"+field)
+	}
+
+	mapping := suite.Pool.GetKeyMapping(keys...)
+	owners := 0
+	for _, hashedKeys := range mapping {
+		if len(hashedKeys) > 0 {
+			owners++
+			suite.Len(hashedKeys, len(keys))
+		}
+	}
+	suite.Equal(1, owners)
+
+	// storage names still come from the whole key
+	suite.NotEqual(suite.Pool.HashKey(keys[0]), suite.Pool.HashKey(keys[1]))
+	suite.Equal(suite.Pool.HashKey(keys[0]), XXH64KeyStrategy(keys[0]))
+}
+
+func (suite *HashTagTestSuite) TestCommands() {
+	for _, field := range []string{"profile", "settings"} {
+		key := "user:{123}:" + field
+		_, err := suite.Pool.Set(key, 0, 0, []byte(field))
+		suite.NoError(err)
+	}
+
+	results, err := suite.Pool.Gets("user:{123}:profile", "user:{123}:settings")
+	suite.NoError(err)
+	suite.Len(results, 2)
+
+	value, err := suite.Pool.Get("user:{123}:settings")
+	suite.NoError(err)
+	suite.Equal("settings", string(value))
+
+	deleted, err := suite.Pool.Delete("user:{123}:profile")
+	suite.NoError(err)
+	suite.True(deleted)
+
+	_, err = suite.Pool.Get("user:{123}:profile")
+	suite.Equal(ErrKeyNotFound, err)
+}
+
+func (suite *HashTagTestSuite) TestCustomExtractor() {
+	pool := &Pool{
+		Servers: getTestServers(),
+		HashTagStrategy: func(key string) string {
+			parts := strings.SplitN(key, ":", 3)
+			if len(parts) < 3 {
+				return key
+			}
+			return parts[0] + ":" + parts[1]
+		},
+	}
+	pool.Start()
+	defer pool.Close()
+
+	for user := 0; user < 20; user++ {
+		prefix := "user:" + strconv.Itoa(user) + ":"
+
+		pool.RLock()
+		slot := pool.locate(prefix + "profile")
+		suite.Equal(slot, pool.locate(prefix+"settings"))
+		suite.Equal(slot, pool.locate(prefix+"friends:page:2"))
+		pool.RUnlock()
+	}
+}
+
+func (suite *HashTagTestSuite) TestReplicasFollowTag() {
+	pool := &Pool{
+		Servers:         getTestServers(),
+		HashTagStrategy: BraceHashTagStrategy,
+		Replicas:        2,
+	}
+	pool.Start()
+	defer pool.Close()
+
+	pool.RLock()
+	defer pool.RUnlock()
+	suite.Equal(pool.replicaSlots("user:{123}:profile"), pool.replicaSlots("user:{123}:settings"))
+}
+
+func TestHashTagTestSuite(t *testing.T) {
+	suite.Run(t, new(HashTagTestSuite))
+}
@@ -0,0 +1,286 @@
+package vshard
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/youtube/vitess/go/memcache"
+	"github.com/youtube/vitess/go/pools"
+)
+
+const (
+	defaultHealthCheckInterval = time.Second
+	defaultHealthFailureLimit  = 3
+	defaultHealthRetryInterval = time.Second * 30
+
+	healthCheckKey = "vshard:health"
+)
+
+// ErrServerDown defines the error when the server owning a key was ejected
+var ErrServerDown = errors.New("error: server is down")
+
+// EjectPolicy decides where requests for a server marked down go
+type EjectPolicy int
+
+const (
+	// EjectAsMiss fails requests for a down server right away: reads are
+	// misses and writes return ErrServerDown
+	EjectAsMiss EjectPolicy = iota
+	// EjectRehash spreads the keys of down servers over the live ones, like
+	// twemproxy's auto_eject_hosts. Keys of live servers never move, but
+	// values written elsewhere while a server was down are left behind
+	// when it comes back.
+	EjectRehash
+)
+
+// HealthCheck configures the background health checker of a Pool. Every
+// Interval each server gets a get on a fresh connection, FailureLimit
+// failures in a row mark it down, and it's checked again once RetryInterval
+// has passed since then.
+type HealthCheck struct {
+	Interval      time.Duration
+	FailureLimit  int
+	RetryInterval time.Duration
+	Policy        EjectPolicy
+}
+
+type serverHealth struct {
+	failures  int
+	down      bool
+	ejectedAt time.Time
+}
+
+type healthChecker struct {
+	HealthCheck
+	servers map[string]*serverHealth
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// strategyLocator adapts a ServerStrategy to a fixed number of servers
+type strategyLocator struct {
+	strategy   ServerStrategy
+	numServers int
+}
+
+func (l strategyLocator) Locate(key string) int {
+	return l.strategy(key, l.numServers)
+}
+
+// startHealthCheck marks unreachable servers down and starts checking them all
+func (v *Pool) startHealthCheck(unreachable []string) {
+	checker := &healthChecker{
+		HealthCheck: *v.HealthCheck,
+		servers:     make(map[string]*serverHealth),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if checker.Interval == 0 {
+		checker.Interval = defaultHealthCheckInterval
+	}
+	if checker.FailureLimit == 0 {
+		checker.FailureLimit = defaultHealthFailureLimit
+	}
+	if checker.RetryInterval == 0 {
+		checker.RetryInterval = defaultHealthRetryInterval
+	}
+
+	v.update.Lock()
+	defer v.update.Unlock()
+
+	v.health = checker
+	for _, server := range unreachable {
+		checker.eject(server)
+	}
+	v.applyHealth()
+
+	go v.runHealthCheck(checker)
+}
+
+func (v *Pool) runHealthCheck(checker *healthChecker) {
+	defer close(checker.done)
+
+	ticker := time.NewTicker(checker.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-checker.stop:
+			return
+		case <-ticker.C:
+			v.checkHealth(checker)
+		}
+	}
+}
+
+// checkHealth probes every live server, and down servers due for a retry
+func (v *Pool) checkHealth(checker *healthChecker) {
+	v.update.Lock()
+	servers := []string{}
+	now := time.Now()
+	for _, server := range v.Servers {
+		health := checker.servers[server]
+		if health == nil || !health.down || now.Sub(health.ejectedAt) >= checker.RetryInterval {
+			servers = append(servers, server)
+		}
+	}
+	v.update.Unlock()
+
+	healthy := make([]bool, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server string) {
+			defer wg.Done()
+			healthy[i] = v.probe(server)
+		}(i, server)
+	}
+	wg.Wait()
+
+	v.update.Lock()
+	defer v.update.Unlock()
+
+	changed := false
+	restored := []string{}
+	for i, server := range servers {
+		health := checker.servers[server]
+		if health == nil {
+			health = &serverHealth{}
+			checker.servers[server] = health
+		}
+
+		switch {
+		case healthy[i]:
+			if health.down {
+				log.Printf("vshard: server %s is back up", server)
+				restored = append(restored, server)
+				changed = true
+			}
+			*health = serverHealth{}
+		case health.down:
+			health.ejectedAt = time.Now()
+		default:
+			health.failures++
+			if health.failures >= checker.FailureLimit {
+				log.Printf("vshard: server %s marked down after %d failures", server, health.failures)
+				checker.eject(server)
+				changed = true
+			}
+		}
+	}
+
+	if changed {
+		v.applyHealth(restored...)
+	}
+}
+
+// probe runs a get on a new connection, so a full pool doesn't look dead
+func (v *Pool) probe(server string) bool {
+	conn, err := memcache.Connect(server, v.ConnectionTimeout)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	_, err = conn.Get(healthCheckKey)
+
+	return err == nil
+}
+
+func (c *healthChecker) eject(server string) {
+	c.servers[server] = &serverHealth{
+		failures:  c.FailureLimit,
+		down:      true,
+		ejectedAt: time.Now(),
+	}
+}
+
+// applyHealth publishes the down servers of the current topology, restored
+// servers get a new connection pool as the old connections are likely dead.
+// Callers must hold the update lock.
+func (v *Pool) applyHealth(restored ...string) {
+	down, liveSlots, liveLocator := v.healthState(v.Servers, v.weights, v.locator)
+
+	serverPools := v.pool
+	renewed := make(map[*pools.ResourcePool]*pools.ResourcePool)
+	restoredPools := make(map[string]*pools.ResourcePool)
+	if len(restored) > 0 {
+		serverPools = append([]*pools.ResourcePool{}, v.pool...)
+		for _, server := range restored {
+			for i := range v.Servers {
+				if v.Servers[i] == server {
+					stale := serverPools[i]
+					serverPools[i], _ = v.newServerPool(server)
+					renewed[stale] = serverPools[i]
+					restoredPools[server] = serverPools[i]
+					// replicas must not serve keys deleted while they were down
+					v.applyPendingDeletes(server, serverPools[i])
+				}
+			}
+		}
+	}
+
+	v.Lock()
+	v.pool = serverPools
+	if v.migration != nil && len(renewed) > 0 {
+		v.migration.old = v.migration.old.renewPools(renewed)
+	}
+	v.down = down
+	v.liveSlots = liveSlots
+	v.liveLocator = liveLocator
+	v.Unlock()
+
+	for stale := range renewed {
+		go stale.Close()
+	}
+	// deletes recorded until the server was published as up
+	for server, pool := range restoredPools {
+		v.applyPendingDeletes(server, pool)
+	}
+}
+
+// healthState returns which servers are down, and when rehashing, the slots
+// of the live ones along with a locator for them. Callers must hold the
+// update lock.
+func (v *Pool) healthState(servers []string, weights []int, locator ServerLocator) ([]bool, []int, ServerLocator) {
+	if v.health == nil {
+		return nil, nil, nil
+	}
+
+	down := make([]bool, len(servers))
+	liveSlots := []int{}
+	liveServers := []string{}
+	liveWeights := []int{}
+	for i, server := range servers {
+		if health := v.health.servers[server]; health != nil && health.down {
+			down[i] = true
+			continue
+		}
+		liveSlots = append(liveSlots, i)
+		liveServers = append(liveServers, server)
+		liveWeights = append(liveWeights, weights[i])
+	}
+
+	if v.health.Policy != EjectRehash || len(liveSlots) == 0 || len(liveSlots) == len(servers) {
+		return down, nil, nil
+	}
+
+	var liveLocator ServerLocator = strategyLocator{v.ServerStrategy, len(liveServers)}
+	if buckets, ok := locator.(*VBucketMap); ok {
+		// only the buckets of down servers move
+		if rebalanced, err := buckets.Rebalance(liveServers, liveWeights); err == nil {
+			liveLocator = rebalanced
+		}
+	} else if v.TopologyStrategy != nil {
+		liveLocator = v.TopologyStrategy(liveServers, liveWeights)
+	}
+
+	return down, liveSlots, liveLocator
+}
+
+// isDown tells if the server in poolNum is down, callers must hold the lock
+func (v *Pool) isDown(poolNum int) bool {
+	return v.down != nil && v.down[poolNum]
+}
@@ -0,0 +1,232 @@
+package vshard
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// flakyProxy forwards connections to a memcached server, while it's up
+type flakyProxy struct {
+	listener net.Listener
+	backend  string
+	up       bool
+	conns    []net.Conn
+	sync.Mutex
+}
+
+func newFlakyProxy(backend string) (*flakyProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := &flakyProxy{listener: listener, backend: backend, up: true}
+	go proxy.serve()
+
+	return proxy, nil
+}
+
+func (p *flakyProxy) Addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *flakyProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		p.Lock()
+		if !p.up {
+			p.Unlock()
+			conn.Close()
+			continue
+		}
+		backend, err := net.Dial("tcp", p.backend)
+		if err != nil {
+			p.Unlock()
+			conn.Close()
+			continue
+		}
+		p.conns = append(p.conns, conn, backend)
+		p.Unlock()
+
+		go io.Copy(backend, conn)
+		go io.Copy(conn, backend)
+	}
+}
+
+// SetUp turns the proxy on or off, dropping every connection when off
+func (p *flakyProxy) SetUp(up bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.up = up
+	if !up {
+		for _, conn := range p.conns {
+			conn.Close()
+		}
+		p.conns = nil
+	}
+}
+
+func (p *flakyProxy) Close() {
+	p.listener.Close()
+	p.SetUp(false)
+}
+
+type HealthCheckTestSuite struct {
+	suite.Suite
+	Pool  *Pool
+	Proxy *flakyProxy
+}
+
+func (suite *HealthCheckTestSuite) SetupTest() {
+	proxy, err := newFlakyProxy(getTestServers()[9])
+	suite.Require().NoError(err)
+	suite.Proxy = proxy
+}
+
+func (suite *HealthCheckTestSuite) TearDownTest() {
+	suite.Proxy.SetUp(true)
+	if suite.Pool != nil {
+		suite.True(waitFor(func() bool { return !suite.Pool.Status()[2].Down }))
+		tearDownPool(suite.T(), suite.Pool)
+		suite.Pool.Close()
+		suite.Pool = nil
+	}
+	suite.Proxy.Close()
+}
+
+func (suite *HealthCheckTestSuite) startPool(policy EjectPolicy) {
+	suite.Pool = &Pool{
+		Servers:     []string{getTestServers()[0], getTestServers()[1], suite.Proxy.Addr()},
+		Capacity:    10,
+		MaxCapacity: 10,
+		IdleTimeout: time.Second * 5,
+		HealthCheck: &HealthCheck{
+			Interval:      time.Millisecond * 20,
+			FailureLimit:  2,
+			RetryInterval: time.Millisecond * 100,
+			Policy:        policy,
+		},
+	}
+	suite.Pool.Start()
+}
+
+func (suite *HealthCheckTestSuite) keysOn(slot int) []string {
+	keys := []string{}
+	for _, key := range testKeys(100) {
+		if suite.Pool.locateSlot(key) == slot {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+func (suite *HealthCheckTestSuite) takeDown() {
+	suite.Proxy.SetUp(false)
+	suite.True(waitFor(func() bool { return suite.Pool.Status()[2].Down }))
+}
+
+func (suite *HealthCheckTestSuite) TestEjectAsMiss() {
+	suite.startPool(EjectAsMiss)
+	key := suite.keysOn(2)[0]
+	live := suite.keysOn(0)[0]
+
+	_, err := suite.Pool.Set(key, 0, 0, []byte("value"))
+	suite.NoError(err)
+	_, err = suite.Pool.Set(live, 0, 0, []byte("live"))
+	suite.NoError(err)
+
+	suite.takeDown()
+
+	_, err = suite.Pool.Get(key)
+	suite.Equal(ErrKeyNotFound, err)
+
+	_, err = suite.Pool.Set(key, 0, 0, []byte("value"))
+	suite.Equal(ErrServerDown, err)
+
+	results, err := suite.Pool.Gets(key, live)
+	suite.NoError(err)
+	suite.Len(results, 1)
+	suite.Equal("live", string(results[0].Value))
+}
+
+func (suite *HealthCheckTestSuite) TestServerComesBack() {
+	suite.startPool(EjectAsMiss)
+	key := suite.keysOn(2)[0]
+
+	suite.takeDown()
+	suite.Proxy.SetUp(true)
+	suite.True(waitFor(func() bool { return !suite.Pool.Status()[2].Down }))
+
+	_, err := suite.Pool.Set(key, 0, 0, []byte("value"))
+	suite.NoError(err)
+
+	value, err := suite.Pool.Get(key)
+	suite.NoError(err)
+	suite.Equal("value", string(value))
+}
+
+func (suite *HealthCheckTestSuite) TestEjectRehash() {
+	suite.startPool(EjectRehash)
+	keys := suite.keysOn(2)
+	before := suite.Pool.GetKeyMapping(testKeys(100)...)
+
+	suite.takeDown()
+
+	mapping := suite.Pool.GetKeyMapping(testKeys(100)...)
+	suite.Empty(mapping[2])
+	for slot := 0; slot < 2; slot++ {
+		for _, key := range before[slot] {
+			suite.Contains(mapping[slot], key)
+		}
+	}
+
+	for _, key := range keys {
+		_, err := suite.Pool.Set(key, 0, 0, []byte(key))
+		suite.NoError(err)
+
+		value, err := suite.Pool.Get(key)
+		suite.NoError(err)
+		suite.Equal(key, string(value))
+	}
+
+	suite.Proxy.SetUp(true)
+	suite.True(waitFor(func() bool { return !suite.Pool.Status()[2].Down }))
+	suite.Equal(before, suite.Pool.GetKeyMapping(testKeys(100)...))
+}
+
+func (suite *HealthCheckTestSuite) TestStartWithDeadServer() {
+	suite.Proxy.SetUp(false)
+	suite.startPool(EjectAsMiss)
+
+	suite.True(suite.Pool.Status()[2].Down)
+	suite.False(suite.Pool.Status()[0].Down)
+
+	_, err := suite.Pool.Get(suite.keysOn(2)[0])
+	suite.Equal(ErrKeyNotFound, err)
+}
+
+func (suite *HealthCheckTestSuite) TestUpdateServersWithDeadServer() {
+	suite.startPool(EjectAsMiss)
+
+	servers := append(suite.Pool.Servers, "127.0.0.1:1")
+	suite.NoError(suite.Pool.UpdateServers(servers))
+	suite.True(suite.Pool.Status()[3].Down)
+
+	suite.NoError(suite.Pool.UpdateServers(servers[:3]))
+	suite.Len(suite.Pool.Status(), 3)
+}
+
+func TestHealthCheckTestSuite(t *testing.T) {
+	suite.Run(t, new(HealthCheckTestSuite))
+}
@@ -43,3 +43,15 @@ func tearDownPool(t assert.TestingT, pool *Pool) {
 		}
 	}
 }
+
+func waitFor(condition func() bool) bool {
+	deadline := time.Now().Add(time.Second * 2)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	return condition()
+}
@@ -0,0 +1,450 @@
+package vshard
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	invalidateKeyOp   = 'k'
+	invalidateFlushOp = 'f'
+	originLength      = 16
+	maxFrameSize      = 1<<16 - 1
+	hubWriteTimeout   = time.Second
+	hubRedialInterval = time.Millisecond * 100
+	generationStripes = 256
+)
+
+var (
+	// ErrTransportClosed defines the error when publishing on a closed transport
+	ErrTransportClosed = errors.New("error: invalidation transport closed")
+)
+
+// InvalidationTransport delivers invalidation messages between pools
+// sharing the same memcached servers, each one with its own LocalCache.
+// Every pool needs its own transport, Pool.Close closes it.
+type InvalidationTransport interface {
+	Publish(message []byte) error
+	Subscribe(handler func(message []byte)) error
+	Close() error
+}
+
+func newOrigin() string {
+	id := make([]byte, originLength/2)
+	if _, err := rand.Read(id); err != nil {
+		log.Fatalf("error: can't generate pool origin: %s", err)
+	}
+
+	return hex.EncodeToString(id)
+}
+
+func encodeInvalidation(op byte, origin, key string) []byte {
+	message := make([]byte, 0, 1+len(origin)+len(key))
+	message = append(message, op)
+	message = append(message, origin...)
+
+	return append(message, key...)
+}
+
+func decodeInvalidation(message []byte) (op byte, origin, key string, ok bool) {
+	if len(message) < 1+originLength {
+		return 0, "", "", false
+	}
+
+	return message[0], string(message[1 : 1+originLength]), string(message[1+originLength:]), true
+}
+
+// generations counts invalidations by stripe of keys, so a value read from
+// memcached isn't cached locally when an invalidation raced the read
+type generations struct {
+	stripes [generationStripes]uint64
+	flushes uint64
+	sync.Mutex
+}
+
+func generationStripe(key string) int {
+	return int(xxh64Hash(key) % generationStripes)
+}
+
+// localGeneration returns the generation of key, to pass to cacheLocally
+// once its value is read
+func (v *Pool) localGeneration(key string) uint64 {
+	v.generations.Lock()
+	defer v.generations.Unlock()
+
+	return v.generations.stripes[generationStripe(key)] + v.generations.flushes
+}
+
+// cacheLocally stores value in the local tier, unless key was invalidated
+// since generation
+func (v *Pool) cacheLocally(key string, value []byte, generation uint64) {
+	v.generations.Lock()
+	defer v.generations.Unlock()
+
+	if v.generations.stripes[generationStripe(key)]+v.generations.flushes == generation {
+		v.LocalCache.Set(key, value)
+	}
+}
+
+// dropLocal removes key from the local tier, moving on its generation
+func (v *Pool) dropLocal(key string) {
+	v.generations.Lock()
+	defer v.generations.Unlock()
+
+	v.generations.stripes[generationStripe(key)]++
+	v.LocalCache.Delete(key)
+}
+
+// purgeLocal empties the local tier, moving on every generation
+func (v *Pool) purgeLocal() {
+	v.generations.Lock()
+	defer v.generations.Unlock()
+
+	v.generations.flushes++
+	v.LocalCache.Purge()
+}
+
+// invalidate drops key from the local tier and tells peer pools to do the same
+func (v *Pool) invalidate(key string) {
+	if v.LocalCache != nil {
+		v.dropLocal(key)
+	}
+	v.publish(invalidateKeyOp, key)
+}
+
+func (v *Pool) invalidateAll() {
+	if v.LocalCache != nil {
+		v.purgeLocal()
+	}
+	v.publish(invalidateFlushOp, "")
+}
+
+func (v *Pool) publish(op byte, key string) {
+	if v.InvalidationTransport == nil {
+		return
+	}
+
+	if err := v.InvalidationTransport.Publish(encodeInvalidation(op, v.origin, key)); err != nil {
+		log.Printf("error: can't publish invalidation for %q: %s", key, err)
+	}
+}
+
+func (v *Pool) subscribeInvalidations() {
+	if v.InvalidationTransport == nil {
+		return
+	}
+
+	err := v.InvalidationTransport.Subscribe(func(message []byte) {
+		op, origin, key, ok := decodeInvalidation(message)
+		if !ok || origin == v.origin || v.LocalCache == nil {
+			return
+		}
+
+		switch op {
+		case invalidateKeyOp:
+			v.dropLocal(key)
+		case invalidateFlushOp:
+			v.purgeLocal()
+		}
+	})
+	if err != nil {
+		log.Fatalf("Can't subscribe to invalidations: %s", err)
+	}
+}
+
+// MulticastTransport publishes invalidations over UDP multicast
+type MulticastTransport struct {
+	group    *net.UDPAddr
+	iface    *net.Interface
+	conn     *net.UDPConn
+	listener *net.UDPConn
+	sync.Mutex
+}
+
+// NewMulticastTransport creates a transport for the multicast group address
+// (e.g. "239.0.0.1:9999"), iface may be nil to use the system default
+func NewMulticastTransport(group string, iface *net.Interface) (*MulticastTransport, error) {
+	addr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MulticastTransport{group: addr, iface: iface, conn: conn}, nil
+}
+
+// Publish sends a message to the multicast group
+func (t *MulticastTransport) Publish(message []byte) error {
+	_, err := t.conn.Write(message)
+	return err
+}
+
+// Subscribe joins the multicast group and calls handler for every message
+func (t *MulticastTransport) Subscribe(handler func(message []byte)) error {
+	listener, err := net.ListenMulticastUDP("udp", t.iface, t.group)
+	if err != nil {
+		return err
+	}
+
+	t.Lock()
+	t.listener = listener
+	t.Unlock()
+
+	go func() {
+		buffer := make([]byte, maxFrameSize)
+		for {
+			n, _, err := listener.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+
+			message := make([]byte, n)
+			copy(message, buffer[:n])
+			handler(message)
+		}
+	}()
+
+	return nil
+}
+
+// Close leaves the multicast group
+func (t *MulticastTransport) Close() error {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.listener != nil {
+		t.listener.Close()
+	}
+
+	return t.conn.Close()
+}
+
+func writeFrame(w io.Writer, message []byte) error {
+	if len(message) > maxFrameSize {
+		return errors.New("error: invalidation message too large")
+	}
+
+	frame := make([]byte, 2+len(message))
+	binary.BigEndian.PutUint16(frame, uint16(len(message)))
+	copy(frame[2:], message)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	message := make([]byte, binary.BigEndian.Uint16(header[:]))
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// InvalidationHub is a TCP server fanning out every message it receives
+// to all the other connected HubTransport clients
+type InvalidationHub struct {
+	listener net.Listener
+	conns    map[net.Conn]*sync.Mutex
+	sync.Mutex
+}
+
+// NewInvalidationHub starts a hub listening on address
+func NewInvalidationHub(address string) (*InvalidationHub, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	hub := &InvalidationHub{listener: listener, conns: make(map[net.Conn]*sync.Mutex)}
+	go hub.accept()
+
+	return hub, nil
+}
+
+// Addr returns the address the hub is listening on
+func (h *InvalidationHub) Addr() net.Addr {
+	return h.listener.Addr()
+}
+
+// Close stops the hub and disconnects every client
+func (h *InvalidationHub) Close() error {
+	err := h.listener.Close()
+
+	h.Lock()
+	for conn := range h.conns {
+		conn.Close()
+	}
+	h.conns = make(map[net.Conn]*sync.Mutex)
+	h.Unlock()
+
+	return err
+}
+
+func (h *InvalidationHub) accept() {
+	for {
+		conn, err := h.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		h.Lock()
+		h.conns[conn] = &sync.Mutex{}
+		h.Unlock()
+
+		go h.serve(conn)
+	}
+}
+
+func (h *InvalidationHub) serve(conn net.Conn) {
+	defer h.drop(conn)
+
+	for {
+		message, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+
+		// write outside the hub lock, so a slow peer only holds back the
+		// messages sent to it, until the write deadline drops it
+		h.Lock()
+		peers := make(map[net.Conn]*sync.Mutex, len(h.conns))
+		for peer, writing := range h.conns {
+			if peer != conn {
+				peers[peer] = writing
+			}
+		}
+		h.Unlock()
+
+		for peer, writing := range peers {
+			writing.Lock()
+			peer.SetWriteDeadline(time.Now().Add(hubWriteTimeout))
+			err := writeFrame(peer, message)
+			writing.Unlock()
+			if err != nil {
+				h.drop(peer)
+			}
+		}
+	}
+}
+
+func (h *InvalidationHub) drop(conn net.Conn) {
+	conn.Close()
+
+	h.Lock()
+	delete(h.conns, conn)
+	h.Unlock()
+}
+
+// HubTransport publishes invalidations through an InvalidationHub,
+// reconnecting to it when the connection is lost
+type HubTransport struct {
+	address string
+	timeout time.Duration
+	conn    net.Conn
+	closed  bool
+	sync.Mutex
+}
+
+// NewHubTransport connects to the InvalidationHub listening on address
+func NewHubTransport(address string, timeout time.Duration) (*HubTransport, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HubTransport{address: address, timeout: timeout, conn: conn}, nil
+}
+
+// Publish sends a message to the hub
+func (t *HubTransport) Publish(message []byte) error {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.closed {
+		return ErrTransportClosed
+	}
+
+	t.conn.SetWriteDeadline(time.Now().Add(t.timeout))
+	err := writeFrame(t.conn, message)
+	if err == nil {
+		return nil
+	}
+
+	if err := t.redial(); err != nil {
+		return err
+	}
+
+	t.conn.SetWriteDeadline(time.Now().Add(t.timeout))
+	return writeFrame(t.conn, message)
+}
+
+// Subscribe calls handler for every message the hub relays from other clients
+func (t *HubTransport) Subscribe(handler func(message []byte)) error {
+	go func() {
+		for {
+			t.Lock()
+			if t.closed {
+				t.Unlock()
+				return
+			}
+			conn := t.conn
+			t.Unlock()
+
+			message, err := readFrame(conn)
+			if err == nil {
+				handler(message)
+				continue
+			}
+
+			t.Lock()
+			if !t.closed && t.conn == conn {
+				if err := t.redial(); err != nil {
+					t.Unlock()
+					time.Sleep(hubRedialInterval)
+					continue
+				}
+			}
+			t.Unlock()
+		}
+	}()
+
+	return nil
+}
+
+// Close disconnects from the hub
+func (t *HubTransport) Close() error {
+	t.Lock()
+	defer t.Unlock()
+
+	t.closed = true
+	return t.conn.Close()
+}
+
+func (t *HubTransport) redial() error {
+	t.conn.Close()
+
+	conn, err := net.DialTimeout("tcp", t.address, t.timeout)
+	if err != nil {
+		return err
+	}
+	t.conn = conn
+
+	return nil
+}
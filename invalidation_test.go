@@ -0,0 +1,221 @@
+package vshard
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type InvalidationTestSuite struct {
+	suite.Suite
+	Hub   *InvalidationHub
+	Pools []*Pool
+}
+
+func (suite *InvalidationTestSuite) SetupTest() {
+	hub, err := NewInvalidationHub("127.0.0.1:0")
+	if err != nil {
+		suite.FailNow("Can't start invalidation hub", err)
+	}
+	suite.Hub = hub
+	suite.Pools = []*Pool{}
+
+	for i := 0; i < 3; i++ {
+		transport, err := NewHubTransport(hub.Addr().String(), time.Second)
+		if err != nil {
+			suite.FailNow("Can't connect to invalidation hub", err)
+		}
+
+		pool := &Pool{
+			Servers:               getTestServers(),
+			LocalCache:            NewMemoryCache(100, time.Minute),
+			InvalidationTransport: transport,
+		}
+		pool.Start()
+		suite.Pools = append(suite.Pools, pool)
+	}
+}
+
+func (suite *InvalidationTestSuite) TearDownTest() {
+	tearDownPool(suite.T(), suite.Pools[0])
+
+	for _, pool := range suite.Pools {
+		pool.Close()
+	}
+	suite.Hub.Close()
+}
+
+func (suite *InvalidationTestSuite) cached(pool *Pool, key string) bool {
+	_, ok := pool.LocalCache.Get(key)
+	return ok
+}
+
+func (suite *InvalidationTestSuite) TestGetPopulatesLocalCache() {
+	key := "near-cache-key"
+	ok, err := suite.Pools[0].Set(key, 0, 0, []byte("value"))
+	suite.True(ok)
+	suite.NoError(err)
+	suite.False(suite.cached(suite.Pools[0], key), "writes should not populate the local tier")
+
+	// the Set's invalidation reaching the peer mid-read keeps it uncached
+	suite.True(waitFor(func() bool {
+		value, err := suite.Pools[1].Get(key)
+		suite.NoError(err)
+		suite.Equal("value", string(value))
+		return suite.cached(suite.Pools[1], key)
+	}))
+}
+
+func (suite *InvalidationTestSuite) testInvalidation(key string, write func(pool *Pool) (bool, error)) {
+	ok, err := suite.Pools[0].Set(key, 0, 0, []byte("old-value"))
+	suite.True(ok)
+	suite.NoError(err)
+
+	// the Set's own invalidation may still be on its way, keeping the
+	// value read out of the local tier until it arrives
+	for _, pool := range suite.Pools[1:] {
+		p := pool
+		suite.True(waitFor(func() bool {
+			value, err := p.Get(key)
+			suite.NoError(err)
+			suite.Equal("old-value", string(value))
+			return suite.cached(p, key)
+		}))
+	}
+
+	ok, err = write(suite.Pools[0])
+	suite.True(ok)
+	suite.NoError(err)
+
+	for _, pool := range suite.Pools[1:] {
+		p := pool
+		suite.True(waitFor(func() bool { return !suite.cached(p, key) }), "peer local tier should be invalidated")
+	}
+}
+
+func (suite *InvalidationTestSuite) TestSetInvalidatesPeers() {
+	key := "invalidate-set-key"
+	suite.testInvalidation(key, func(pool *Pool) (bool, error) {
+		return pool.Set(key, 0, 0, []byte("new-value"))
+	})
+
+	value, err := suite.Pools[1].Get(key)
+	suite.NoError(err)
+	suite.Equal("new-value", string(value))
+}
+
+func (suite *InvalidationTestSuite) TestDeleteInvalidatesPeers() {
+	key := "invalidate-delete-key"
+	suite.testInvalidation(key, func(pool *Pool) (bool, error) {
+		return pool.Delete(key)
+	})
+
+	_, err := suite.Pools[2].Get(key)
+	suite.Equal(ErrKeyNotFound, err)
+}
+
+func (suite *InvalidationTestSuite) TestCasInvalidatesPeers() {
+	key := "invalidate-cas-key"
+	suite.testInvalidation(key, func(pool *Pool) (bool, error) {
+		results, err := pool.Gets(key)
+		if err != nil || len(results) != 1 {
+			return false, err
+		}
+
+		return pool.Cas(key, 0, 0, []byte("cas-value"), results[0].Cas)
+	})
+}
+
+func (suite *InvalidationTestSuite) TestFlushAllPurgesPeers() {
+	key := "invalidate-flush-key"
+	suite.testInvalidation(key, func(pool *Pool) (bool, error) {
+		errs := pool.FlushAll()
+		return len(errs) == 0, nil
+	})
+}
+
+func (suite *InvalidationTestSuite) TestHubTransportReconnects() {
+	key := "invalidate-reconnect-key"
+	transport := suite.Pools[0].InvalidationTransport.(*HubTransport)
+	transport.Lock()
+	transport.conn.Close()
+	transport.Unlock()
+
+	suite.testInvalidation(key, func(pool *Pool) (bool, error) {
+		return pool.Delete(key)
+	})
+}
+
+func (suite *InvalidationTestSuite) TestCloseClosesTransport() {
+	transport, err := NewHubTransport(suite.Hub.Addr().String(), time.Second)
+	suite.Require().NoError(err)
+
+	pool := &Pool{
+		Servers:               getTestServers(),
+		LocalCache:            NewMemoryCache(100, time.Minute),
+		InvalidationTransport: transport,
+	}
+	pool.Start()
+	pool.Close()
+
+	suite.Equal(ErrTransportClosed, transport.Publish([]byte("message")))
+}
+
+func (suite *InvalidationTestSuite) TestInvalidationDuringRead() {
+	pool := suite.Pools[0]
+	key := "invalidate-race-key"
+
+	// a peer invalidates the key between the memcached read and the local Set
+	generation := pool.localGeneration(key)
+	pool.dropLocal(key)
+	pool.cacheLocally(key, []byte("stale"), generation)
+	suite.False(suite.cached(pool, key))
+
+	generation = pool.localGeneration(key)
+	pool.purgeLocal()
+	pool.cacheLocally(key, []byte("stale"), generation)
+	suite.False(suite.cached(pool, key))
+
+	pool.cacheLocally(key, []byte("fresh"), pool.localGeneration(key))
+	suite.True(suite.cached(pool, key))
+}
+
+func (suite *InvalidationTestSuite) TestMulticastTransport() {
+	group := "239.255.42.99:19999"
+	publisher, err := NewMulticastTransport(group, nil)
+	suite.Require().NoError(err)
+	defer publisher.Close()
+	subscriber, err := NewMulticastTransport(group, nil)
+	suite.Require().NoError(err)
+	defer subscriber.Close()
+
+	messages := make(chan []byte, 1)
+	suite.Require().NoError(subscriber.Subscribe(func(message []byte) {
+		select {
+		case messages <- message:
+		default:
+		}
+	}))
+
+	message := encodeInvalidation(invalidateKeyOp, newOrigin(), "multicast-key")
+	deadline := time.After(time.Second * 2)
+	ticker := time.NewTicker(time.Millisecond * 50)
+	defer ticker.Stop()
+	for {
+		// joining the group takes a moment, publish until a message arrives
+		suite.Require().NoError(publisher.Publish(message))
+		select {
+		case received := <-messages:
+			suite.Equal(message, received)
+			return
+		case <-deadline:
+			suite.FailNow("no multicast message received")
+		case <-ticker.C:
+		}
+	}
+}
+
+func TestInvalidationTestSuite(t *testing.T) {
+	suite.Run(t, new(InvalidationTestSuite))
+}
@@ -0,0 +1,143 @@
+package vshard
+
+import (
+	"crypto/md5"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	ketamaPointsPerServer = 160
+	ketamaPointsPerHash   = 4
+	memcachedDefaultPort  = "11211"
+)
+
+// ketamaLocator is a continuum of points, each one owned by a server slot
+type ketamaLocator struct {
+	points []ketamaPoint
+}
+
+type ketamaPoint struct {
+	value uint32
+	slot  int
+}
+
+// KetamaServerStrategy builds the weighted ketama continuum the way
+// libmemcached does with MEMCACHED_BEHAVIOR_KETAMA_WEIGHTED (what php-memcached
+// and pylibmc call libketama compatibility), so keys land on the same servers
+// as long as every client lists the same "host:port" servers and weights.
+// Like libmemcached, the port is left out of the point names when it's 11211.
+func KetamaServerStrategy(servers []string, weights []int) ServerLocator {
+	return newKetamaLocator(servers, weights, libmemcachedKetamaName)
+}
+
+// TwemproxyKetamaServerStrategy builds the ketama continuum the way twemproxy
+// does for "distribution: ketama" with "hash: md5", always naming points
+// after the full "host:port" server name
+func TwemproxyKetamaServerStrategy(servers []string, weights []int) ServerLocator {
+	return newKetamaLocator(servers, weights, twemproxyKetamaName)
+}
+
+func libmemcachedKetamaName(server string, index int) string {
+	host, port := splitHostPort(server)
+	if port == "" || port == memcachedDefaultPort {
+		return host + "-" + strconv.Itoa(index)
+	}
+
+	return host + ":" + port + "-" + strconv.Itoa(index)
+}
+
+func twemproxyKetamaName(server string, index int) string {
+	return server + "-" + strconv.Itoa(index)
+}
+
+func splitHostPort(server string) (string, string) {
+	i := strings.LastIndex(server, ":")
+	if i < 0 || strings.Contains(server, "/") {
+		return server, ""
+	}
+
+	return server[:i], server[i+1:]
+}
+
+func newKetamaLocator(servers []string, weights []int, name func(server string, index int) string) *ketamaLocator {
+	totalWeight := 0
+	for _, weight := range weights {
+		totalWeight += weight
+	}
+
+	locator := &ketamaLocator{}
+	for slot, server := range servers {
+		// same float32 arithmetic as the C implementations, so rounding matches
+		pct := float32(weights[slot]) / float32(totalWeight)
+		points := pct * ketamaPointsPerServer / ketamaPointsPerHash * float32(len(servers))
+		hashes := int(math.Floor(float64(float32(float64(points) + 0.0000000001))))
+
+		for i := 0; i < hashes; i++ {
+			digest := md5.Sum([]byte(name(server, i)))
+			for alignment := 0; alignment < ketamaPointsPerHash; alignment++ {
+				locator.points = append(locator.points, ketamaPoint{
+					value: ketamaHash(digest, alignment),
+					slot:  slot,
+				})
+			}
+		}
+	}
+
+	sort.Slice(locator.points, func(i, j int) bool {
+		return locator.points[i].value < locator.points[j].value
+	})
+
+	return locator
+}
+
+// ketamaHash reads 4 bytes of an md5 digest as a little endian number
+func ketamaHash(digest [md5.Size]byte, alignment int) uint32 {
+	b := digest[alignment*4:]
+	return uint32(b[3])<<24 | uint32(b[2])<<16 | uint32(b[1])<<8 | uint32(b[0])
+}
+
+// Locate returns the slot owning the first point at or after the key's hash
+func (l *ketamaLocator) Locate(key string) int {
+	if len(l.points) == 0 {
+		return 0
+	}
+
+	return l.points[l.search(key)].slot
+}
+
+// LocateReplicas walks the continuum from key's point, collecting n
+// distinct slots
+func (l *ketamaLocator) LocateReplicas(key string, n int) []int {
+	if len(l.points) == 0 {
+		return []int{0}
+	}
+
+	slots := []int{}
+	seen := make(map[int]bool)
+	start := l.search(key)
+	for i := 0; i < len(l.points) && len(slots) < n; i++ {
+		slot := l.points[(start+i)%len(l.points)].slot
+		if !seen[slot] {
+			seen[slot] = true
+			slots = append(slots, slot)
+		}
+	}
+
+	return slots
+}
+
+// search returns the index of the first point at or after the key's hash
+func (l *ketamaLocator) search(key string) int {
+	hash := ketamaHash(md5.Sum([]byte(key)), 0)
+	i := sort.Search(len(l.points), func(i int) bool {
+		return l.points[i].value >= hash
+	})
+	if i == len(l.points) {
+		i = 0
+	}
+
+	return i
+}
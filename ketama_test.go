@@ -0,0 +1,100 @@
+package vshard
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// golden vectors follow libmemcached's update_continuum and twemproxy's
+// ketama_update, point naming and float32 point counts included
+var (
+	ketamaTestKeys = []string{"apple", "banana", "cherry", "user:123:profile", "user:123:settings",
+		"session:abcdef", "0", "1", "2", "3", "foo", "bar", "baz", "qux", "a", "b", "c", "d", "e", "f"}
+	ketamaDefaultPortServers = []string{"10.0.1.1:11211", "10.0.1.2:11211", "10.0.1.3:11211", "10.0.1.4:11211"}
+	ketamaMixedPortServers   = []string{"10.0.1.1:11211", "10.0.1.2:11211", "10.0.1.3:11212", "10.0.1.4:11213"}
+	ketamaWeights            = []int{600, 300, 200, 350}
+)
+
+type KetamaTestSuite struct {
+	suite.Suite
+}
+
+func (suite *KetamaTestSuite) testGolden(strategy TopologyStrategy, servers []string, weights []int, points int, expected []int) {
+	locator := strategy(servers, weights).(*ketamaLocator)
+	suite.Len(locator.points, points)
+
+	for i, key := range ketamaTestKeys {
+		suite.Equal(expected[i], locator.Locate(key), "key %q", key)
+	}
+}
+
+func (suite *KetamaTestSuite) TestLibmemcachedGolden() {
+	suite.testGolden(KetamaServerStrategy, ketamaDefaultPortServers, []int{1, 1, 1, 1}, 640,
+		[]int{0, 3, 1, 3, 0, 1, 2, 2, 3, 2, 2, 3, 3, 0, 2, 1, 0, 3, 3, 2})
+}
+
+func (suite *KetamaTestSuite) TestLibmemcachedWeightedGolden() {
+	suite.testGolden(KetamaServerStrategy, ketamaMixedPortServers, ketamaWeights, 636,
+		[]int{0, 0, 0, 3, 2, 1, 3, 3, 0, 0, 3, 2, 1, 0, 2, 0, 0, 0, 2, 2})
+}
+
+func (suite *KetamaTestSuite) TestTwemproxyGolden() {
+	suite.testGolden(TwemproxyKetamaServerStrategy, ketamaDefaultPortServers, []int{1, 1, 1, 1}, 640,
+		[]int{0, 0, 0, 1, 3, 1, 0, 1, 2, 2, 1, 3, 1, 0, 2, 2, 3, 0, 3, 2})
+}
+
+func (suite *KetamaTestSuite) TestTwemproxyWeightedGolden() {
+	suite.testGolden(TwemproxyKetamaServerStrategy, ketamaMixedPortServers, ketamaWeights, 636,
+		[]int{3, 0, 0, 1, 0, 1, 0, 1, 1, 0, 1, 2, 1, 0, 2, 0, 0, 0, 2, 1})
+}
+
+func (suite *KetamaTestSuite) TestPointNames() {
+	suite.Equal("10.0.1.1-3", libmemcachedKetamaName("10.0.1.1:11211", 3))
+	suite.Equal("10.0.1.1:11212-0", libmemcachedKetamaName("10.0.1.1:11212", 0))
+	suite.Equal("/tmp/memcached.sock-1", libmemcachedKetamaName("/tmp/memcached.sock", 1))
+	suite.Equal("10.0.1.1:11211-3", twemproxyKetamaName("10.0.1.1:11211", 3))
+}
+
+func (suite *KetamaTestSuite) TestDistribution() {
+	servers := getTestServers()
+	locator := KetamaServerStrategy(servers, normalizeWeights(servers, nil))
+	keys := testKeys(100000)
+
+	counts := make([]int, len(servers))
+	for _, key := range keys {
+		counts[locator.Locate(key)]++
+	}
+
+	for _, count := range counts {
+		suite.InEpsilon(len(keys)/len(servers), count, 0.2)
+	}
+}
+
+func (suite *KetamaTestSuite) TestRemoveServerRemapsMinimally() {
+	servers := getTestServers()
+	before := KetamaServerStrategy(servers, normalizeWeights(servers, nil))
+	remaining := append(append([]string{}, servers[:4]...), servers[5:]...)
+	after := KetamaServerStrategy(remaining, normalizeWeights(remaining, nil))
+
+	for _, key := range testKeys(10000) {
+		oldServer := servers[before.Locate(key)]
+		newServer := remaining[after.Locate(key)]
+		if oldServer != servers[4] {
+			suite.Equal(oldServer, newServer, "only keys of the removed server should move")
+		}
+	}
+}
+
+func TestKetamaTestSuite(t *testing.T) {
+	suite.Run(t, new(KetamaTestSuite))
+}
+
+func BenchmarkShardedServerStrategyKetama(b *testing.B) {
+	servers := getTestServers()
+	locator := KetamaServerStrategy(servers, normalizeWeights(servers, nil))
+
+	for n := 0; n < b.N; n++ {
+		_ = locator.Locate("a")
+	}
+}
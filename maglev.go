@@ -0,0 +1,193 @@
+package vshard
+
+import "fmt"
+
+// DefaultMaglevTableSize is the lookup table size used by MaglevServerStrategy,
+// a prime much larger than the number of servers
+const DefaultMaglevTableSize = 65537
+
+// MaglevTable implements Maglev hashing: every server walks its own
+// permutation of the table slots, taking turns to claim free entries in
+// proportion to its weight. Lookups are a single table read, and removing
+// a server mostly reassigns the entries it owned.
+type MaglevTable struct {
+	servers []string
+	entries []int32
+}
+
+// MaglevServerStrategy builds a MaglevTable of DefaultMaglevTableSize
+// entries, or of the next prime when there are more servers than that. It
+// panics when weights don't match servers, which Pool checks beforehand.
+func MaglevServerStrategy(servers []string, weights []int) ServerLocator {
+	size := DefaultMaglevTableSize
+	for size <= len(servers) || !isPrime(size) {
+		size++
+	}
+
+	table, err := NewMaglevTable(servers, weights, size)
+	if err != nil {
+		panic(err)
+	}
+
+	return table
+}
+
+// NewMaglevTable builds the lookup table for servers and their weights
+// (nil meaning 1 each). Size must be a prime larger than the number of
+// servers, so every permutation visits every entry.
+func NewMaglevTable(servers []string, weights []int, size int) (*MaglevTable, error) {
+	if size <= len(servers) || !isPrime(size) {
+		return nil, fmt.Errorf("error: maglev table size %d must be a prime larger than the %d servers", size, len(servers))
+	}
+	weights, err := checkWeights(servers, weights)
+	if err != nil {
+		return nil, err
+	}
+
+	table := &MaglevTable{
+		servers: append([]string{}, servers...),
+		entries: make([]int32, size),
+	}
+	if len(servers) == 0 {
+		return table, nil
+	}
+
+	for i := range table.entries {
+		table.entries[i] = -1
+	}
+
+	offsets := make([]uint64, len(servers))
+	skips := make([]uint64, len(servers))
+	next := make([]uint64, len(servers))
+	for i, server := range servers {
+		offsets[i] = xxh64Hash(server) % uint64(size)
+		skips[i] = farmHash(server)%uint64(size-1) + 1
+	}
+
+	turns := maglevTurns(weights)
+	filled := 0
+	for filled < size {
+		for i := range servers {
+			for turn := 0; turn < turns[i] && filled < size; turn++ {
+				// walk the permutation until a free entry shows up
+				entry := (offsets[i] + next[i]*skips[i]) % uint64(size)
+				for table.entries[entry] >= 0 {
+					next[i]++
+					entry = (offsets[i] + next[i]*skips[i]) % uint64(size)
+				}
+
+				table.entries[entry] = int32(i)
+				next[i]++
+				filled++
+			}
+		}
+	}
+
+	return table, nil
+}
+
+func isPrime(n int) bool {
+	if n < 2 {
+		return false
+	}
+	for d := 2; d*d <= n; d++ {
+		if n%d == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// maglevTurns reduces weights to the smallest number of turns per round
+func maglevTurns(weights []int) []int {
+	divisor := 0
+	for _, weight := range weights {
+		divisor = gcd(divisor, weight)
+	}
+
+	turns := make([]int, len(weights))
+	for i, weight := range weights {
+		turns[i] = 1
+		if divisor > 0 {
+			turns[i] = weight / divisor
+		}
+	}
+
+	return turns
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+
+	return a
+}
+
+// Locate returns the slot owning key's table entry
+func (t *MaglevTable) Locate(key string) int {
+	if len(t.servers) == 0 {
+		return 0
+	}
+
+	return int(t.entries[xxh64Hash(key)%uint64(len(t.entries))])
+}
+
+// LocateReplicas walks the table from key's entry, collecting n distinct slots
+func (t *MaglevTable) LocateReplicas(key string, n int) []int {
+	if len(t.servers) == 0 {
+		return []int{0}
+	}
+	if n > len(t.servers) {
+		n = len(t.servers)
+	}
+
+	slots := []int{}
+	seen := make(map[int32]bool)
+	start := xxh64Hash(key) % uint64(len(t.entries))
+	for i := uint64(0); i < uint64(len(t.entries)) && len(slots) < n; i++ {
+		slot := t.entries[(start+i)%uint64(len(t.entries))]
+		if !seen[slot] {
+			seen[slot] = true
+			slots = append(slots, int(slot))
+		}
+	}
+
+	return slots
+}
+
+// Disruption returns the percentage of table entries that moved to another
+// server since previous was built, matching servers by address
+func (t *MaglevTable) Disruption(previous *MaglevTable) float64 {
+	if len(t.entries) != len(previous.entries) {
+		return 100
+	}
+
+	moved := 0
+	for i, slot := range t.entries {
+		if previous.server(previous.entries[i]) != t.server(slot) {
+			moved++
+		}
+	}
+
+	return float64(moved) * 100 / float64(len(t.entries))
+}
+
+// MaglevDisruption returns the percentage of maglev table entries that moved
+// to another server in the last topology change of a pool using
+// MaglevServerStrategy, or 0 before any change
+func (v *Pool) MaglevDisruption() float64 {
+	v.RLock()
+	defer v.RUnlock()
+
+	return v.disruption
+}
+
+func (t *MaglevTable) server(slot int32) string {
+	if slot < 0 || int(slot) >= len(t.servers) {
+		return ""
+	}
+
+	return t.servers[slot]
+}
@@ -0,0 +1,210 @@
+package vshard
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type MaglevTestSuite struct {
+	suite.Suite
+	Pool *Pool
+}
+
+func (suite *MaglevTestSuite) SetupSuite() {
+	suite.Pool = &Pool{
+		Servers:          getTestServers(),
+		TopologyStrategy: MaglevServerStrategy,
+		HashKeyStrategy:  NoKeyStrategy,
+	}
+	suite.Pool.Start()
+}
+
+func (suite *MaglevTestSuite) TearDownTest() {
+	tearDownPool(suite.T(), suite.Pool)
+}
+
+func (suite *MaglevTestSuite) testMaglevSharding(key string, poolNum int) {
+	servers := getTestServers()
+	actualPoolNum := MaglevServerStrategy(servers, normalizeWeights(servers, nil)).Locate(key)
+	suite.Equal(poolNum, actualPoolNum)
+}
+
+func (suite *MaglevTestSuite) testShardingDistribution(key, value string, poolNum int) {
+	ok, err := suite.Pool.Set(key, 0, 0, []byte(value))
+	suite.True(ok)
+	suite.NoError(err)
+
+	resource, err := suite.Pool.GetPoolConnection(poolNum)
+	if err != nil {
+		suite.FailNow("Failure getting specific connection from pool", err)
+	}
+	defer suite.Pool.ReturnConnection(poolNum, resource)
+
+	result, err := resource.Get(key)
+	if err != nil {
+		suite.FailNow("Failure getting key", err, result)
+	}
+
+	if suite.NotEmpty(result) {
+		suite.Equal(value, string(result[0].Value))
+	}
+}
+
+func (suite *MaglevTestSuite) TestMaglevSharding() {
+	suite.testMaglevSharding("m", 0)
+	suite.testMaglevSharding("e", 1)
+	suite.testMaglevSharding("l", 2)
+	suite.testMaglevSharding("b", 3)
+	suite.testMaglevSharding("o", 4)
+	suite.testMaglevSharding("s", 5)
+	suite.testMaglevSharding("h", 6)
+	suite.testMaglevSharding("a", 7)
+	suite.testMaglevSharding("c", 8)
+	suite.testMaglevSharding("d", 9)
+}
+
+func (suite *MaglevTestSuite) TestShardingDistributionMaglev() {
+	suite.testShardingDistribution("m", "test-server-1", 0)
+	suite.testShardingDistribution("e", "test-server-2", 1)
+	suite.testShardingDistribution("l", "test-server-3", 2)
+	suite.testShardingDistribution("b", "test-server-4", 3)
+	suite.testShardingDistribution("o", "test-server-5", 4)
+	suite.testShardingDistribution("s", "test-server-6", 5)
+	suite.testShardingDistribution("h", "test-server-7", 6)
+	suite.testShardingDistribution("a", "test-server-8", 7)
+	suite.testShardingDistribution("c", "test-server-9", 8)
+	suite.testShardingDistribution("d", "test-server-10", 9)
+}
+
+func (suite *MaglevTestSuite) TestTableIsBalanced() {
+	servers := testServers(10)
+	table, err := NewMaglevTable(servers, nil, DefaultMaglevTableSize)
+	suite.Require().NoError(err)
+
+	counts := make([]int, len(servers))
+	for _, slot := range table.entries {
+		counts[slot]++
+	}
+
+	for _, count := range counts {
+		suite.InDelta(DefaultMaglevTableSize/10, count, 1, "every server should own the same number of entries")
+	}
+}
+
+func (suite *MaglevTestSuite) TestWeights() {
+	servers := testServers(4)
+	table, err := NewMaglevTable(servers, []int{1, 2, 4, 1}, DefaultMaglevTableSize)
+	suite.Require().NoError(err)
+
+	counts := make([]int, len(servers))
+	for _, slot := range table.entries {
+		counts[slot]++
+	}
+
+	suite.InEpsilon(DefaultMaglevTableSize/8, counts[0], 0.01)
+	suite.InEpsilon(DefaultMaglevTableSize/4, counts[1], 0.01)
+	suite.InEpsilon(DefaultMaglevTableSize/2, counts[2], 0.01)
+}
+
+func (suite *MaglevTestSuite) TestDisruption() {
+	servers := testServers(10)
+	before, err := NewMaglevTable(servers, nil, DefaultMaglevTableSize)
+	suite.Require().NoError(err)
+	remaining := without(servers, 4)
+	after, err := NewMaglevTable(remaining, nil, DefaultMaglevTableSize)
+	suite.Require().NoError(err)
+
+	suite.Equal(float64(0), before.Disruption(before))
+
+	// the removed server owned 10% of the entries, maglev moves a few more
+	disruption := after.Disruption(before)
+	suite.True(disruption >= 10 && disruption < 15, "disruption was %.2f%%", disruption)
+
+	moved := 0
+	keys := testKeys(20000)
+	for _, key := range keys {
+		if servers[before.Locate(key)] != remaining[after.Locate(key)] {
+			moved++
+		}
+	}
+	suite.InDelta(disruption, float64(moved)*100/float64(len(keys)), 1)
+}
+
+func (suite *MaglevTestSuite) TestPoolDisruption() {
+	pool := &Pool{Servers: getTestServers()[:4], TopologyStrategy: MaglevServerStrategy}
+	pool.Start()
+	defer pool.Close()
+	suite.Equal(float64(0), pool.MaglevDisruption())
+
+	// the removed server owned a quarter of the entries
+	suite.Require().NoError(pool.UpdateServers(without(getTestServers()[:4], 1)))
+	disruption := pool.MaglevDisruption()
+	suite.True(disruption >= 25 && disruption < 35, "disruption was %.2f%%", disruption)
+
+	suite.Require().NoError(pool.UpdateServers(pool.Servers))
+	suite.Equal(float64(0), pool.MaglevDisruption())
+}
+
+func (suite *MaglevTestSuite) TestEmptyTopology() {
+	table, err := NewMaglevTable(nil, nil, 7)
+	suite.NoError(err)
+	suite.Equal(0, table.Locate("a"))
+}
+
+func (suite *MaglevTestSuite) TestInvalidTables() {
+	for _, size := range []int{0, 1, 4, 9, 65536} {
+		_, err := NewMaglevTable([]string{"e:1"}, []int{1}, size)
+		suite.Error(err, "size %d", size)
+	}
+	_, err := NewMaglevTable(testServers(7), nil, 7)
+	suite.Error(err)
+	_, err = NewMaglevTable(testServers(2), []int{1}, 7)
+	suite.Error(err)
+
+	table, err := NewMaglevTable([]string{"e:1"}, []int{1}, 4)
+	suite.Error(err)
+	suite.Nil(table)
+	table, err = NewMaglevTable([]string{"e:1"}, []int{1}, 3)
+	suite.NoError(err)
+	suite.Equal(0, table.Locate("a"))
+}
+
+func TestMaglevTestSuite(t *testing.T) {
+	suite.Run(t, new(MaglevTestSuite))
+}
+
+func BenchmarkGetKeyMappingMaglev(b *testing.B) {
+	servers := []string{"0"}
+	pool := Pool{
+		Servers:         servers,
+		HashKeyStrategy: NoKeyStrategy,
+		numServers:      len(servers),
+		locator:         MaglevServerStrategy(servers, normalizeWeights(servers, nil)),
+	}
+	keys := []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9",
+		"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l", "m", "n", "o", "p", "q", "r", "s", "t", "u", "v", "w", "x", "y", "z",
+		"A", "B", "C", "D", "E", "F", "G", "H", "I", "J", "K", "L", "M", "N", "O", "P", "Q", "R", "S", "T", "U", "V", "W", "X", "Y", "Z"}
+
+	for n := 0; n < b.N; n++ {
+		_ = pool.GetKeyMapping(keys...)
+	}
+}
+
+func BenchmarkShardedServerStrategyMaglev(b *testing.B) {
+	servers := getTestServers()
+	locator := MaglevServerStrategy(servers, normalizeWeights(servers, nil))
+
+	for n := 0; n < b.N; n++ {
+		_ = locator.Locate("a")
+	}
+}
+
+func BenchmarkMaglevTableBuild(b *testing.B) {
+	servers := testServers(100)
+	weights := normalizeWeights(servers, nil)
+
+	for n := 0; n < b.N; n++ {
+		_, _ = NewMaglevTable(servers, weights, DefaultMaglevTableSize)
+	}
+}
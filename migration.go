@@ -0,0 +1,372 @@
+package vshard
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/youtube/vitess/go/cacheservice"
+	"github.com/youtube/vitess/go/pools"
+)
+
+var (
+	// ErrMigrating defines the error when the topology changes during a migration
+	ErrMigrating = errors.New("error: topology migration in progress")
+	// ErrNotMigrating defines the error when there's no migration to end
+	ErrNotMigrating = errors.New("error: no topology migration in progress")
+)
+
+const defaultCopyTimeout = 3600
+
+// Migration describes the topology a pool moves to with BeginMigration.
+// Copied items can't keep their original expiration, memcached doesn't
+// return it, so they expire after CopyTimeout seconds instead, 1 hour
+// by default.
+type Migration struct {
+	Servers     []string
+	Weights     []int
+	CopyTimeout uint64
+}
+
+// MigrationStats reports the progress of a migration. Reads count the keys
+// read, each being a hit on its new owner, a hit on its old owner (and then
+// copied forward, unless the new owner got a value meanwhile) or a miss.
+type MigrationStats struct {
+	Started     time.Time
+	OldServers  []string
+	Servers     []string
+	Reads       int64
+	NewHits     int64
+	OldHits     int64
+	Misses      int64
+	Copied      int64
+	DualWrites  int64
+	DualDeletes int64
+}
+
+// Progress returns the share of hits served by the new owners, getting
+// close to 1 as the working set moves to the new topology
+func (s MigrationStats) Progress() float64 {
+	hits := s.NewHits + s.OldHits
+	if hits == 0 {
+		return 0
+	}
+
+	return float64(s.NewHits) / float64(hits)
+}
+
+// migration is the old topology of a pool being migrated, along with its
+// counters
+type migration struct {
+	old         *topology
+	copyTimeout uint64
+	started     time.Time
+	reads       int64
+	newHits     int64
+	oldHits     int64
+	misses      int64
+	copied      int64
+	dualWrites  int64
+	dualDeletes int64
+}
+
+// BeginMigration moves the pool to a new topology while keeping the old one
+// around. Until FinalizeMigration or AbortMigration, writes and deletes go
+// to both the new and the old owner of a key, and reads that miss on the
+// new owner are tried on the old one, copying hits forward.
+//
+// Conditional commands (add, replace and cas) are decided by the new owner,
+// and the value is then set on the old one. When the new owner didn't store
+// it, the command runs on the old owner, so a replace still finds keys that
+// weren't copied yet.
+func (v *Pool) BeginMigration(m Migration) error {
+	v.update.Lock()
+	defer v.update.Unlock()
+
+	if v.migration != nil {
+		return ErrMigrating
+	}
+
+	next, err := v.buildTopology(m.Servers, m.Weights)
+	if err != nil {
+		return err
+	}
+
+	copyTimeout := m.CopyTimeout
+	if copyTimeout == 0 {
+		copyTimeout = defaultCopyTimeout
+	}
+
+	v.RLock()
+	previous := v.currentTopology()
+	v.RUnlock()
+
+	// servers only in the old topology keep their pools until the end
+	v.swapTopology(next, &migration{
+		old:         previous,
+		copyTimeout: copyTimeout,
+		started:     time.Now(),
+	})
+
+	return nil
+}
+
+// FinalizeMigration ends a migration, dropping the old topology and closing
+// the connections of the servers it alone used
+func (v *Pool) FinalizeMigration() error {
+	v.update.Lock()
+	defer v.update.Unlock()
+
+	v.Lock()
+	m := v.migration
+	current := v.currentTopology()
+	v.migration = nil
+	v.Unlock()
+
+	if m == nil {
+		return ErrNotMigrating
+	}
+
+	for _, pool := range unusedPools(m.old, current) {
+		go pool.Close()
+	}
+
+	return nil
+}
+
+// AbortMigration ends a migration, going back to the old topology. Items
+// written during the migration are on the old owners too, so nothing is lost.
+func (v *Pool) AbortMigration() error {
+	v.update.Lock()
+	defer v.update.Unlock()
+
+	v.RLock()
+	m := v.migration
+	v.RUnlock()
+
+	if m == nil {
+		return ErrNotMigrating
+	}
+
+	for _, pool := range v.swapTopology(m.old, nil) {
+		go pool.Close()
+	}
+
+	return nil
+}
+
+// MigrationStatus returns the progress of the current migration, and false
+// when there's none
+func (v *Pool) MigrationStatus() (MigrationStats, bool) {
+	v.RLock()
+	defer v.RUnlock()
+
+	m := v.migration
+	if m == nil {
+		return MigrationStats{}, false
+	}
+
+	return MigrationStats{
+		Started:     m.started,
+		OldServers:  m.old.servers,
+		Servers:     v.Servers,
+		Reads:       atomic.LoadInt64(&m.reads),
+		NewHits:     atomic.LoadInt64(&m.newHits),
+		OldHits:     atomic.LoadInt64(&m.oldHits),
+		Misses:      atomic.LoadInt64(&m.misses),
+		Copied:      atomic.LoadInt64(&m.copied),
+		DualWrites:  atomic.LoadInt64(&m.dualWrites),
+		DualDeletes: atomic.LoadInt64(&m.dualDeletes),
+	}, true
+}
+
+// oldOwner returns the current migration and the pool of key's owner in the
+// old topology, which is nil when key didn't move
+func (v *Pool) oldOwner(key string) (*migration, *pools.ResourcePool) {
+	v.RLock()
+	defer v.RUnlock()
+
+	m := v.migration
+	if m == nil {
+		return nil, nil
+	}
+
+	pool := m.old.pools[m.old.locate(v.hashTag(key), v.ServerStrategy)]
+	if pool == v.pool[v.locate(key)] {
+		return m, nil
+	}
+
+	return m, pool
+}
+
+// readThrough completes results read from the new owners of keys with the
+// items their old owners still have, copying them forward
+func (v *Pool) readThrough(keys []string, results []cacheservice.Result) []cacheservice.Result {
+	v.RLock()
+	m := v.migration
+	v.RUnlock()
+
+	if m == nil {
+		return results
+	}
+
+	found := make(map[string]bool, len(results))
+	for _, result := range results {
+		found[result.Key] = true
+	}
+	atomic.AddInt64(&m.reads, int64(len(keys)))
+	atomic.AddInt64(&m.newHits, int64(len(results)))
+
+	owners := []*pools.ResourcePool{}
+	mapping := make(map[*pools.ResourcePool][]string)
+	for _, key := range keys {
+		if found[v.HashKeyStrategy(key)] {
+			continue
+		}
+
+		_, pool := v.oldOwner(key)
+		if pool == nil {
+			atomic.AddInt64(&m.misses, 1)
+			continue
+		}
+		if _, ok := mapping[pool]; !ok {
+			owners = append(owners, pool)
+		}
+		mapping[pool] = append(mapping[pool], key)
+	}
+
+	for _, pool := range owners {
+		keys := mapping[pool]
+		hashedKeys := make(map[string]string, len(keys))
+		for _, key := range keys {
+			hashedKeys[v.HashKeyStrategy(key)] = key
+		}
+
+		// the old owner failing is a miss, it's on its way out anyway
+		old, err := v.getsOn(pool, v.hashKeys(keys)...)
+		if err != nil {
+			old = nil
+		}
+		atomic.AddInt64(&m.oldHits, int64(len(old)))
+		atomic.AddInt64(&m.misses, int64(len(keys)-len(old)))
+
+		for _, item := range old {
+			if copied, ok := v.copyForward(m, pool, hashedKeys[item.Key], item); ok {
+				results = append(results, copied)
+			}
+		}
+	}
+
+	return results
+}
+
+// copyForward adds item, read from old, to the new owner of key, returning
+// it as stored there so its CAS identifier is valid for later commands. It
+// reports false when a Delete ran since item was read, the copy undone.
+func (v *Pool) copyForward(m *migration, old *pools.ResourcePool, key string, item cacheservice.Result) (cacheservice.Result, bool) {
+	resource, _, err := v.GetConnection(key)
+	if err != nil {
+		return item, true
+	}
+	defer func() { v.release(resource, err) }()
+
+	copied, err := resource.Add(item.Key, item.Flags, m.copyTimeout, item.Value)
+	if err != nil {
+		return item, true
+	}
+
+	results, err := resource.Gets(item.Key)
+	if err != nil || len(results) == 0 {
+		return item, true
+	}
+	if !copied {
+		return results[0], true
+	}
+
+	// a Delete between the read and the Add left the old owner without
+	// the item, expire the copy unless it was written since
+	current, err := v.getsOn(old, item.Key)
+	if err == nil && len(current) == 0 {
+		_, err = resource.Cas(item.Key, item.Flags, expireNow, []byte{}, results[0].Cas)
+		return cacheservice.Result{}, false
+	}
+	atomic.AddInt64(&m.copied, 1)
+
+	return results[0], true
+}
+
+// storeOld repeats a storage command on the old owner of key, stored being
+// the reply of the new owner. Errors of the old owner are ignored, reads
+// prefer the new owner, and the old one is on its way out anyway.
+//
+// Conditional commands refused by the new owner only go on for Replace,
+// the key not being copied yet: an Add was refused by a key readers see,
+// and a CAS identifier from the new owner could match the old one's by
+// chance.
+func (v *Pool) storeOld(command Command, key string, store storeFunc, conditional bool, stored bool, flags uint16, timeout uint64, value []byte, cas uint64) bool {
+	m, pool := v.oldOwner(key)
+	if pool == nil {
+		return stored
+	}
+	atomic.AddInt64(&m.dualWrites, 1)
+
+	if conditional && stored {
+		v.storeOn(pool, storeSet, v.HashKeyStrategy(key), flags, timeout, value, 0)
+		return true
+	}
+	if conditional && command != CommandReplace {
+		return false
+	}
+
+	oldStored, err := v.storeOn(pool, store, v.HashKeyStrategy(key), flags, timeout, value, cas)
+	if err != nil {
+		return stored
+	}
+
+	return stored || oldStored
+}
+
+// deleteOld deletes key from its old owner too, so reads can't copy a
+// deleted item forward again
+func (v *Pool) deleteOld(key string, deleted bool, err error) (bool, error) {
+	m, pool := v.oldOwner(key)
+	if pool == nil {
+		return deleted, err
+	}
+	atomic.AddInt64(&m.dualDeletes, 1)
+
+	oldDeleted, oldErr := v.deleteOn(pool, v.HashKeyStrategy(key))
+	if oldErr == pools.ErrClosed {
+		// the migration just ended
+		oldErr = nil
+	}
+	if err == nil {
+		err = oldErr
+	}
+
+	return deleted || oldDeleted, err
+}
+
+// oldOnlyPools returns the pools of servers only in the old topology,
+// callers must hold the lock
+func (v *Pool) oldOnlyPools() []*pools.ResourcePool {
+	if v.migration == nil {
+		return nil
+	}
+
+	return unusedPools(v.migration.old, v.currentTopology())
+}
+
+// renewPools replaces stale pools of t with fresh ones
+func (t *topology) renewPools(renewed map[*pools.ResourcePool]*pools.ResourcePool) *topology {
+	next := *t
+	next.pools = make([]*pools.ResourcePool, len(t.pools))
+	for i, pool := range t.pools {
+		next.pools[i] = pool
+		if fresh, ok := renewed[pool]; ok {
+			next.pools[i] = fresh
+		}
+	}
+
+	return &next
+}
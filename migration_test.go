@@ -0,0 +1,304 @@
+package vshard
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type MigrationTestSuite struct {
+	suite.Suite
+	Pool *Pool
+	Old  *Pool
+	New  *Pool
+}
+
+func (suite *MigrationTestSuite) SetupTest() {
+	suite.Old = &Pool{Servers: getTestServers()[:3], IdleTimeout: time.Second * 5}
+	suite.Old.Start()
+	suite.New = &Pool{Servers: getTestServers()[2:6], IdleTimeout: time.Second * 5}
+	suite.New.Start()
+
+	suite.Pool = &Pool{Servers: getTestServers()[:3], IdleTimeout: time.Second * 5}
+	suite.Pool.Start()
+}
+
+func (suite *MigrationTestSuite) TearDownTest() {
+	suite.Pool.AbortMigration()
+	suite.Pool.Close()
+	tearDownPool(suite.T(), suite.Old)
+	tearDownPool(suite.T(), suite.New)
+	suite.Old.Close()
+	suite.New.Close()
+}
+
+func (suite *MigrationTestSuite) begin() {
+	suite.Require().NoError(suite.Pool.BeginMigration(Migration{Servers: getTestServers()[2:6]}))
+}
+
+// movedKeys returns keys whose owner changes with the migration
+func (suite *MigrationTestSuite) movedKeys(n int) []string {
+	suite.Old.RLock()
+	defer suite.Old.RUnlock()
+	suite.New.RLock()
+	defer suite.New.RUnlock()
+
+	keys := []string{}
+	for _, key := range testKeys(1000) {
+		if suite.Old.Servers[suite.Old.locate(key)] != suite.New.Servers[suite.New.locate(key)] {
+			keys = append(keys, key)
+			if len(keys) == n {
+				break
+			}
+		}
+	}
+
+	return keys
+}
+
+func (suite *MigrationTestSuite) TestDualWrites() {
+	suite.begin()
+	keys := suite.movedKeys(20)
+
+	for _, key := range keys {
+		stored, err := suite.Pool.Set(key, 0, 0, []byte(key))
+		suite.NoError(err)
+		suite.True(stored)
+	}
+
+	for _, pool := range []*Pool{suite.Old, suite.New} {
+		for _, key := range keys {
+			value, err := pool.Get(key)
+			suite.NoError(err)
+			suite.Equal(key, string(value))
+		}
+	}
+
+	stats, ok := suite.Pool.MigrationStatus()
+	suite.True(ok)
+	suite.Equal(int64(len(keys)), stats.DualWrites)
+}
+
+func (suite *MigrationTestSuite) TestReadsCopyForward() {
+	keys := suite.movedKeys(10)
+	for _, key := range keys {
+		_, err := suite.Old.Set(key, 3, 0, []byte(key))
+		suite.NoError(err)
+	}
+
+	suite.begin()
+
+	for _, key := range keys[:5] {
+		value, err := suite.Pool.Get(key)
+		suite.NoError(err)
+		suite.Equal(key, string(value))
+	}
+
+	results, err := suite.Pool.Gets(append(keys[5:], "missing")...)
+	suite.NoError(err)
+	suite.Len(results, 5)
+	cas := map[string]uint64{}
+	for _, result := range results {
+		suite.Equal(uint16(3), result.Flags)
+		cas[result.Key] = result.Cas
+	}
+
+	// the CAS identifiers returned are the new owner's
+	stored, err := suite.Pool.Cas(keys[5], 0, 0, []byte("cas"), cas[suite.Pool.HashKey(keys[5])])
+	suite.NoError(err)
+	suite.True(stored)
+
+	for _, key := range keys {
+		_, err := suite.New.Get(key)
+		suite.NoError(err)
+	}
+
+	stats, _ := suite.Pool.MigrationStatus()
+	suite.Equal(int64(11), stats.Reads)
+	suite.Equal(int64(10), stats.OldHits)
+	suite.Equal(int64(10), stats.Copied)
+	suite.Equal(int64(1), stats.Misses)
+	suite.Equal(float64(0), stats.Progress())
+
+	// copied keys now hit the new owners
+	_, err = suite.Pool.Gets(keys...)
+	suite.NoError(err)
+	stats, _ = suite.Pool.MigrationStatus()
+	suite.Equal(int64(10), stats.NewHits)
+	suite.Equal(0.5, stats.Progress())
+}
+
+func (suite *MigrationTestSuite) TestConditionalCommands() {
+	keys := suite.movedKeys(2)
+	for _, key := range keys {
+		_, err := suite.Old.Set(key, 0, 0, []byte("old"))
+		suite.NoError(err)
+	}
+
+	suite.begin()
+
+	// replace finds keys not copied yet on the old owner
+	stored, err := suite.Pool.Replace(keys[0], 0, 0, []byte("replaced"))
+	suite.NoError(err)
+	suite.True(stored)
+
+	value, err := suite.Pool.Get(keys[0])
+	suite.NoError(err)
+	suite.Equal("replaced", string(value))
+
+	stored, err = suite.Pool.Append(keys[1], 0, 0, []byte("+"))
+	suite.NoError(err)
+	suite.True(stored)
+
+	value, err = suite.Pool.Get(keys[1])
+	suite.NoError(err)
+	suite.Equal("old+", string(value))
+}
+
+func (suite *MigrationTestSuite) TestRefusedCommandsStayRefused() {
+	keys := suite.movedKeys(2)
+	_, err := suite.New.Set(keys[0], 0, 0, []byte("new"))
+	suite.NoError(err)
+	for _, pool := range []*Pool{suite.Old, suite.New} {
+		_, err = pool.Set(keys[1], 0, 0, []byte("value"))
+		suite.NoError(err)
+	}
+
+	suite.begin()
+
+	// the key exists where readers look, the old owner isn't asked
+	stored, err := suite.Pool.Add(keys[0], 0, 0, []byte("added"))
+	suite.NoError(err)
+	suite.False(stored)
+	_, err = suite.Old.Get(keys[0])
+	suite.Equal(ErrKeyNotFound, err)
+
+	// a CAS identifier of the old owner only
+	old, err := suite.Old.Gets(keys[1])
+	suite.NoError(err)
+	suite.Require().Len(old, 1)
+	_, err = suite.New.Set(keys[1], 0, 0, []byte("changed"))
+	suite.NoError(err)
+
+	stored, err = suite.Pool.Cas(keys[1], 0, 0, []byte("cas"), old[0].Cas)
+	suite.NoError(err)
+	suite.False(stored)
+	value, err := suite.Old.Get(keys[1])
+	suite.NoError(err)
+	suite.Equal("value", string(value))
+}
+
+func (suite *MigrationTestSuite) TestCopyForwardRacingDelete() {
+	keys := suite.movedKeys(1)
+	_, err := suite.Old.Set(keys[0], 0, 0, []byte("old"))
+	suite.NoError(err)
+
+	suite.begin()
+
+	// the old owner is read, then the key is deleted before the copy
+	items, err := suite.Old.Gets(keys[0])
+	suite.NoError(err)
+	suite.Require().Len(items, 1)
+	_, err = suite.Pool.Delete(keys[0])
+	suite.NoError(err)
+
+	m, pool := suite.Pool.oldOwner(keys[0])
+	suite.Require().NotNil(pool)
+	_, ok := suite.Pool.copyForward(m, pool, keys[0], items[0])
+	suite.False(ok)
+
+	_, err = suite.New.Get(keys[0])
+	suite.Equal(ErrKeyNotFound, err)
+	_, err = suite.Pool.Get(keys[0])
+	suite.Equal(ErrKeyNotFound, err)
+
+	stats, _ := suite.Pool.MigrationStatus()
+	suite.Equal(int64(0), stats.Copied)
+}
+
+func (suite *MigrationTestSuite) TestDeletes() {
+	keys := suite.movedKeys(1)
+	_, err := suite.Old.Set(keys[0], 0, 0, []byte("old"))
+	suite.NoError(err)
+
+	suite.begin()
+
+	deleted, err := suite.Pool.Delete(keys[0])
+	suite.NoError(err)
+	suite.True(deleted)
+
+	_, err = suite.Pool.Get(keys[0])
+	suite.Equal(ErrKeyNotFound, err)
+	_, err = suite.Old.Get(keys[0])
+	suite.Equal(ErrKeyNotFound, err)
+}
+
+func (suite *MigrationTestSuite) TestFinalize() {
+	keys := suite.movedKeys(1)
+	_, err := suite.Old.Set(keys[0], 0, 0, []byte("old"))
+	suite.NoError(err)
+
+	suite.begin()
+	oldOnly := suite.Pool.migration.old.pools[0]
+
+	suite.NoError(suite.Pool.FinalizeMigration())
+	suite.Equal(ErrNotMigrating, suite.Pool.FinalizeMigration())
+
+	_, ok := suite.Pool.MigrationStatus()
+	suite.False(ok)
+	suite.Equal(getTestServers()[2:6], suite.Pool.Servers)
+	suite.True(waitFor(oldOnly.IsClosed))
+
+	// reads don't fall back anymore
+	_, err = suite.Pool.Get(keys[0])
+	suite.Equal(ErrKeyNotFound, err)
+}
+
+func (suite *MigrationTestSuite) TestAbort() {
+	suite.begin()
+	newOnly := suite.Pool.pool[3]
+	keys := suite.movedKeys(5)
+
+	for _, key := range keys {
+		_, err := suite.Pool.Set(key, 0, 0, []byte(key))
+		suite.NoError(err)
+	}
+
+	suite.NoError(suite.Pool.AbortMigration())
+	suite.Equal(ErrNotMigrating, suite.Pool.AbortMigration())
+	suite.Equal(getTestServers()[:3], suite.Pool.Servers)
+	suite.True(waitFor(newOnly.IsClosed))
+
+	for _, key := range keys {
+		value, err := suite.Pool.Get(key)
+		suite.NoError(err)
+		suite.Equal(key, string(value))
+	}
+}
+
+func (suite *MigrationTestSuite) TestTopologyLocked() {
+	suite.begin()
+
+	suite.Equal(ErrMigrating, suite.Pool.BeginMigration(Migration{Servers: getTestServers()[:2]}))
+	suite.Equal(ErrMigrating, suite.Pool.UpdateServers(getTestServers()[:2]))
+	suite.Equal(ErrMigrating, suite.Pool.UpdateWeightedServers(getTestServers()[:2], []int{1, 2}))
+
+	suite.NoError(suite.Pool.FinalizeMigration())
+	suite.Equal(ErrNoServers, suite.Pool.BeginMigration(Migration{}))
+}
+
+func (suite *MigrationTestSuite) TestFlushAllReachesOldServers() {
+	_, err := suite.Old.Set("key", 0, 0, []byte("value"))
+	suite.NoError(err)
+
+	suite.begin()
+	suite.Empty(suite.Pool.FlushAll())
+
+	_, err = suite.Old.Get("key")
+	suite.Equal(ErrKeyNotFound, err)
+}
+
+func TestMigrationTestSuite(t *testing.T) {
+	suite.Run(t, new(MigrationTestSuite))
+}
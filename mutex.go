@@ -0,0 +1,179 @@
+package vshard
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+const (
+	lockKeyPrefix  = "vshard:lock:"
+	fenceKeyPrefix = "vshard:fence:"
+
+	// expireNow is past maxRelativeTimeout, so memcached reads it as an
+	// absolute timestamp in 1970 and expires the item right away
+	expireNow = uint64(maxRelativeTimeout + 1)
+
+	defaultLockRetryInterval = time.Millisecond * 50
+)
+
+var (
+	// ErrLockHeld defines the error when a lock is owned by someone else
+	ErrLockHeld = errors.New("error: lock is held")
+	// ErrLockLost defines the error when a lease expired or was taken over
+	ErrLockLost = errors.New("error: lock lost")
+)
+
+// Mutex implements named distributed locks on top of Pool.
+//
+// Each acquisition gets a fencing token that is greater than every token
+// handed out before for the same name, downstream systems should reject
+// writes carrying a token older than the last one they saw. Tokens live in
+// memcached too, so they never start below the current time in nanoseconds,
+// which keeps them increasing when the counter is evicted or flushed.
+//
+// That guarantee assumes the clocks of every client are synchronized, to
+// within the time between an eviction and the next acquisition: a client
+// whose clock lags behind can restart an evicted counter below tokens
+// already handed out. Without synchronized clocks, keep the last token of
+// each name in durable storage and have downstream systems reject it too.
+//
+// A lease is only as safe as its TTL: when it expires mid-operation (or the
+// shard owning the lock is flushed or restarted) another caller can acquire
+// the lock while the first one still runs. Unlock and Extend detect this
+// and return ErrLockLost without touching the new owner's lock.
+type Mutex struct {
+	Pool          *Pool
+	RetryInterval time.Duration
+	// added runs after a lock is added, for tests
+	added func()
+}
+
+// Lease is an acquired lock
+type Lease struct {
+	Name  string
+	Token uint64
+	cas   uint64
+}
+
+// Lock acquires the named lock, waiting for it until ctx is done
+func (m *Mutex) Lock(ctx context.Context, name string, ttl time.Duration) (*Lease, error) {
+	retryInterval := m.RetryInterval
+	if retryInterval == 0 {
+		retryInterval = defaultLockRetryInterval
+	}
+
+	for {
+		lease, err := m.TryLock(name, ttl)
+		if err != ErrLockHeld {
+			return lease, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// TryLock acquires the named lock, returning ErrLockHeld if it's taken
+func (m *Mutex) TryLock(name string, ttl time.Duration) (*Lease, error) {
+	// a missing counter restarts from this client's clock, see Mutex
+	token, err := m.Pool.addCounter(fenceKeyPrefix+name, 1, uint64(time.Now().UnixNano()), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	value := []byte(strconv.FormatUint(token, 10))
+	ok, err := m.Pool.Add(lockKeyPrefix+name, 0, leaseTimeout(ttl), value)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrLockHeld
+	}
+
+	if m.added != nil {
+		m.added()
+	}
+
+	lease := &Lease{Name: name, Token: token}
+	if _, err := m.check(lease); err != nil {
+		if err != ErrLockLost {
+			// the lock is still ours, don't leave it held until it expires
+			m.Unlock(lease)
+		}
+		return nil, err
+	}
+
+	return lease, nil
+}
+
+// Unlock releases the lock, only if it's still owned by lease
+func (m *Mutex) Unlock(lease *Lease) error {
+	value, err := m.check(lease)
+	if err != nil {
+		return err
+	}
+
+	ok, err := m.Pool.Cas(lockKeyPrefix+lease.Name, 0, expireNow, value, lease.cas)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrLockLost
+	}
+
+	return nil
+}
+
+// Extend renews the lease for another ttl, only if it's still owned by lease
+func (m *Mutex) Extend(lease *Lease, ttl time.Duration) error {
+	value, err := m.check(lease)
+	if err != nil {
+		return err
+	}
+
+	ok, err := m.Pool.Cas(lockKeyPrefix+lease.Name, 0, leaseTimeout(ttl), value, lease.cas)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrLockLost
+	}
+
+	_, err = m.check(lease)
+	return err
+}
+
+// check verifies lease still owns the lock, refreshing its CAS identifier
+func (m *Mutex) check(lease *Lease) ([]byte, error) {
+	results, err := m.Pool.Gets(lockKeyPrefix + lease.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) < 1 {
+		return nil, ErrLockLost
+	}
+
+	token, err := strconv.ParseUint(string(results[0].Value), 10, 64)
+	if err != nil || token != lease.Token {
+		return nil, ErrLockLost
+	}
+	lease.cas = results[0].Cas
+
+	return results[0].Value, nil
+}
+
+// leaseTimeout converts ttl into a timeout of at least one second, as zero
+// would never expire
+func leaseTimeout(ttl time.Duration) uint64 {
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	timeout, _ := DurationTimeout(ttl)
+
+	return timeout
+}
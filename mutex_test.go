@@ -0,0 +1,150 @@
+package vshard
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type MutexTestSuite struct {
+	suite.Suite
+	Pool  *Pool
+	Mutex *Mutex
+}
+
+func (suite *MutexTestSuite) SetupSuite() {
+	suite.Pool = setupPool(suite.T())
+	suite.Mutex = &Mutex{Pool: suite.Pool, RetryInterval: time.Millisecond * 10}
+}
+
+func (suite *MutexTestSuite) TearDownTest() {
+	tearDownPool(suite.T(), suite.Pool)
+}
+
+func (suite *MutexTestSuite) TestTryLock() {
+	lease, err := suite.Mutex.TryLock("try-lock", time.Second*10)
+	suite.NoError(err)
+
+	_, err = suite.Mutex.TryLock("try-lock", time.Second*10)
+	suite.Equal(ErrLockHeld, err)
+
+	suite.NoError(suite.Mutex.Unlock(lease))
+
+	next, err := suite.Mutex.TryLock("try-lock", time.Second*10)
+	suite.NoError(err)
+	suite.True(next.Token > lease.Token, "fencing tokens should increase")
+}
+
+func (suite *MutexTestSuite) TestLockWaits() {
+	lease, err := suite.Mutex.TryLock("wait-lock", time.Second*10)
+	suite.NoError(err)
+
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		suite.Mutex.Unlock(lease)
+	}()
+
+	next, err := suite.Mutex.Lock(context.Background(), "wait-lock", time.Second*10)
+	suite.NoError(err)
+	suite.True(next.Token > lease.Token)
+}
+
+func (suite *MutexTestSuite) TestLockContextDone() {
+	_, err := suite.Mutex.TryLock("ctx-lock", time.Second*10)
+	suite.NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	_, err = suite.Mutex.Lock(ctx, "ctx-lock", time.Second*10)
+	suite.Equal(context.DeadlineExceeded, err)
+}
+
+func (suite *MutexTestSuite) TestUnlockOnlyOwnLock() {
+	lease, err := suite.Mutex.TryLock("own-lock", time.Second*10)
+	suite.NoError(err)
+
+	forged := &Lease{Name: lease.Name, Token: lease.Token - 1}
+	suite.Equal(ErrLockLost, suite.Mutex.Unlock(forged))
+
+	_, err = suite.Mutex.TryLock("own-lock", time.Second*10)
+	suite.Equal(ErrLockHeld, err, "the lock should still be held")
+}
+
+func (suite *MutexTestSuite) TestLeaseExpiresMidOperation() {
+	lease, err := suite.Mutex.TryLock("expire-lock", time.Second)
+	suite.NoError(err)
+
+	time.Sleep(time.Millisecond * 2100)
+
+	next, err := suite.Mutex.TryLock("expire-lock", time.Second*10)
+	suite.NoError(err)
+	suite.True(next.Token > lease.Token)
+
+	suite.Equal(ErrLockLost, suite.Mutex.Extend(lease, time.Second*10))
+	suite.Equal(ErrLockLost, suite.Mutex.Unlock(lease))
+	suite.NoError(suite.Mutex.Extend(next, time.Second*10), "the new owner must keep the lock")
+	suite.NoError(suite.Mutex.Unlock(next))
+}
+
+func (suite *MutexTestSuite) TestShardFlush() {
+	lease, err := suite.Mutex.TryLock("flush-lock", time.Second*10)
+	suite.NoError(err)
+
+	suite.Pool.FlushAll()
+
+	next, err := suite.Mutex.TryLock("flush-lock", time.Second*10)
+	suite.NoError(err)
+	suite.True(next.Token > lease.Token, "tokens should keep increasing after the counter is flushed")
+	suite.Equal(ErrLockLost, suite.Mutex.Unlock(lease))
+}
+
+func (suite *MutexTestSuite) TestFailedCheckReleasesLock() {
+	proxy, err := newFlakyProxy(getTestServers()[9])
+	suite.Require().NoError(err)
+	defer proxy.Close()
+
+	pool := &Pool{Servers: []string{proxy.Addr()}, Capacity: 1, MaxCapacity: 1, IdleTimeout: time.Second * 5}
+	pool.Start()
+	defer pool.Close()
+	defer tearDownPool(suite.T(), pool)
+
+	mutex := &Mutex{Pool: pool, added: func() {
+		// drop the connection the check after Add would use
+		proxy.SetUp(false)
+		proxy.SetUp(true)
+	}}
+	_, err = mutex.TryLock("failed-check", time.Second*10)
+	suite.Error(err)
+	suite.NotEqual(ErrLockHeld, err)
+
+	mutex.added = nil
+	lease, err := mutex.TryLock("failed-check", time.Second*10)
+	suite.NoError(err)
+	suite.NotNil(lease)
+}
+
+func (suite *MutexTestSuite) TestExtend() {
+	lease, err := suite.Mutex.TryLock("extend-lock", time.Second)
+	suite.NoError(err)
+	suite.NoError(suite.Mutex.Extend(lease, time.Second*10))
+
+	time.Sleep(time.Millisecond * 2100)
+
+	_, err = suite.Mutex.TryLock("extend-lock", time.Second*10)
+	suite.Equal(ErrLockHeld, err)
+	suite.NoError(suite.Mutex.Unlock(lease))
+}
+
+func (suite *MutexTestSuite) TestLeaseTimeout() {
+	suite.Equal(uint64(1), leaseTimeout(0))
+	suite.Equal(uint64(1), leaseTimeout(time.Millisecond))
+	suite.Equal(uint64(2), leaseTimeout(time.Millisecond*1001))
+	suite.Equal(uint64(30), leaseTimeout(time.Second*30))
+}
+
+func TestMutexTestSuite(t *testing.T) {
+	suite.Run(t, new(MutexTestSuite))
+}
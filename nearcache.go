@@ -0,0 +1,117 @@
+package vshard
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// LocalCache defines the in-process near-cache tier kept in front of memcached
+type LocalCache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+	Delete(key string)
+	Purge()
+}
+
+// MemoryCache is a size bounded LRU LocalCache with an optional TTL
+type MemoryCache struct {
+	maxEntries int
+	ttl        time.Duration
+	entries    map[string]*list.Element
+	lru        *list.List
+	sync.Mutex
+}
+
+type memoryCacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewMemoryCache creates a MemoryCache holding up to maxEntries keys, each one
+// for at most ttl (zero means entries only leave the cache through eviction)
+func NewMemoryCache(maxEntries int, ttl time.Duration) *MemoryCache {
+	return &MemoryCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Get returns the cached value for key
+func (c *MemoryCache) Get(key string) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*memoryCacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.remove(element)
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+
+	return entry.value, true
+}
+
+// Set stores value under key, evicting the least recently used key if needed
+func (c *MemoryCache) Set(key string, value []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	var expires time.Time
+	if c.ttl > 0 {
+		expires = time.Now().Add(c.ttl)
+	}
+
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*memoryCacheEntry)
+		entry.value = value
+		entry.expires = expires
+		c.lru.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&memoryCacheEntry{key: key, value: value, expires: expires})
+	if c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Delete removes key from the cache
+func (c *MemoryCache) Delete(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+}
+
+// Purge removes every key from the cache
+func (c *MemoryCache) Purge() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// Len returns the number of cached keys
+func (c *MemoryCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.lru.Len()
+}
+
+func (c *MemoryCache) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*memoryCacheEntry).key)
+}
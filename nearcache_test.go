@@ -0,0 +1,68 @@
+package vshard
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type MemoryCacheTestSuite struct {
+	suite.Suite
+}
+
+func (suite *MemoryCacheTestSuite) TestSetGet() {
+	cache := NewMemoryCache(10, 0)
+	cache.Set("a", []byte("value-a"))
+
+	value, ok := cache.Get("a")
+	suite.True(ok)
+	suite.Equal("value-a", string(value))
+
+	_, ok = cache.Get("b")
+	suite.False(ok)
+}
+
+func (suite *MemoryCacheTestSuite) TestEviction() {
+	cache := NewMemoryCache(2, 0)
+	cache.Set("a", []byte("1"))
+	cache.Set("b", []byte("2"))
+	cache.Get("a")
+	cache.Set("c", []byte("3"))
+
+	suite.Equal(2, cache.Len())
+	_, ok := cache.Get("b")
+	suite.False(ok, "least recently used key should have been evicted")
+	_, ok = cache.Get("a")
+	suite.True(ok)
+	_, ok = cache.Get("c")
+	suite.True(ok)
+}
+
+func (suite *MemoryCacheTestSuite) TestTTL() {
+	cache := NewMemoryCache(10, time.Millisecond*20)
+	cache.Set("a", []byte("1"))
+
+	time.Sleep(time.Millisecond * 40)
+	_, ok := cache.Get("a")
+	suite.False(ok)
+	suite.Equal(0, cache.Len())
+}
+
+func (suite *MemoryCacheTestSuite) TestDeletePurge() {
+	cache := NewMemoryCache(10, 0)
+	cache.Set("a", []byte("1"))
+	cache.Set("b", []byte("2"))
+
+	cache.Delete("a")
+	_, ok := cache.Get("a")
+	suite.False(ok)
+	suite.Equal(1, cache.Len())
+
+	cache.Purge()
+	suite.Equal(0, cache.Len())
+}
+
+func TestMemoryCacheTestSuite(t *testing.T) {
+	suite.Run(t, new(MemoryCacheTestSuite))
+}
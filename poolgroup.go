@@ -0,0 +1,346 @@
+package vshard
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/youtube/vitess/go/cacheservice"
+)
+
+// ErrNoPools defines the error when a PoolGroup has no pools
+var ErrNoPools = errors.New("error: no pools in group")
+
+// Route decides how a PoolGroup spreads a command over its pools
+type Route int
+
+const (
+	// AllSync sends the command to every pool and waits for all of them.
+	// Writes report the worst reply: stored only if every pool stored, and
+	// the first error. Reads return the first hit in pool order.
+	AllSync Route = iota
+	// AllAsync waits for the first pool only, the others get the command in
+	// the background and their errors go to OnAsyncError. Reads only go to
+	// the first pool.
+	AllAsync
+	// FirstSuccess tries the pools in order, returning the first reply that
+	// isn't an error. A miss counts as a reply.
+	FirstSuccess
+	// LocalFirst tries the pools in order, moving on after errors and, for
+	// reads, after misses too. The first pool is the local one.
+	LocalFirst
+)
+
+// PoolGroup composes several caches, usually a Pool per datacenter with the
+// local one first, behind the same commands as Pool. Each kind of command
+// takes its own Route, for instance reads go LocalFirst while deletes go
+// AllSync so invalidations reach every region.
+//
+// CAS identifiers are only valid on the pool that returned them, so Cas
+// only makes sense with FirstSuccess and LocalFirst write routes.
+type PoolGroup struct {
+	Pools        []Cache
+	ReadRoute    Route
+	WriteRoute   Route
+	DeleteRoute  Route
+	OnAsyncError func(err error)
+	async        sync.WaitGroup
+}
+
+// Get returns a key from the pools, following ReadRoute
+func (g *PoolGroup) Get(key string) ([]byte, error) {
+	if len(g.Pools) == 0 {
+		return nil, ErrNoPools
+	}
+
+	switch g.ReadRoute {
+	case AllSync:
+		values := make([][]byte, len(g.Pools))
+		errs := make([]error, len(g.Pools))
+		g.each(func(i int, pool Cache) {
+			values[i], errs[i] = pool.Get(key)
+		})
+
+		var firstErr error
+		for i, err := range errs {
+			if err == nil {
+				return values[i], nil
+			}
+			if err != ErrKeyNotFound && firstErr == nil {
+				firstErr = err
+			}
+		}
+		if firstErr != nil {
+			return nil, firstErr
+		}
+
+		return nil, ErrKeyNotFound
+	case AllAsync:
+		return g.Pools[0].Get(key)
+	}
+
+	var lastErr error
+	for _, pool := range g.Pools {
+		value, err := pool.Get(key)
+		if err == nil || (err == ErrKeyNotFound && g.ReadRoute == FirstSuccess) {
+			return value, err
+		}
+		if err != ErrKeyNotFound {
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+
+	return nil, ErrKeyNotFound
+}
+
+// Gets returns cached data for keys from the pools, following ReadRoute.
+// Results carry the names keys are stored under in the pool that had them.
+func (g *PoolGroup) Gets(keys ...string) ([]cacheservice.Result, error) {
+	if len(g.Pools) == 0 {
+		return nil, ErrNoPools
+	}
+
+	switch g.ReadRoute {
+	case AllSync:
+		replies := make([][]cacheservice.Result, len(g.Pools))
+		errs := make([]error, len(g.Pools))
+		g.each(func(i int, pool Cache) {
+			replies[i], errs[i] = pool.Gets(keys...)
+		})
+
+		found := newFoundKeys(keys)
+		results := []cacheservice.Result{}
+		for i, pool := range g.Pools {
+			results = found.merge(results, pool, replies[i])
+		}
+		for _, err := range errs {
+			if err != nil && len(results) == 0 {
+				return nil, err
+			}
+		}
+
+		return results, nil
+	case AllAsync:
+		return g.Pools[0].Gets(keys...)
+	case FirstSuccess:
+		var lastErr error
+		for _, pool := range g.Pools {
+			results, err := pool.Gets(keys...)
+			if err == nil {
+				return results, nil
+			}
+			lastErr = err
+		}
+
+		return nil, lastErr
+	}
+
+	found := newFoundKeys(keys)
+	results := []cacheservice.Result{}
+	var lastErr error
+	for _, pool := range g.Pools {
+		missing := found.missing()
+		if len(missing) == 0 {
+			break
+		}
+
+		reply, err := pool.Gets(missing...)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		results = found.merge(results, pool, reply)
+	}
+	if len(results) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+
+	return results, nil
+}
+
+// foundKeys tracks which keys were found by the pools of a group
+type foundKeys struct {
+	keys  []string
+	found map[string]bool
+}
+
+func newFoundKeys(keys []string) *foundKeys {
+	return &foundKeys{keys: keys, found: make(map[string]bool, len(keys))}
+}
+
+// merge appends the results from pool for keys not found yet
+func (f *foundKeys) merge(results []cacheservice.Result, pool Cache, reply []cacheservice.Result) []cacheservice.Result {
+	owners := make(map[string]string, len(f.keys))
+	for _, key := range f.keys {
+		owners[pool.HashKey(key)] = key
+	}
+
+	for _, result := range reply {
+		key, ok := owners[result.Key]
+		if ok && !f.found[key] {
+			f.found[key] = true
+			results = append(results, result)
+		}
+	}
+
+	return results
+}
+
+func (f *foundKeys) missing() []string {
+	missing := []string{}
+	for _, key := range f.keys {
+		if !f.found[key] {
+			missing = append(missing, key)
+		}
+	}
+
+	return missing
+}
+
+// Set set the value with specified cache key, following WriteRoute
+func (g *PoolGroup) Set(key string, flags uint16, timeout uint64, value []byte) (bool, error) {
+	return g.route(g.WriteRoute, func(pool Cache) (bool, error) {
+		return pool.Set(key, flags, timeout, value)
+	})
+}
+
+// Add store the value only if it does not already exist, following WriteRoute
+func (g *PoolGroup) Add(key string, flags uint16, timeout uint64, value []byte) (bool, error) {
+	return g.route(g.WriteRoute, func(pool Cache) (bool, error) {
+		return pool.Add(key, flags, timeout, value)
+	})
+}
+
+// Replace replaces the value only if it already exists, following WriteRoute
+func (g *PoolGroup) Replace(key string, flags uint16, timeout uint64, value []byte) (bool, error) {
+	return g.route(g.WriteRoute, func(pool Cache) (bool, error) {
+		return pool.Replace(key, flags, timeout, value)
+	})
+}
+
+// Append appends the value after an existing item, following WriteRoute
+func (g *PoolGroup) Append(key string, flags uint16, timeout uint64, value []byte) (bool, error) {
+	return g.route(g.WriteRoute, func(pool Cache) (bool, error) {
+		return pool.Append(key, flags, timeout, value)
+	})
+}
+
+// Prepend prepends the value before an existing item, following WriteRoute
+func (g *PoolGroup) Prepend(key string, flags uint16, timeout uint64, value []byte) (bool, error) {
+	return g.route(g.WriteRoute, func(pool Cache) (bool, error) {
+		return pool.Prepend(key, flags, timeout, value)
+	})
+}
+
+// Cas stores the value only if it wasn't updated since read, following WriteRoute
+func (g *PoolGroup) Cas(key string, flags uint16, timeout uint64, value []byte, cas uint64) (bool, error) {
+	return g.route(g.WriteRoute, func(pool Cache) (bool, error) {
+		return pool.Cas(key, flags, timeout, value, cas)
+	})
+}
+
+// Delete delete the value for the specified cache key, following DeleteRoute
+func (g *PoolGroup) Delete(key string) (bool, error) {
+	return g.route(g.DeleteRoute, func(pool Cache) (bool, error) {
+		return pool.Delete(key)
+	})
+}
+
+// FlushAll purges the entire cache on every pool
+func (g *PoolGroup) FlushAll() []error {
+	errs := []error{}
+	for _, pool := range g.Pools {
+		errs = append(errs, pool.FlushAll()...)
+	}
+
+	return errs
+}
+
+// HashKey returns the name key is stored under in the first pool, pools of
+// a group are expected to hash keys the same way
+func (g *PoolGroup) HashKey(key string) string {
+	if len(g.Pools) == 0 {
+		return key
+	}
+
+	return g.Pools[0].HashKey(key)
+}
+
+// Wait blocks until the commands sent in the background by AllAsync are done
+func (g *PoolGroup) Wait() {
+	g.async.Wait()
+}
+
+// route runs a write or a delete on the pools, as route says
+func (g *PoolGroup) route(route Route, command func(pool Cache) (bool, error)) (bool, error) {
+	if len(g.Pools) == 0 {
+		return false, ErrNoPools
+	}
+
+	switch route {
+	case AllSync:
+		oks := make([]bool, len(g.Pools))
+		errs := make([]error, len(g.Pools))
+		g.each(func(i int, pool Cache) {
+			oks[i], errs[i] = command(pool)
+		})
+
+		ok := true
+		for i, err := range errs {
+			if err != nil {
+				return false, err
+			}
+			ok = ok && oks[i]
+		}
+
+		return ok, nil
+	case AllAsync:
+		for _, pool := range g.Pools[1:] {
+			g.async.Add(1)
+			go func(pool Cache) {
+				defer g.async.Done()
+				if _, err := command(pool); err != nil {
+					g.asyncError(err)
+				}
+			}(pool)
+		}
+
+		return command(g.Pools[0])
+	}
+
+	var lastErr error
+	for _, pool := range g.Pools {
+		ok, err := command(pool)
+		if err == nil {
+			return ok, nil
+		}
+		lastErr = err
+	}
+
+	return false, lastErr
+}
+
+// each runs fn on every pool concurrently, waiting for all of them
+func (g *PoolGroup) each(fn func(i int, pool Cache)) {
+	var wg sync.WaitGroup
+	for i, pool := range g.Pools {
+		wg.Add(1)
+		go func(i int, pool Cache) {
+			defer wg.Done()
+			fn(i, pool)
+		}(i, pool)
+	}
+	wg.Wait()
+}
+
+func (g *PoolGroup) asyncError(err error) {
+	if g.OnAsyncError != nil {
+		g.OnAsyncError(err)
+		return
+	}
+
+	log.Printf("vshard: async command failed: %s", err)
+}
@@ -0,0 +1,235 @@
+package vshard
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type PoolGroupTestSuite struct {
+	suite.Suite
+	Local  *Pool
+	Remote *Pool
+}
+
+func (suite *PoolGroupTestSuite) SetupSuite() {
+	suite.Local = &Pool{Servers: getTestServers()[:3], IdleTimeout: time.Second * 5}
+	suite.Local.Start()
+	suite.Remote = &Pool{Servers: getTestServers()[3:6], IdleTimeout: time.Second * 5}
+	suite.Remote.Start()
+}
+
+func (suite *PoolGroupTestSuite) TearDownTest() {
+	tearDownPool(suite.T(), suite.Local)
+	tearDownPool(suite.T(), suite.Remote)
+}
+
+func (suite *PoolGroupTestSuite) group(read, write, del Route) *PoolGroup {
+	return &PoolGroup{
+		Pools:       []Cache{suite.Local, suite.Remote},
+		ReadRoute:   read,
+		WriteRoute:  write,
+		DeleteRoute: del,
+	}
+}
+
+// deadPool returns a pool whose only server stopped answering
+func (suite *PoolGroupTestSuite) deadPool() (*Pool, *flakyProxy) {
+	proxy, err := newFlakyProxy(getTestServers()[9])
+	suite.Require().NoError(err)
+
+	pool := &Pool{Servers: []string{proxy.Addr()}}
+	pool.Start()
+	proxy.SetUp(false)
+
+	return pool, proxy
+}
+
+func (suite *PoolGroupTestSuite) TestAllSyncWritesAndDeletes() {
+	group := suite.group(LocalFirst, AllSync, AllSync)
+
+	stored, err := group.Set("key", 0, 0, []byte("value"))
+	suite.NoError(err)
+	suite.True(stored)
+
+	for _, pool := range []*Pool{suite.Local, suite.Remote} {
+		value, err := pool.Get("key")
+		suite.NoError(err)
+		suite.Equal("value", string(value))
+	}
+
+	deleted, err := group.Delete("key")
+	suite.NoError(err)
+	suite.True(deleted)
+
+	for _, pool := range []*Pool{suite.Local, suite.Remote} {
+		_, err := pool.Get("key")
+		suite.Equal(ErrKeyNotFound, err)
+	}
+
+	// the worst reply wins
+	_, err = suite.Remote.Set("key", 0, 0, []byte("remote"))
+	suite.NoError(err)
+	deleted, err = group.Delete("key")
+	suite.NoError(err)
+	suite.False(deleted)
+}
+
+func (suite *PoolGroupTestSuite) TestAllAsync() {
+	group := suite.group(AllAsync, AllAsync, AllAsync)
+
+	stored, err := group.Set("key", 0, 0, []byte("value"))
+	suite.NoError(err)
+	suite.True(stored)
+	group.Wait()
+
+	value, err := suite.Remote.Get("key")
+	suite.NoError(err)
+	suite.Equal("value", string(value))
+
+	_, err = suite.Local.Delete("key")
+	suite.NoError(err)
+
+	// reads only go to the first pool
+	_, err = group.Get("key")
+	suite.Equal(ErrKeyNotFound, err)
+}
+
+func (suite *PoolGroupTestSuite) TestAllAsyncErrors() {
+	dead, proxy := suite.deadPool()
+	defer proxy.Close()
+	defer dead.Close()
+
+	var lock sync.Mutex
+	errs := []error{}
+	group := &PoolGroup{
+		Pools:       []Cache{suite.Local, dead},
+		DeleteRoute: AllAsync,
+		OnAsyncError: func(err error) {
+			lock.Lock()
+			errs = append(errs, err)
+			lock.Unlock()
+		},
+	}
+
+	_, err := group.Delete("key")
+	suite.NoError(err)
+	group.Wait()
+
+	lock.Lock()
+	suite.Len(errs, 1)
+	lock.Unlock()
+}
+
+func (suite *PoolGroupTestSuite) TestLocalFirstReads() {
+	group := suite.group(LocalFirst, AllSync, AllSync)
+
+	_, err := suite.Local.Set("local", 0, 0, []byte("local"))
+	suite.NoError(err)
+	_, err = suite.Remote.Set("local", 0, 0, []byte("stale"))
+	suite.NoError(err)
+	_, err = suite.Remote.Set("remote", 0, 0, []byte("remote"))
+	suite.NoError(err)
+
+	value, err := group.Get("local")
+	suite.NoError(err)
+	suite.Equal("local", string(value))
+
+	value, err = group.Get("remote")
+	suite.NoError(err)
+	suite.Equal("remote", string(value))
+
+	_, err = group.Get("missing")
+	suite.Equal(ErrKeyNotFound, err)
+
+	results, err := group.Gets("local", "remote", "missing")
+	suite.NoError(err)
+	suite.Len(results, 2)
+
+	values := map[string]string{}
+	for _, result := range results {
+		values[result.Key] = string(result.Value)
+	}
+	suite.Equal("local", values[suite.Local.HashKey("local")])
+	suite.Equal("remote", values[suite.Remote.HashKey("remote")])
+}
+
+func (suite *PoolGroupTestSuite) TestFirstSuccess() {
+	dead, proxy := suite.deadPool()
+	defer proxy.Close()
+	defer dead.Close()
+
+	_, err := suite.Local.Set("key", 0, 0, []byte("value"))
+	suite.NoError(err)
+
+	group := &PoolGroup{Pools: []Cache{dead, suite.Local, suite.Remote}, ReadRoute: FirstSuccess, WriteRoute: FirstSuccess}
+
+	value, err := group.Get("key")
+	suite.NoError(err)
+	suite.Equal("value", string(value))
+
+	stored, err := group.Set("other", 0, 0, []byte("other"))
+	suite.NoError(err)
+	suite.True(stored)
+	_, err = suite.Remote.Get("other")
+	suite.Equal(ErrKeyNotFound, err)
+
+	// a miss is a reply, so it doesn't move on
+	group.Pools = []Cache{suite.Remote, suite.Local}
+	_, err = group.Get("key")
+	suite.Equal(ErrKeyNotFound, err)
+}
+
+func (suite *PoolGroupTestSuite) TestAllSyncReads() {
+	group := suite.group(AllSync, AllSync, AllSync)
+
+	_, err := suite.Remote.Set("key", 0, 0, []byte("remote"))
+	suite.NoError(err)
+
+	value, err := group.Get("key")
+	suite.NoError(err)
+	suite.Equal("remote", string(value))
+
+	_, err = suite.Local.Set("key", 0, 0, []byte("local"))
+	suite.NoError(err)
+
+	value, err = group.Get("key")
+	suite.NoError(err)
+	suite.Equal("local", string(value))
+
+	results, err := group.Gets("key")
+	suite.NoError(err)
+	suite.Len(results, 1)
+	suite.Equal("local", string(results[0].Value))
+}
+
+func (suite *PoolGroupTestSuite) TestNestedGroups() {
+	inner := suite.group(LocalFirst, AllSync, AllSync)
+	group := &PoolGroup{Pools: []Cache{inner}, ReadRoute: LocalFirst}
+
+	_, err := group.Set("key", 0, 0, []byte("value"))
+	suite.NoError(err)
+
+	value, err := group.Get("key")
+	suite.NoError(err)
+	suite.Equal("value", string(value))
+
+	suite.Empty(group.FlushAll())
+	_, err = suite.Remote.Get("key")
+	suite.Equal(ErrKeyNotFound, err)
+}
+
+func (suite *PoolGroupTestSuite) TestNoPools() {
+	group := &PoolGroup{}
+
+	_, err := group.Get("key")
+	suite.Equal(ErrNoPools, err)
+	_, err = group.Set("key", 0, 0, []byte("value"))
+	suite.Equal(ErrNoPools, err)
+}
+
+func TestPoolGroupTestSuite(t *testing.T) {
+	suite.Run(t, new(PoolGroupTestSuite))
+}
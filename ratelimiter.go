@@ -0,0 +1,170 @@
+package vshard
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+const rateKeyPrefix = "vshard:rate:"
+
+var (
+	// ErrInvalidRateLimit defines the error when a RateLimiter has no Limit or Window
+	ErrInvalidRateLimit = errors.New("error: rate limit and window must be set")
+)
+
+// RateLimitAlgorithm defines how RateLimiter counts requests
+type RateLimitAlgorithm int
+
+const (
+	// FixedWindow counts requests in consecutive, non overlapping windows
+	FixedWindow RateLimitAlgorithm = iota
+	// SlidingWindow approximates a sliding window log by weighting the
+	// previous window's count by how much of it still overlaps the last Window
+	SlidingWindow
+)
+
+// RateLimiter limits how many requests each key can make per Window.
+//
+// Counters live on the shard owning each limiter key, a key allows up to
+// Limit requests per Window across every process sharing the Pool.
+type RateLimiter struct {
+	Pool      *Pool
+	Limit     uint64
+	Window    time.Duration
+	Algorithm RateLimitAlgorithm
+	// MaxDelay bounds how far ahead Reserve may book requests, defaults to Window
+	MaxDelay time.Duration
+	clock    func() time.Time
+}
+
+// Reservation is the outcome of RateLimiter.Reserve
+type Reservation struct {
+	// OK reports whether the requests were booked within MaxDelay
+	OK bool
+	// Delay is how long the caller must wait before going ahead
+	Delay time.Duration
+}
+
+// Allow reports whether n requests for key may happen now, counting them if so
+func (r *RateLimiter) Allow(key string, n uint64) (bool, error) {
+	reservation, err := r.reserve(key, n, 0)
+	if err != nil {
+		return false, err
+	}
+
+	return reservation.OK, nil
+}
+
+// Reserve books n requests for key in the earliest window with room for them,
+// the requests are counted even if the caller chooses not to wait for Delay
+func (r *RateLimiter) Reserve(key string, n uint64) (*Reservation, error) {
+	maxDelay := r.MaxDelay
+	if maxDelay == 0 {
+		maxDelay = r.Window
+	}
+
+	return r.reserve(key, n, maxDelay)
+}
+
+func (r *RateLimiter) reserve(key string, n uint64, maxDelay time.Duration) (*Reservation, error) {
+	if r.Limit == 0 || r.Window <= 0 {
+		return nil, ErrInvalidRateLimit
+	}
+	if n > r.Limit {
+		return &Reservation{}, nil
+	}
+
+	now := r.now()
+	deadline := now.Add(maxDelay)
+	window := now.UnixNano() / int64(r.Window)
+
+	for ; !r.windowStart(window).After(deadline); window++ {
+		previous := uint64(0)
+		if r.Algorithm == SlidingWindow {
+			var err error
+			previous, err = r.count(key, window-1)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var at time.Time
+		_, ok, err := r.Pool.updateCounter(r.windowKey(key, window), r.windowTimeout(window, now), func(current uint64) (uint64, bool) {
+			var fits bool
+			at, fits = r.earliest(window, previous, current, n, now)
+			if !fits || at.After(deadline) {
+				return current, false
+			}
+			return current + n, true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return &Reservation{OK: true, Delay: at.Sub(now)}, nil
+		}
+	}
+
+	return &Reservation{}, nil
+}
+
+// earliest returns the first moment, not before now, in which n more requests
+// fit in window given the counts of the window and the one before it
+func (r *RateLimiter) earliest(window int64, previous, current, n uint64, now time.Time) (time.Time, bool) {
+	if current+n > r.Limit {
+		return time.Time{}, false
+	}
+
+	start := r.windowStart(window)
+	at := start
+	if previous > 0 {
+		// previous*(1-elapsed/Window) + current + n <= Limit
+		room := float64(r.Limit - current - n)
+		elapsed := 1 - room/float64(previous)
+		if elapsed > 0 {
+			at = start.Add(time.Duration(elapsed * float64(r.Window)))
+		}
+	}
+
+	if at.Before(now) {
+		at = now
+	}
+
+	return at, at.Before(start.Add(r.Window))
+}
+
+func (r *RateLimiter) count(key string, window int64) (uint64, error) {
+	// counters change all the time, so they never go through the LocalCache
+	result, err := r.Pool.get(r.windowKey(key, window))
+	if err != nil {
+		return 0, err
+	}
+	if len(result) < 1 {
+		return 0, nil
+	}
+
+	return strconv.ParseUint(string(result[0].Value), 10, 64)
+}
+
+// windowTimeout returns the timeout of the counter of window, booked at now,
+// which outlives the window after it, where SlidingWindow still reads it
+func (r *RateLimiter) windowTimeout(window int64, now time.Time) uint64 {
+	return leaseTimeout(r.windowStart(window + 2).Sub(now))
+}
+
+func (r *RateLimiter) windowKey(key string, window int64) string {
+	return rateKeyPrefix + key + ":" + strconv.FormatInt(window, 10)
+}
+
+func (r *RateLimiter) windowStart(window int64) time.Time {
+	return time.Unix(0, window*int64(r.Window))
+}
+
+func (r *RateLimiter) now() time.Time {
+	if r.clock != nil {
+		return r.clock()
+	}
+
+	return time.Now()
+}
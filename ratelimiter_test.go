@@ -0,0 +1,174 @@
+package vshard
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RateLimiterTestSuite struct {
+	suite.Suite
+	Pool *Pool
+	Now  time.Time
+}
+
+func (suite *RateLimiterTestSuite) SetupSuite() {
+	suite.Pool = setupPool(suite.T())
+}
+
+func (suite *RateLimiterTestSuite) SetupTest() {
+	suite.Now = time.Now().Truncate(time.Minute)
+}
+
+func (suite *RateLimiterTestSuite) TearDownTest() {
+	tearDownPool(suite.T(), suite.Pool)
+}
+
+func (suite *RateLimiterTestSuite) newRateLimiter(algorithm RateLimitAlgorithm) *RateLimiter {
+	return &RateLimiter{
+		Pool:      suite.Pool,
+		Limit:     10,
+		Window:    time.Minute,
+		Algorithm: algorithm,
+		clock:     func() time.Time { return suite.Now },
+	}
+}
+
+func (suite *RateLimiterTestSuite) allowed(limiter *RateLimiter, key string, attempts int) int {
+	allowed := 0
+	for i := 0; i < attempts; i++ {
+		ok, err := limiter.Allow(key, 1)
+		suite.NoError(err)
+		if ok {
+			allowed++
+		}
+	}
+
+	return allowed
+}
+
+func (suite *RateLimiterTestSuite) TestFixedWindow() {
+	limiter := suite.newRateLimiter(FixedWindow)
+
+	suite.Equal(10, suite.allowed(limiter, "fixed", 15))
+	suite.Equal(10, suite.allowed(limiter, "other-fixed", 10), "keys should be limited independently")
+
+	suite.Now = suite.Now.Add(time.Second * 59)
+	suite.Equal(0, suite.allowed(limiter, "fixed", 1))
+
+	suite.Now = suite.Now.Add(time.Second)
+	suite.Equal(10, suite.allowed(limiter, "fixed", 15), "a new window should reset the limit")
+}
+
+func (suite *RateLimiterTestSuite) TestAllowN() {
+	limiter := suite.newRateLimiter(FixedWindow)
+
+	ok, err := limiter.Allow("allow-n", 7)
+	suite.NoError(err)
+	suite.True(ok)
+
+	ok, err = limiter.Allow("allow-n", 4)
+	suite.NoError(err)
+	suite.False(ok, "denied requests must not be counted")
+
+	ok, err = limiter.Allow("allow-n", 3)
+	suite.NoError(err)
+	suite.True(ok)
+
+	ok, err = limiter.Allow("allow-n", 11)
+	suite.NoError(err)
+	suite.False(ok)
+}
+
+func (suite *RateLimiterTestSuite) TestSlidingWindow() {
+	limiter := suite.newRateLimiter(SlidingWindow)
+	suite.Equal(10, suite.allowed(limiter, "sliding", 10))
+
+	// a quarter into the next window, 75% of the previous one still counts
+	suite.Now = suite.Now.Add(time.Second * 75)
+	suite.Equal(2, suite.allowed(limiter, "sliding", 5))
+
+	suite.Now = suite.Now.Add(time.Second * 30)
+	suite.Equal(5, suite.allowed(limiter, "sliding", 10))
+}
+
+func (suite *RateLimiterTestSuite) TestReserveFixedWindow() {
+	limiter := suite.newRateLimiter(FixedWindow)
+	suite.Now = suite.Now.Add(time.Second * 20)
+
+	reservation, err := limiter.Reserve("reserve-fixed", 10)
+	suite.NoError(err)
+	suite.True(reservation.OK)
+	suite.Equal(time.Duration(0), reservation.Delay)
+
+	reservation, err = limiter.Reserve("reserve-fixed", 5)
+	suite.NoError(err)
+	suite.True(reservation.OK)
+	suite.Equal(time.Second*40, reservation.Delay, "should wait for the next window")
+
+	reservation, err = limiter.Reserve("reserve-fixed", 6)
+	suite.NoError(err)
+	suite.False(reservation.OK, "both windows within MaxDelay are full")
+}
+
+func (suite *RateLimiterTestSuite) TestReserveSlidingWindow() {
+	limiter := suite.newRateLimiter(SlidingWindow)
+	suite.Equal(10, suite.allowed(limiter, "reserve-sliding", 10))
+	suite.Now = suite.Now.Add(time.Second * 60)
+
+	reservation, err := limiter.Reserve("reserve-sliding", 5)
+	suite.NoError(err)
+	suite.True(reservation.OK)
+	suite.Equal(time.Second*30, reservation.Delay, "half of the previous window must slide out")
+}
+
+func (suite *RateLimiterTestSuite) TestCountersOutliveBookedWindows() {
+	limiter := suite.newRateLimiter(FixedWindow)
+	limiter.MaxDelay = limiter.Window * 4
+	current := suite.Now.UnixNano() / int64(limiter.Window)
+
+	for window := current; window <= current+4; window++ {
+		timeout := time.Duration(limiter.windowTimeout(window, suite.Now)) * time.Second
+		suite.True(timeout >= limiter.windowStart(window+2).Sub(suite.Now), "window %d", window-current)
+	}
+
+	// a full window a few windows ahead stays full
+	for i := 0; i < 5; i++ {
+		reservation, err := limiter.Reserve("far-ahead", 10)
+		suite.NoError(err)
+		suite.True(reservation.OK)
+	}
+	reservation, err := limiter.Reserve("far-ahead", 1)
+	suite.NoError(err)
+	suite.False(reservation.OK)
+}
+
+func (suite *RateLimiterTestSuite) TestInvalidLimit() {
+	limiter := &RateLimiter{Pool: suite.Pool}
+	_, err := limiter.Allow("invalid", 1)
+	suite.Equal(ErrInvalidRateLimit, err)
+}
+
+func (suite *RateLimiterTestSuite) TestCountersAreSharded() {
+	limiter := suite.newRateLimiter(FixedWindow)
+	limiter.Allow("sharded-limit", 3)
+
+	key := limiter.windowKey("sharded-limit", suite.Now.UnixNano()/int64(time.Minute))
+	poolNum := suite.Pool.locate(key)
+	resource, err := suite.Pool.GetPoolConnection(poolNum)
+	if err != nil {
+		suite.FailNow("Failure getting specific connection from pool", err)
+	}
+	defer suite.Pool.ReturnConnection(poolNum, resource)
+
+	result, err := resource.Get(suite.Pool.HashKeyStrategy(key))
+	suite.NoError(err)
+	if suite.Len(result, 1) {
+		suite.Equal("3", string(result[0].Value))
+	}
+}
+
+func TestRateLimiterTestSuite(t *testing.T) {
+	suite.Run(t, new(RateLimiterTestSuite))
+}
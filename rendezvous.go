@@ -0,0 +1,14 @@
+package vshard
+
+// RendezvousServerStrategy uses weighted rendezvous (highest random weight)
+// hashing with servers identified by address instead of position, so any
+// server can be added or removed and only the keys it owns (or will own)
+// move. Lookups score every server, costing O(servers) per key.
+func RendezvousServerStrategy(servers []string, weights []int) ServerLocator {
+	seeds := make([]uint64, len(servers))
+	for i, server := range servers {
+		seeds[i] = xxh64Hash(server)
+	}
+
+	return newWeightedLocator(xxh64Hash, seeds, weights)
+}
@@ -0,0 +1,141 @@
+package vshard
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RendezvousTestSuite struct {
+	suite.Suite
+}
+
+func testServers(n int) []string {
+	servers := make([]string, n)
+	for i := range servers {
+		servers[i] = "10.0." + strconv.Itoa(i/250) + "." + strconv.Itoa(i%250+1) + ":11211"
+	}
+
+	return servers
+}
+
+func without(servers []string, i int) []string {
+	return append(append([]string{}, servers[:i]...), servers[i+1:]...)
+}
+
+func (suite *RendezvousTestSuite) TestRemoveAnyServer() {
+	servers := testServers(10)
+	before := RendezvousServerStrategy(servers, normalizeWeights(servers, nil))
+	remaining := without(servers, 3)
+	after := RendezvousServerStrategy(remaining, normalizeWeights(remaining, nil))
+	keys := testKeys(20000)
+
+	moved := 0
+	for _, key := range keys {
+		oldServer, newServer := servers[before.Locate(key)], remaining[after.Locate(key)]
+		if oldServer != newServer {
+			moved++
+			suite.Equal(servers[3], oldServer, "only keys of the removed server should move")
+		}
+	}
+	suite.InEpsilon(len(keys)/10, moved, 0.1)
+
+	// jump hash, for comparison, reshuffles most keys when a middle server goes away
+	jumpMoved := 0
+	for _, key := range keys {
+		if servers[XXH64ShardServerStrategy(key, 10)] != remaining[XXH64ShardServerStrategy(key, 9)] {
+			jumpMoved++
+		}
+	}
+	suite.True(jumpMoved > moved*3)
+}
+
+func (suite *RendezvousTestSuite) TestAddServer() {
+	servers := testServers(10)
+	before := RendezvousServerStrategy(servers[:9], normalizeWeights(servers[:9], nil))
+	after := RendezvousServerStrategy(servers, normalizeWeights(servers, nil))
+
+	for _, key := range testKeys(10000) {
+		oldServer, newServer := servers[before.Locate(key)], servers[after.Locate(key)]
+		if oldServer != newServer {
+			suite.Equal(servers[9], newServer, "keys should only move to the new server")
+		}
+	}
+}
+
+func (suite *RendezvousTestSuite) TestOrderDoesNotMatter() {
+	servers := testServers(5)
+	reversed := []string{servers[4], servers[3], servers[2], servers[1], servers[0]}
+	locator := RendezvousServerStrategy(servers, normalizeWeights(servers, nil))
+	reversedLocator := RendezvousServerStrategy(reversed, normalizeWeights(reversed, nil))
+
+	for _, key := range testKeys(1000) {
+		suite.Equal(servers[locator.Locate(key)], reversed[reversedLocator.Locate(key)])
+	}
+}
+
+func (suite *RendezvousTestSuite) TestWeights() {
+	servers := testServers(4)
+	weights := []int{1, 2, 4, 1}
+	locator := RendezvousServerStrategy(servers, weights)
+	keys := testKeys(80000)
+
+	counts := make([]int, len(servers))
+	for _, key := range keys {
+		counts[locator.Locate(key)]++
+	}
+
+	for i, weight := range weights {
+		suite.InEpsilon(len(keys)*weight/8, counts[i], 0.05)
+	}
+}
+
+func (suite *RendezvousTestSuite) TestDistribution() {
+	servers := testServers(100)
+	locator := RendezvousServerStrategy(servers, normalizeWeights(servers, nil))
+	keys := testKeys(200000)
+
+	counts := make([]int, len(servers))
+	for _, key := range keys {
+		counts[locator.Locate(key)]++
+	}
+
+	for _, count := range counts {
+		suite.InEpsilon(len(keys)/len(servers), count, 0.15)
+	}
+}
+
+func TestRendezvousTestSuite(t *testing.T) {
+	suite.Run(t, new(RendezvousTestSuite))
+}
+
+func benchmarkRendezvous(b *testing.B, numServers int, weighted bool) {
+	servers := testServers(numServers)
+	weights := normalizeWeights(servers, nil)
+	if weighted {
+		weights[0] = 2
+	}
+	locator := RendezvousServerStrategy(servers, weights)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_ = locator.Locate("a")
+	}
+}
+
+func BenchmarkShardedServerStrategyRendezvous(b *testing.B) {
+	benchmarkRendezvous(b, 10, false)
+}
+
+func BenchmarkShardedServerStrategyRendezvous100(b *testing.B) {
+	benchmarkRendezvous(b, 100, false)
+}
+
+func BenchmarkShardedServerStrategyRendezvous1000(b *testing.B) {
+	benchmarkRendezvous(b, 1000, false)
+}
+
+func BenchmarkShardedServerStrategyRendezvousWeighted100(b *testing.B) {
+	benchmarkRendezvous(b, 100, true)
+}
@@ -0,0 +1,388 @@
+package vshard
+
+import (
+	"log"
+
+	"github.com/youtube/vitess/go/cacheservice"
+	"github.com/youtube/vitess/go/pools"
+)
+
+// defaultMaxPendingDeletes is how many deletes a down replica can miss
+// before it's flushed when back, instead of replaying them
+const defaultMaxPendingDeletes = 10000
+
+// ReplicaLocator is a ServerLocator able to rank servers for a key, Pools
+// with Replicas store each key on the first servers of that ranking.
+// Locators without a ranking, and plain ServerStrategy functions, use the
+// slots following the one owning the key.
+type ReplicaLocator interface {
+	ServerLocator
+	LocateReplicas(key string, n int) []int
+}
+
+// replicaSlots returns the live slots holding key, primary first. Callers
+// must hold the lock.
+func (v *Pool) replicaSlots(key string) []int {
+	slots, n := v.rankedReplicaSlots(key)
+
+	live := slots[:0]
+	for _, slot := range slots {
+		if !v.isDown(slot) {
+			live = append(live, slot)
+		}
+	}
+	if len(live) > n {
+		live = live[:n]
+	}
+
+	return live
+}
+
+// downReplicaSlots returns the down slots that hold key's replicas again
+// once they're back. Callers must hold the lock.
+func (v *Pool) downReplicaSlots(key string) []int {
+	slots, _ := v.rankedReplicaSlots(key)
+
+	down := []int{}
+	for _, slot := range slots {
+		if v.isDown(slot) {
+			down = append(down, slot)
+		}
+	}
+
+	return down
+}
+
+// rankedReplicaSlots returns the slots ranked for key, with an extra slot
+// for each down server, along with the number of replicas. Callers must
+// hold the lock.
+func (v *Pool) rankedReplicaSlots(key string) ([]int, int) {
+	n := v.Replicas
+	if n > v.numServers {
+		n = v.numServers
+	}
+
+	// ask for extra servers to make up for the down ones
+	want := n
+	for _, down := range v.down {
+		if down && want < v.numServers {
+			want++
+		}
+	}
+
+	tag := v.hashTag(key)
+	var slots []int
+	if locator, ok := v.locator.(ReplicaLocator); ok {
+		slots = locator.LocateReplicas(tag, want)
+	} else {
+		primary := v.locateSlot(tag)
+		for i := 0; i < want; i++ {
+			slots = append(slots, (primary+i)%v.numServers)
+		}
+	}
+
+	return slots, n
+}
+
+// replicaPools returns the pools holding key's replicas, primary first
+func (v *Pool) replicaPools(key string) ([]*pools.ResourcePool, error) {
+	v.RLock()
+	defer v.RUnlock()
+
+	replicas := []*pools.ResourcePool{}
+	for _, slot := range v.replicaSlots(key) {
+		replicas = append(replicas, v.pool[slot])
+	}
+	if len(replicas) == 0 {
+		return nil, ErrServerDown
+	}
+
+	return replicas, nil
+}
+
+// storeOn runs store with a connection from pool
+func (v *Pool) storeOn(pool *pools.ResourcePool, store storeFunc, key string, flags uint16, timeout uint64, value []byte, cas uint64) (bool, error) {
+	resource, err := getConnection(pool)
+	if err != nil {
+		return false, err
+	}
+	defer func() { v.release(resource, err) }()
+
+	stored, err := store(resource, key, flags, timeout, value, cas)
+
+	return stored, err
+}
+
+// replicatedStore writes key to every replica. Conditional commands (add,
+// replace and cas) are decided by the replica reads are served from, as
+// CAS identifiers differ between servers, and the value is then set on the
+// other replicas.
+// The rest count as stored when any replica stored them, failing only when
+// every replica failed.
+func (v *Pool) replicatedStore(key string, store storeFunc, conditional bool, flags uint16, timeout uint64, value []byte, cas uint64) (bool, error) {
+	for {
+		replicas, err := v.replicaPools(key)
+		if err != nil {
+			return false, err
+		}
+
+		stored, err := v.storeReplicas(replicas, store, conditional, v.HashKeyStrategy(key), flags, timeout, value, cas)
+		if err == pools.ErrClosed {
+			// a server was just removed by UpdateServers, locate the key again
+			continue
+		}
+		if err == nil && stored {
+			v.invalidate(key)
+		}
+
+		return stored, err
+	}
+}
+
+func (v *Pool) storeReplicas(replicas []*pools.ResourcePool, store storeFunc, conditional bool, key string, flags uint16, timeout uint64, value []byte, cas uint64) (bool, error) {
+	if conditional {
+		decider := 0
+		stored, err := v.storeOn(replicas[0], store, key, flags, timeout, value, cas)
+		if err != nil {
+			return false, err
+		}
+		if !stored {
+			// a primary that lost the key refuses it, while reads and their
+			// CAS identifiers come from the next replica holding it
+			decider = v.servingReplica(replicas, key)
+			if decider < 1 {
+				return false, nil
+			}
+			stored, err = v.storeOn(replicas[decider], store, key, flags, timeout, value, cas)
+			if err != nil || !stored {
+				return stored, err
+			}
+		}
+
+		for i, pool := range replicas {
+			if i != decider {
+				v.storeOn(pool, storeSet, key, flags, timeout, value, 0)
+			}
+		}
+
+		return true, nil
+	}
+
+	var lastErr error
+	anyStored, failures := false, 0
+	for _, pool := range replicas {
+		stored, err := v.storeOn(pool, store, key, flags, timeout, value, cas)
+		if err != nil {
+			lastErr = err
+			failures++
+			continue
+		}
+		anyStored = anyStored || stored
+	}
+
+	if failures == len(replicas) {
+		return false, lastErr
+	}
+
+	return anyStored, nil
+}
+
+// servingReplica returns the index of the first of replicas holding key,
+// the one replicatedGets reads it from, or -1
+func (v *Pool) servingReplica(replicas []*pools.ResourcePool, key string) int {
+	for i, pool := range replicas {
+		results, err := v.getsOn(pool, key)
+		if err == nil && len(results) > 0 {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// replicatedDelete deletes key from every replica, returning the first
+// error so callers know when a replica may still hold it. Replicas that
+// are down get the delete once they're back.
+func (v *Pool) replicatedDelete(key string) (bool, error) {
+	hashedKey := v.HashKeyStrategy(key)
+
+	v.RLock()
+	replicas := []*pools.ResourcePool{}
+	for _, slot := range v.replicaSlots(key) {
+		replicas = append(replicas, v.pool[slot])
+	}
+	// recorded under the lock, so a server can't come back in between
+	for _, slot := range v.downReplicaSlots(key) {
+		v.addPendingDelete(v.Servers[slot], hashedKey)
+	}
+	v.RUnlock()
+
+	if len(replicas) == 0 {
+		return false, ErrServerDown
+	}
+
+	var firstErr error
+	anyDeleted := false
+	for _, pool := range replicas {
+		deleted, err := v.deleteOn(pool, hashedKey)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		anyDeleted = anyDeleted || deleted
+	}
+	if firstErr == nil {
+		v.invalidate(key)
+	}
+
+	return anyDeleted, firstErr
+}
+
+// pendingDeletes are the deletes a down replica missed
+type pendingDeletes struct {
+	keys map[string]bool
+	// overflow means too many deletes were missed, the server is flushed
+	overflow bool
+}
+
+// addPendingDelete records a delete of key missed by server
+func (v *Pool) addPendingDelete(server string, key string) {
+	v.pendingLock.Lock()
+	defer v.pendingLock.Unlock()
+
+	if v.pendingDeletes == nil {
+		v.pendingDeletes = make(map[string]*pendingDeletes)
+	}
+	pending := v.pendingDeletes[server]
+	if pending == nil {
+		pending = &pendingDeletes{keys: make(map[string]bool)}
+		v.pendingDeletes[server] = pending
+	}
+	if pending.overflow {
+		return
+	}
+
+	pending.keys[key] = true
+	if len(pending.keys) > defaultMaxPendingDeletes {
+		pending.keys, pending.overflow = nil, true
+	}
+}
+
+// applyPendingDeletes runs the deletes server missed while down on pool,
+// keeping the ones that failed for the next time it's back
+func (v *Pool) applyPendingDeletes(server string, pool *pools.ResourcePool) {
+	v.pendingLock.Lock()
+	pending := v.pendingDeletes[server]
+	delete(v.pendingDeletes, server)
+	v.pendingLock.Unlock()
+
+	if pending == nil {
+		return
+	}
+
+	resource, err := getConnection(pool)
+	if err == nil {
+		defer func() { v.release(resource, err) }()
+
+		if pending.overflow {
+			if err = resource.FlushAll(); err == nil {
+				return
+			}
+		} else {
+			for key := range pending.keys {
+				if _, err = resource.Delete(key); err != nil {
+					break
+				}
+				delete(pending.keys, key)
+			}
+			if err == nil {
+				return
+			}
+		}
+	}
+
+	log.Printf("vshard: server %s is back, but its missed deletes failed: %v", server, err)
+	if pending.overflow {
+		v.pendingLock.Lock()
+		v.pendingDeletes[server] = pending
+		v.pendingLock.Unlock()
+		return
+	}
+	for key := range pending.keys {
+		v.addPendingDelete(server, key)
+	}
+}
+
+func (v *Pool) deleteOn(pool *pools.ResourcePool, key string) (bool, error) {
+	resource, err := getConnection(pool)
+	if err != nil {
+		return false, err
+	}
+	defer func() { v.release(resource, err) }()
+
+	deleted, err := resource.Delete(key)
+
+	return deleted, err
+}
+
+// replicatedGets reads keys from their primary, falling back to the next
+// replica for the keys that missed or failed there
+func (v *Pool) replicatedGets(keys ...string) ([]cacheservice.Result, error) {
+	v.RLock()
+	serverPools := v.pool
+	replicas := make([][]int, len(keys))
+	for i, key := range keys {
+		replicas[i] = v.replicaSlots(key)
+	}
+	v.RUnlock()
+
+	hashedKeys := v.hashKeys(keys)
+
+	results := []cacheservice.Result{}
+	found := make(map[string]bool, len(keys))
+	var lastErr error
+
+	for round := 0; ; round++ {
+		mapping := make(map[int][]string)
+		for i, slots := range replicas {
+			if round < len(slots) && !found[hashedKeys[i]] {
+				mapping[slots[round]] = append(mapping[slots[round]], hashedKeys[i])
+			}
+		}
+		if len(mapping) == 0 {
+			break
+		}
+
+		for slot, keys := range mapping {
+			result, err := v.getsOn(serverPools[slot], keys...)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+
+			for _, item := range result {
+				if !found[item.Key] {
+					found[item.Key] = true
+					results = append(results, item)
+				}
+			}
+		}
+	}
+
+	if len(results) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+
+	return results, nil
+}
+
+func (v *Pool) getsOn(pool *pools.ResourcePool, keys ...string) ([]cacheservice.Result, error) {
+	resource, err := getConnection(pool)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { v.release(resource, err) }()
+
+	results, err := resource.Gets(keys...)
+
+	return results, err
+}
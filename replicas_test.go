@@ -0,0 +1,294 @@
+package vshard
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ReplicasTestSuite struct {
+	suite.Suite
+	Pool *Pool
+}
+
+func (suite *ReplicasTestSuite) SetupSuite() {
+	suite.Pool = &Pool{
+		Servers:     getTestServers(),
+		Capacity:    10,
+		MaxCapacity: 10,
+		IdleTimeout: time.Second * 5,
+		Replicas:    3,
+	}
+	suite.Pool.Start()
+}
+
+func (suite *ReplicasTestSuite) TearDownTest() {
+	tearDownPool(suite.T(), suite.Pool)
+}
+
+// stored returns the value of key on each of its replicas, "" when missing
+func (suite *ReplicasTestSuite) stored(pool *Pool, key string) []string {
+	pool.RLock()
+	slots := pool.replicaSlots(key)
+	pool.RUnlock()
+
+	values := []string{}
+	for _, slot := range slots {
+		resource, err := pool.GetPoolConnection(slot)
+		suite.Require().NoError(err)
+
+		results, err := resource.Get(pool.HashKeyStrategy(key))
+		pool.ReturnConnection(slot, resource)
+		suite.Require().NoError(err)
+
+		value := ""
+		if len(results) > 0 {
+			value = string(results[0].Value)
+		}
+		values = append(values, value)
+	}
+
+	return values
+}
+
+func (suite *ReplicasTestSuite) deleteFromPrimary(key string) {
+	suite.Pool.RLock()
+	primary := suite.Pool.replicaSlots(key)[0]
+	suite.Pool.RUnlock()
+
+	resource, err := suite.Pool.GetPoolConnection(primary)
+	suite.Require().NoError(err)
+	defer suite.Pool.ReturnConnection(primary, resource)
+
+	_, err = resource.Delete(suite.Pool.HashKeyStrategy(key))
+	suite.Require().NoError(err)
+}
+
+func (suite *ReplicasTestSuite) TestReplicaSlots() {
+	for _, key := range testKeys(100) {
+		suite.Pool.RLock()
+		slots := suite.Pool.replicaSlots(key)
+		primary := suite.Pool.locateSlot(key)
+		suite.Pool.RUnlock()
+
+		suite.Len(slots, 3)
+		suite.Equal(primary, slots[0])
+		suite.NotEqual(slots[0], slots[1])
+		suite.NotEqual(slots[1], slots[2])
+		suite.NotEqual(slots[0], slots[2])
+	}
+}
+
+func (suite *ReplicasTestSuite) TestSetWritesEveryReplica() {
+	stored, err := suite.Pool.Set("key", 0, 0, []byte("value"))
+	suite.NoError(err)
+	suite.True(stored)
+
+	suite.Equal([]string{"value", "value", "value"}, suite.stored(suite.Pool, "key"))
+
+	stored, err = suite.Pool.Append("key", 0, 0, []byte("-end"))
+	suite.NoError(err)
+	suite.True(stored)
+
+	suite.Equal([]string{"value-end", "value-end", "value-end"}, suite.stored(suite.Pool, "key"))
+}
+
+func (suite *ReplicasTestSuite) TestReadFallsBackOnMiss() {
+	_, err := suite.Pool.Set("key", 0, 0, []byte("value"))
+	suite.NoError(err)
+	suite.deleteFromPrimary("key")
+
+	value, err := suite.Pool.Get("key")
+	suite.NoError(err)
+	suite.Equal("value", string(value))
+
+	results, err := suite.Pool.Gets("key", "missing")
+	suite.NoError(err)
+	suite.Len(results, 1)
+	suite.Equal("value", string(results[0].Value))
+}
+
+func (suite *ReplicasTestSuite) TestDeleteReachesEveryReplica() {
+	_, err := suite.Pool.Set("key", 0, 0, []byte("value"))
+	suite.NoError(err)
+	suite.deleteFromPrimary("key")
+
+	deleted, err := suite.Pool.Delete("key")
+	suite.NoError(err)
+	suite.True(deleted)
+
+	suite.Equal([]string{"", "", ""}, suite.stored(suite.Pool, "key"))
+
+	_, err = suite.Pool.Get("key")
+	suite.Equal(ErrKeyNotFound, err)
+}
+
+func (suite *ReplicasTestSuite) TestConditionalWritesFollowPrimary() {
+	stored, err := suite.Pool.Add("key", 0, 0, []byte("first"))
+	suite.NoError(err)
+	suite.True(stored)
+
+	stored, err = suite.Pool.Add("key", 0, 0, []byte("second"))
+	suite.NoError(err)
+	suite.False(stored)
+
+	results, err := suite.Pool.Gets("key")
+	suite.NoError(err)
+	suite.Require().Len(results, 1)
+
+	stored, err = suite.Pool.Cas("key", 0, 0, []byte("third"), results[0].Cas)
+	suite.NoError(err)
+	suite.True(stored)
+
+	suite.Equal([]string{"third", "third", "third"}, suite.stored(suite.Pool, "key"))
+
+	// a primary that lost the key leaves the Cas to the replica read from
+	suite.deleteFromPrimary("key")
+	results, err = suite.Pool.Gets("key")
+	suite.NoError(err)
+	suite.Require().Len(results, 1)
+
+	stored, err = suite.Pool.Cas("key", 0, 0, []byte("fourth"), results[0].Cas)
+	suite.NoError(err)
+	suite.True(stored)
+	suite.Equal([]string{"fourth", "fourth", "fourth"}, suite.stored(suite.Pool, "key"))
+
+	stored, err = suite.Pool.Cas("key", 0, 0, []byte("fifth"), results[0].Cas)
+	suite.NoError(err)
+	suite.False(stored)
+
+	stored, err = suite.Pool.Add("key", 0, 0, []byte("fifth"))
+	suite.NoError(err)
+	suite.False(stored)
+}
+
+func (suite *ReplicasTestSuite) TestUpdateAfterPrimaryMiss() {
+	_, err := suite.Pool.addCounter("counter", 1, 0, 0)
+	suite.Require().NoError(err)
+	suite.deleteFromPrimary("counter")
+
+	value, err := suite.Pool.addCounter("counter", 1, 0, 0)
+	suite.NoError(err)
+	suite.Equal(uint64(2), value)
+	suite.Equal([]string{"2", "2", "2"}, suite.stored(suite.Pool, "counter"))
+}
+
+func (suite *ReplicasTestSuite) TestReadFallsBackOnError() {
+	proxy, err := newFlakyProxy(getTestServers()[9])
+	suite.Require().NoError(err)
+	defer proxy.Close()
+
+	pool := &Pool{
+		Servers:         []string{proxy.Addr(), getTestServers()[8]},
+		HashKeyStrategy: NoKeyStrategy,
+		Replicas:        2,
+	}
+	pool.Start()
+	defer pool.Close()
+
+	key := ""
+	for _, candidate := range testKeys(100) {
+		if pool.locateSlot(candidate) == 0 {
+			key = candidate
+			break
+		}
+	}
+
+	_, err = pool.Set(key, 0, 0, []byte("value"))
+	suite.NoError(err)
+
+	proxy.SetUp(false)
+
+	value, err := pool.Get(key)
+	suite.NoError(err)
+	suite.Equal("value", string(value))
+
+	deleted, err := pool.Delete(key)
+	suite.Error(err)
+	suite.True(deleted)
+}
+
+func (suite *ReplicasTestSuite) TestDeleteWhileReplicaDown() {
+	proxy, err := newFlakyProxy(getTestServers()[9])
+	suite.Require().NoError(err)
+	defer proxy.Close()
+
+	pool := &Pool{
+		Servers:         []string{getTestServers()[8], proxy.Addr()},
+		HashKeyStrategy: NoKeyStrategy,
+		Replicas:        2,
+		HealthCheck: &HealthCheck{
+			Interval:      time.Millisecond * 20,
+			FailureLimit:  1,
+			RetryInterval: time.Millisecond * 50,
+		},
+	}
+	pool.Start()
+	defer pool.Close()
+	defer tearDownPool(suite.T(), pool)
+
+	keys := testKeys(20)
+	for _, key := range keys {
+		_, err = pool.Set(key, 0, 0, []byte("value"))
+		suite.Require().NoError(err)
+	}
+
+	proxy.SetUp(false)
+	suite.Require().True(waitFor(func() bool { return pool.Status()[1].Down }))
+	for _, key := range keys {
+		_, err = pool.Delete(key)
+		suite.NoError(err)
+	}
+
+	proxy.SetUp(true)
+	suite.Require().True(waitFor(func() bool { return !pool.Status()[1].Down }))
+	for _, key := range keys {
+		_, err := pool.Get(key)
+		suite.Equal(ErrKeyNotFound, err, key)
+	}
+}
+
+func (suite *ReplicasTestSuite) TestPendingDeletesOverflow() {
+	pool := &Pool{}
+	for i := 0; i <= defaultMaxPendingDeletes; i++ {
+		pool.addPendingDelete("server", strconv.Itoa(i))
+	}
+	suite.True(pool.pendingDeletes["server"].overflow)
+	suite.Nil(pool.pendingDeletes["server"].keys)
+}
+
+func (suite *ReplicasTestSuite) TestLocateReplicas() {
+	servers := getTestServers()
+	weights := []int{1, 2, 3, 1, 2, 3, 1, 2, 3, 1}
+	locators := map[string]ServerLocator{
+		"weighted":   XXH64WeightedServerStrategy(servers, weights),
+		"rendezvous": RendezvousServerStrategy(servers, weights),
+		"ketama":     KetamaServerStrategy(servers, weights),
+		"maglev":     MaglevServerStrategy(servers, weights),
+	}
+
+	for name, locator := range locators {
+		replicaLocator, ok := locator.(ReplicaLocator)
+		suite.Require().True(ok, name)
+
+		for _, key := range testKeys(200) {
+			slots := replicaLocator.LocateReplicas(key, 4)
+			suite.Len(slots, 4, name)
+			suite.Equal(locator.Locate(key), slots[0], name)
+
+			seen := make(map[int]bool)
+			for _, slot := range slots {
+				suite.False(seen[slot], name)
+				seen[slot] = true
+			}
+		}
+
+		suite.Len(replicaLocator.LocateReplicas("key", 20), len(servers), name)
+	}
+}
+
+func TestReplicasTestSuite(t *testing.T) {
+	suite.Run(t, new(ReplicasTestSuite))
+}
@@ -0,0 +1,182 @@
+package vshard
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/youtube/vitess/go/memcache"
+)
+
+const (
+	defaultRetryMaxAttempts = 3
+	defaultRetryBackoff     = time.Millisecond * 5
+	defaultRetryMaxBackoff  = time.Millisecond * 50
+)
+
+// Command is a set of memcached commands a RetryPolicy applies to
+type Command uint16
+
+// Commands of a RetryPolicy
+const (
+	CommandGet Command = 1 << iota
+	CommandGets
+	CommandSet
+	CommandAdd
+	CommandReplace
+	CommandAppend
+	CommandPrepend
+	CommandCas
+	CommandDelete
+	// CommandUpdate is the writes of Pool.Update, which counters such as
+	// Mutex fencing tokens and RateLimiter windows increment through
+	CommandUpdate
+)
+
+// DefaultRetryCommands are the commands safe to run twice: reads, Set,
+// Replace and Delete. Add and Cas report a lost reply's write as refused
+// when retried, and Append, Prepend and Update writes would apply twice.
+const DefaultRetryCommands = CommandGet | CommandGets | CommandSet | CommandReplace | CommandDelete
+
+var retryCommands = map[string]Command{
+	"get":     CommandGet,
+	"gets":    CommandGets,
+	"set":     CommandSet,
+	"add":     CommandAdd,
+	"replace": CommandReplace,
+	"append":  CommandAppend,
+	"prepend": CommandPrepend,
+	"cas":     CommandCas,
+	"delete":  CommandDelete,
+	"update":  CommandUpdate,
+}
+
+// RetryPolicy retries commands failing with a transient error, such as a
+// connection dropped by the network, on a new connection. Without a
+// RetryPolicy, Pool runs every command once.
+type RetryPolicy struct {
+	// MaxAttempts is how many times a command runs at most, including the
+	// first attempt
+	MaxAttempts int
+	// Backoff is the wait before the first retry, doubling up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Retryable tells if a command failing with err is retried, by default
+	// for network and I/O failures such as timeouts, EOF and connection
+	// resets. Servers marked down by the
+	// health checker are never retried.
+	Retryable func(err error) bool
+	// Commands are the commands retried, DefaultRetryCommands when zero
+	Commands Command
+}
+
+// ioFailures are in the messages of the memcache.Errors raised when the
+// connection fails, as opposed to the server replying with an error
+var ioFailures = []string{
+	"EOF",
+	"i/o timeout",
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"use of closed network connection",
+}
+
+// transientError tells if err is a network or I/O failure, which may not
+// happen again on a new connection. Errors replied by the server, such as
+// SERVER_ERROR object too large, would.
+func transientError(err error) bool {
+	switch err := err.(type) {
+	case net.Error:
+		return true
+	case memcache.Error:
+		for _, failure := range ioFailures {
+			if strings.Contains(err.Message, failure) {
+				return true
+			}
+		}
+	}
+
+	return err == io.EOF
+}
+
+// retry runs fn for a command on key, again while it fails with a
+// retryable error and the policy has attempts left
+func (v *Pool) retry(command Command, key string, fn func() error) error {
+	policy := v.RetryPolicy
+	if policy == nil {
+		return fn()
+	}
+
+	commands := policy.Commands
+	if commands == 0 {
+		commands = DefaultRetryCommands
+	}
+	if commands&command == 0 {
+		return fn()
+	}
+
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = defaultRetryMaxAttempts
+	}
+	retryable := policy.Retryable
+	if retryable == nil {
+		retryable = transientError
+	}
+	backoff, maxBackoff := policy.Backoff, policy.MaxBackoff
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
+	}
+	if maxBackoff == 0 {
+		maxBackoff = defaultRetryMaxBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || err == ErrServerDown || attempt >= maxAttempts || !retryable(err) {
+			return err
+		}
+		v.recordRetry(key)
+
+		if backoff > 0 {
+			time.Sleep(jitteredBackoff(backoff))
+
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+}
+
+// jitteredBackoff returns a random wait between backoff/2 and backoff, both
+// included, so clients backing off together fall out of step
+func jitteredBackoff(backoff time.Duration) time.Duration {
+	half := backoff / 2
+
+	return half + time.Duration(rand.Int63n(int64(backoff-half)+1))
+}
+
+// recordRetry counts a retry for the server owning key
+func (v *Pool) recordRetry(key string) {
+	v.RLock()
+	server := v.Servers[v.locate(key)]
+	v.RUnlock()
+
+	v.retryLock.Lock()
+	if v.retries == nil {
+		v.retries = make(map[string]int64)
+	}
+	v.retries[server]++
+	v.retryLock.Unlock()
+}
+
+// retryCount returns how many commands for server were retried
+func (v *Pool) retryCount(server string) int64 {
+	v.retryLock.Lock()
+	defer v.retryLock.Unlock()
+
+	return v.retries[server]
+}
@@ -0,0 +1,219 @@
+package vshard
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/youtube/vitess/go/memcache"
+)
+
+type RetryTestSuite struct {
+	suite.Suite
+	Pool  *Pool
+	Proxy *flakyProxy
+}
+
+func (suite *RetryTestSuite) SetupTest() {
+	proxy, err := newFlakyProxy(getTestServers()[9])
+	suite.Require().NoError(err)
+	suite.Proxy = proxy
+
+	// a single connection, so the one dropped is the one used next
+	suite.Pool = &Pool{
+		Servers:     []string{proxy.Addr()},
+		Capacity:    1,
+		MaxCapacity: 1,
+		IdleTimeout: time.Second * 5,
+		RetryPolicy: &RetryPolicy{Backoff: time.Millisecond},
+	}
+	suite.Pool.Start()
+}
+
+func (suite *RetryTestSuite) TearDownTest() {
+	suite.Proxy.SetUp(true)
+	tearDownPool(suite.T(), suite.Pool)
+	suite.Pool.Close()
+	suite.Proxy.Close()
+}
+
+// dropConnections drops the connections to the proxy, as a network blip would
+func (suite *RetryTestSuite) dropConnections() {
+	suite.Proxy.SetUp(false)
+	suite.Proxy.SetUp(true)
+}
+
+func (suite *RetryTestSuite) TestRetriesDroppedConnection() {
+	_, err := suite.Pool.Set("key", 0, 0, []byte("value"))
+	suite.Require().NoError(err)
+
+	suite.dropConnections()
+	value, err := suite.Pool.Get("key")
+	suite.NoError(err)
+	suite.Equal("value", string(value))
+	suite.Equal(int64(1), suite.Pool.Status()[0].Retries)
+
+	suite.dropConnections()
+	results, err := suite.Pool.Gets("key")
+	suite.NoError(err)
+	suite.Len(results, 1)
+
+	suite.dropConnections()
+	_, err = suite.Pool.Set("key", 0, 0, []byte("other"))
+	suite.NoError(err)
+
+	suite.dropConnections()
+	deleted, err := suite.Pool.Delete("key")
+	suite.NoError(err)
+	suite.True(deleted)
+	suite.Equal(int64(4), suite.Pool.Status()[0].Retries)
+}
+
+func (suite *RetryTestSuite) TestWithoutPolicy() {
+	suite.Pool.RetryPolicy = nil
+	_, err := suite.Pool.Set("key", 0, 0, []byte("value"))
+	suite.Require().NoError(err)
+
+	suite.dropConnections()
+	_, err = suite.Pool.Get("key")
+	suite.Error(err)
+	suite.Equal(int64(0), suite.Pool.Status()[0].Retries)
+}
+
+func (suite *RetryTestSuite) TestNonIdempotentCommands() {
+	_, err := suite.Pool.Set("key", 0, 0, []byte("value"))
+	suite.Require().NoError(err)
+
+	suite.dropConnections()
+	_, err = suite.Pool.Append("key", 0, 0, []byte("-appended"))
+	suite.Error(err)
+
+	// the broken connection was closed, open a new one to drop
+	_, err = suite.Pool.Get("key")
+	suite.Require().NoError(err)
+	suite.dropConnections()
+	_, err = suite.Pool.Prepend("key", 0, 0, []byte("prepended-"))
+	suite.Error(err)
+
+	_, err = suite.Pool.addCounter("counter", 1, 0, 0)
+	suite.Require().NoError(err)
+	suite.dropConnections()
+	_, err = suite.Pool.Update(context.Background(), "counter", 0, func(old []byte, exists bool) ([]byte, error) {
+		// the read is retried, only the write fails
+		suite.dropConnections()
+		return []byte("2"), nil
+	})
+	suite.Error(err)
+
+	suite.Equal(int64(1), suite.Pool.Status()[0].Retries)
+
+	value, err := suite.Pool.Get("key")
+	suite.NoError(err)
+	suite.Equal("value", string(value))
+}
+
+func (suite *RetryTestSuite) TestCommands() {
+	suite.Pool.RetryPolicy.Commands = CommandAppend
+	_, err := suite.Pool.Set("key", 0, 0, []byte("value"))
+	suite.Require().NoError(err)
+
+	suite.dropConnections()
+	_, err = suite.Pool.Append("key", 0, 0, []byte("-appended"))
+	suite.NoError(err)
+
+	suite.dropConnections()
+	_, err = suite.Pool.Get("key")
+	suite.Error(err)
+	suite.Equal(int64(1), suite.Pool.Status()[0].Retries)
+}
+
+func (suite *RetryTestSuite) TestMaxAttempts() {
+	attempts := 0
+	suite.Pool.RetryPolicy.MaxAttempts = 4
+	suite.Pool.RetryPolicy.Retryable = func(err error) bool {
+		attempts++
+		return transientError(err)
+	}
+
+	suite.Proxy.SetUp(false)
+	_, err := suite.Pool.Get("key")
+	suite.Error(err)
+	suite.Equal(3, attempts)
+	suite.Equal(int64(3), suite.Pool.Status()[0].Retries)
+
+	suite.Proxy.SetUp(true)
+	suite.Pool.RetryPolicy.Retryable = func(err error) bool { return false }
+	suite.dropConnections()
+	_, err = suite.Pool.Get("key")
+	suite.Error(err)
+	suite.Equal(int64(3), suite.Pool.Status()[0].Retries)
+}
+
+func (suite *RetryTestSuite) TestBackoff() {
+	suite.Pool.RetryPolicy = &RetryPolicy{MaxAttempts: 4, Backoff: time.Millisecond * 20, MaxBackoff: time.Millisecond * 40}
+	suite.Proxy.SetUp(false)
+
+	// waits of [10ms, 20ms], [20ms, 40ms] and [20ms, 40ms]
+	started := time.Now()
+	_, err := suite.Pool.Get("key")
+	suite.Error(err)
+	elapsed := time.Since(started)
+	suite.True(elapsed >= time.Millisecond*50, elapsed.String())
+	suite.True(elapsed < time.Millisecond*500, elapsed.String())
+}
+
+func (suite *RetryTestSuite) TestTransientErrors() {
+	for _, err := range []error{
+		io.EOF,
+		memcache.NewError("%s", io.EOF),
+		memcache.NewError("Prefix: false, %s", io.ErrUnexpectedEOF),
+		memcache.NewError("read tcp 127.0.0.1:50000->127.0.0.1:21210: i/o timeout"),
+		memcache.NewError("write tcp 127.0.0.1:50000->127.0.0.1:21210: write: broken pipe"),
+		memcache.NewError("read tcp 127.0.0.1:50000->127.0.0.1:21210: read: connection reset by peer"),
+		&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+	} {
+		suite.True(transientError(err), err.Error())
+	}
+
+	for _, err := range []error{
+		memcache.NewError("Server error"),
+		memcache.NewError("SERVER_ERROR object too large for cache"),
+		memcache.NewError("Malformed response: %s", "VALUE"),
+		ErrKeyNotFound,
+		ErrServerDown,
+	} {
+		suite.False(transientError(err), err.Error())
+	}
+}
+
+func (suite *RetryTestSuite) TestServerErrorsNotRetried() {
+	attempts := 0
+	suite.Pool.RetryPolicy.Retryable = func(err error) bool {
+		attempts++
+		return transientError(err)
+	}
+
+	err := suite.Pool.retry(CommandSet, "key", func() error {
+		return memcache.NewError("Server error")
+	})
+	suite.Error(err)
+	suite.Equal(1, attempts)
+	suite.Equal(int64(0), suite.Pool.Status()[0].Retries)
+}
+
+func (suite *RetryTestSuite) TestJitteredBackoff() {
+	for _, backoff := range []time.Duration{0, 1, 3, time.Millisecond * 20} {
+		for i := 0; i < 100; i++ {
+			wait := jitteredBackoff(backoff)
+			suite.True(wait >= backoff/2 && wait <= backoff, "backoff %s waited %s", backoff, wait)
+		}
+	}
+}
+
+func TestRetryTestSuite(t *testing.T) {
+	suite.Run(t, new(RetryTestSuite))
+}
@@ -0,0 +1,246 @@
+package vshard
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/youtube/vitess/go/cacheservice"
+)
+
+// ErrNoRoute defines the error when no route matches a key and there's no Default
+var ErrNoRoute = errors.New("error: no route for key")
+
+// Router sends each key to the cache its route points at, with the same
+// commands as Pool. Prefix routes are checked first, the longest matching
+// prefix wins, then regexp routes in the order they were added, and keys
+// matching nothing go to Default.
+type Router struct {
+	Default  Cache
+	prefixes []prefixRoute
+	patterns []patternRoute
+	sync.RWMutex
+}
+
+type prefixRoute struct {
+	prefix string
+	cache  Cache
+}
+
+type patternRoute struct {
+	pattern *regexp.Regexp
+	cache   Cache
+}
+
+// AddPrefix routes keys starting with prefix to cache, replacing any
+// previous route for the same prefix
+func (r *Router) AddPrefix(prefix string, cache Cache) {
+	r.Lock()
+	defer r.Unlock()
+
+	for i := range r.prefixes {
+		if r.prefixes[i].prefix == prefix {
+			r.prefixes[i].cache = cache
+			return
+		}
+	}
+
+	r.prefixes = append(r.prefixes, prefixRoute{prefix, cache})
+	sort.SliceStable(r.prefixes, func(i, j int) bool {
+		return len(r.prefixes[i].prefix) > len(r.prefixes[j].prefix)
+	})
+}
+
+// AddRegexp routes keys matching expr to cache
+func (r *Router) AddRegexp(expr string, cache Cache) error {
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	r.patterns = append(r.patterns, patternRoute{pattern, cache})
+	r.Unlock()
+
+	return nil
+}
+
+// Lookup returns the cache key is routed to
+func (r *Router) Lookup(key string) (Cache, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	for _, route := range r.prefixes {
+		if strings.HasPrefix(key, route.prefix) {
+			return route.cache, nil
+		}
+	}
+
+	for _, route := range r.patterns {
+		if route.pattern.MatchString(key) {
+			return route.cache, nil
+		}
+	}
+
+	if r.Default == nil {
+		return nil, ErrNoRoute
+	}
+
+	return r.Default, nil
+}
+
+// caches returns every cache routed to, once each
+func (r *Router) caches() []Cache {
+	r.RLock()
+	defer r.RUnlock()
+
+	caches := []Cache{}
+	seen := make(map[Cache]bool)
+	add := func(cache Cache) {
+		if cache != nil && !seen[cache] {
+			seen[cache] = true
+			caches = append(caches, cache)
+		}
+	}
+
+	for _, route := range r.prefixes {
+		add(route.cache)
+	}
+	for _, route := range r.patterns {
+		add(route.cache)
+	}
+	add(r.Default)
+
+	return caches
+}
+
+// Get returns a key from the cache it's routed to
+func (r *Router) Get(key string) ([]byte, error) {
+	cache, err := r.Lookup(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cache.Get(key)
+}
+
+// Gets returns cached data for keys, one Gets per cache they're routed to
+func (r *Router) Gets(keys ...string) ([]cacheservice.Result, error) {
+	caches := []Cache{}
+	mapping := make(map[Cache][]string)
+
+	for _, key := range keys {
+		cache, err := r.Lookup(key)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := mapping[cache]; !ok {
+			caches = append(caches, cache)
+		}
+		mapping[cache] = append(mapping[cache], key)
+	}
+
+	results := []cacheservice.Result{}
+	for _, cache := range caches {
+		result, err := cache.Gets(mapping[cache]...)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result...)
+	}
+
+	return results, nil
+}
+
+// Set set the value with specified cache key.
+func (r *Router) Set(key string, flags uint16, timeout uint64, value []byte) (bool, error) {
+	cache, err := r.Lookup(key)
+	if err != nil {
+		return false, err
+	}
+
+	return cache.Set(key, flags, timeout, value)
+}
+
+// Add store the value only if it does not already exist.
+func (r *Router) Add(key string, flags uint16, timeout uint64, value []byte) (bool, error) {
+	cache, err := r.Lookup(key)
+	if err != nil {
+		return false, err
+	}
+
+	return cache.Add(key, flags, timeout, value)
+}
+
+// Replace replaces the value, only if the value already exists,
+// for the specified cache key.
+func (r *Router) Replace(key string, flags uint16, timeout uint64, value []byte) (bool, error) {
+	cache, err := r.Lookup(key)
+	if err != nil {
+		return false, err
+	}
+
+	return cache.Replace(key, flags, timeout, value)
+}
+
+// Append appends the value after the last bytes in an existing item.
+func (r *Router) Append(key string, flags uint16, timeout uint64, value []byte) (bool, error) {
+	cache, err := r.Lookup(key)
+	if err != nil {
+		return false, err
+	}
+
+	return cache.Append(key, flags, timeout, value)
+}
+
+// Prepend prepends the value before existing value.
+func (r *Router) Prepend(key string, flags uint16, timeout uint64, value []byte) (bool, error) {
+	cache, err := r.Lookup(key)
+	if err != nil {
+		return false, err
+	}
+
+	return cache.Prepend(key, flags, timeout, value)
+}
+
+// Cas stores the value only if no one else has updated the data since you read it last.
+func (r *Router) Cas(key string, flags uint16, timeout uint64, value []byte, cas uint64) (bool, error) {
+	cache, err := r.Lookup(key)
+	if err != nil {
+		return false, err
+	}
+
+	return cache.Cas(key, flags, timeout, value, cas)
+}
+
+// Delete delete the value for the specified cache key.
+func (r *Router) Delete(key string) (bool, error) {
+	cache, err := r.Lookup(key)
+	if err != nil {
+		return false, err
+	}
+
+	return cache.Delete(key)
+}
+
+// FlushAll purges the entire cache on every cache routed to
+func (r *Router) FlushAll() []error {
+	errs := []error{}
+	for _, cache := range r.caches() {
+		errs = append(errs, cache.FlushAll()...)
+	}
+
+	return errs
+}
+
+// HashKey returns the name key is stored under in the cache it's routed to
+func (r *Router) HashKey(key string) string {
+	cache, err := r.Lookup(key)
+	if err != nil {
+		return key
+	}
+
+	return cache.HashKey(key)
+}
@@ -0,0 +1,138 @@
+package vshard
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RouterTestSuite struct {
+	suite.Suite
+	Sessions  *Pool
+	Fragments *Pool
+	Default   *Pool
+	Router    *Router
+}
+
+func (suite *RouterTestSuite) SetupSuite() {
+	suite.Sessions = &Pool{Servers: getTestServers()[:2], IdleTimeout: time.Second * 5}
+	suite.Sessions.Start()
+	suite.Fragments = &Pool{Servers: getTestServers()[2:6], IdleTimeout: time.Second * 5}
+	suite.Fragments.Start()
+	suite.Default = &Pool{Servers: getTestServers()[6:], IdleTimeout: time.Second * 5}
+	suite.Default.Start()
+}
+
+func (suite *RouterTestSuite) SetupTest() {
+	suite.Router = &Router{Default: suite.Default}
+	suite.Router.AddPrefix("session:", suite.Sessions)
+	suite.Router.AddPrefix("session:admin:", suite.Fragments)
+	suite.Require().NoError(suite.Router.AddRegexp(`^frag:\d+$`, suite.Fragments))
+}
+
+func (suite *RouterTestSuite) TearDownTest() {
+	for _, err := range suite.Router.FlushAll() {
+		suite.NoError(err)
+	}
+}
+
+func (suite *RouterTestSuite) TestLookup() {
+	routes := map[string]Cache{
+		"session:1":       suite.Sessions,
+		"session:admin:1": suite.Fragments,
+		"frag:42":         suite.Fragments,
+		"frag:x":          suite.Default,
+		"other":           suite.Default,
+		"":                suite.Default,
+	}
+
+	for key, expected := range routes {
+		cache, err := suite.Router.Lookup(key)
+		suite.NoError(err)
+		suite.True(expected == cache, key)
+	}
+}
+
+func (suite *RouterTestSuite) TestReplacePrefix() {
+	suite.Router.AddPrefix("session:", suite.Default)
+
+	cache, err := suite.Router.Lookup("session:1")
+	suite.NoError(err)
+	suite.True(suite.Default == cache)
+	suite.Len(suite.Router.prefixes, 2)
+}
+
+func (suite *RouterTestSuite) TestNoRoute() {
+	router := &Router{}
+	router.AddPrefix("session:", suite.Sessions)
+
+	_, err := router.Get("other")
+	suite.Equal(ErrNoRoute, err)
+	_, err = router.Set("other", 0, 0, []byte("value"))
+	suite.Equal(ErrNoRoute, err)
+
+	suite.Error(router.AddRegexp("(", suite.Sessions))
+}
+
+func (suite *RouterTestSuite) TestCommands() {
+	stored, err := suite.Router.Set("session:1", 0, 0, []byte("session"))
+	suite.NoError(err)
+	suite.True(stored)
+
+	value, err := suite.Sessions.Get("session:1")
+	suite.NoError(err)
+	suite.Equal("session", string(value))
+
+	_, err = suite.Default.Get("session:1")
+	suite.Equal(ErrKeyNotFound, err)
+
+	stored, err = suite.Router.Add("frag:1", 0, 0, []byte("fragment"))
+	suite.NoError(err)
+	suite.True(stored)
+
+	stored, err = suite.Router.Append("frag:1", 0, 0, []byte("-end"))
+	suite.NoError(err)
+	suite.True(stored)
+
+	value, err = suite.Router.Get("frag:1")
+	suite.NoError(err)
+	suite.Equal("fragment-end", string(value))
+
+	deleted, err := suite.Router.Delete("frag:1")
+	suite.NoError(err)
+	suite.True(deleted)
+
+	_, err = suite.Fragments.Get("frag:1")
+	suite.Equal(ErrKeyNotFound, err)
+}
+
+func (suite *RouterTestSuite) TestGets() {
+	keys := []string{"session:1", "frag:1", "other", "session:2"}
+	for _, key := range keys {
+		_, err := suite.Router.Set(key, 0, 0, []byte(key))
+		suite.NoError(err)
+	}
+
+	results, err := suite.Router.Gets(append(keys, "missing")...)
+	suite.NoError(err)
+	suite.Len(results, 4)
+
+	values := map[string]string{}
+	cas := map[string]uint64{}
+	for _, result := range results {
+		values[result.Key] = string(result.Value)
+		cas[result.Key] = result.Cas
+	}
+	for _, key := range keys {
+		suite.Equal(key, values[suite.Router.HashKey(key)])
+	}
+
+	stored, err := suite.Router.Cas("other", 0, 0, []byte("updated"), cas[suite.Router.HashKey("other")])
+	suite.NoError(err)
+	suite.True(stored)
+}
+
+func TestRouterTestSuite(t *testing.T) {
+	suite.Run(t, new(RouterTestSuite))
+}
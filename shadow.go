@@ -0,0 +1,353 @@
+package vshard
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/youtube/vitess/go/cacheservice"
+)
+
+const defaultMaxPending = 100
+
+// ShadowCache mirrors a sample of the commands sent to Primary to Shadow,
+// a candidate cluster or hash strategy, and reports how both compare.
+// Callers only ever get Primary's replies: the mirrored commands run in the
+// background, and are dropped when MaxPending of them are still running,
+// except FlushAll which always reaches the shadow. A mirrored command
+// panicking is recovered and counted, so a broken shadow can't take the
+// process down.
+//
+// Keys are sampled by hash, Percent of them (0 to 100) being mirrored with
+// all their commands, so the shadow sees the same traffic as the primary
+// for those keys and hit rates are comparable. Cas is mirrored as a Set of
+// the stored value, CAS identifiers being valid on their own cluster only.
+type ShadowCache struct {
+	Primary    Cache
+	Shadow     Cache
+	Percent    float64
+	MaxPending int
+	// OnMismatch is called with the values of a sampled key found by both
+	// caches that differ
+	OnMismatch func(key string, primary, shadow []byte)
+
+	once          sync.Once
+	pending       chan struct{}
+	async         sync.WaitGroup
+	mirrored      int64
+	dropped       int64
+	reads         int64
+	primaryHits   int64
+	shadowHits    int64
+	mismatches    int64
+	primaryErrors int64
+	shadowErrors  int64
+	panics        int64
+	primaryTime   int64
+	shadowTime    int64
+}
+
+// ShadowReport compares the primary and the shadow over the mirrored
+// commands. Reads count the sampled keys read, and latencies are the mean
+// of each cache over the mirrored commands.
+type ShadowReport struct {
+	Mirrored       int64
+	Dropped        int64
+	Reads          int64
+	PrimaryHits    int64
+	ShadowHits     int64
+	Mismatches     int64
+	PrimaryErrors  int64
+	ShadowErrors   int64
+	Panics         int64
+	PrimaryLatency time.Duration
+	ShadowLatency  time.Duration
+}
+
+// PrimaryHitRate returns the share of sampled keys read found by the primary
+func (r ShadowReport) PrimaryHitRate() float64 {
+	return rate(r.PrimaryHits, r.Reads)
+}
+
+// ShadowHitRate returns the share of sampled keys read found by the shadow
+func (r ShadowReport) ShadowHitRate() float64 {
+	return rate(r.ShadowHits, r.Reads)
+}
+
+func rate(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+
+	return float64(n) / float64(total)
+}
+
+// Report returns how the shadow compares to the primary so far
+func (s *ShadowCache) Report() ShadowReport {
+	report := ShadowReport{
+		Mirrored:      atomic.LoadInt64(&s.mirrored),
+		Dropped:       atomic.LoadInt64(&s.dropped),
+		Reads:         atomic.LoadInt64(&s.reads),
+		PrimaryHits:   atomic.LoadInt64(&s.primaryHits),
+		ShadowHits:    atomic.LoadInt64(&s.shadowHits),
+		Mismatches:    atomic.LoadInt64(&s.mismatches),
+		PrimaryErrors: atomic.LoadInt64(&s.primaryErrors),
+		ShadowErrors:  atomic.LoadInt64(&s.shadowErrors),
+		Panics:        atomic.LoadInt64(&s.panics),
+	}
+	if report.Mirrored > 0 {
+		report.PrimaryLatency = time.Duration(atomic.LoadInt64(&s.primaryTime) / report.Mirrored)
+		report.ShadowLatency = time.Duration(atomic.LoadInt64(&s.shadowTime) / report.Mirrored)
+	}
+
+	return report
+}
+
+// Wait blocks until the mirrored commands running are done
+func (s *ShadowCache) Wait() {
+	s.async.Wait()
+}
+
+// sampled tells if the commands on key are mirrored
+func (s *ShadowCache) sampled(key string) bool {
+	return float64(xxh64Hash(key)%10000) < s.Percent*100
+}
+
+// mirror runs command on the shadow in the background, unless too many
+// mirrored commands are running already. elapsed is the primary's latency
+// for the same command.
+func (s *ShadowCache) mirror(elapsed time.Duration, primaryErr error, command func() error) {
+	s.once.Do(func() {
+		maxPending := s.MaxPending
+		if maxPending == 0 {
+			maxPending = defaultMaxPending
+		}
+		s.pending = make(chan struct{}, maxPending)
+	})
+
+	select {
+	case s.pending <- struct{}{}:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+		return
+	}
+
+	s.run(elapsed, primaryErr, func() error {
+		defer func() { <-s.pending }()
+		return command()
+	})
+}
+
+// run runs a mirrored command on the shadow in the background, recovering
+// from its panics
+func (s *ShadowCache) run(elapsed time.Duration, primaryErr error, command func() error) {
+	atomic.AddInt64(&s.mirrored, 1)
+	atomic.AddInt64(&s.primaryTime, int64(elapsed))
+	if failed(primaryErr) {
+		atomic.AddInt64(&s.primaryErrors, 1)
+	}
+
+	s.async.Add(1)
+	go func() {
+		defer s.async.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				atomic.AddInt64(&s.panics, 1)
+				log.Printf("vshard: mirrored command panicked: %v", r)
+			}
+		}()
+
+		start := time.Now()
+		err := command()
+		atomic.AddInt64(&s.shadowTime, int64(time.Since(start)))
+		if failed(err) {
+			atomic.AddInt64(&s.shadowErrors, 1)
+		}
+	}()
+}
+
+// failed tells if err is an error rather than a miss
+func failed(err error) bool {
+	return err != nil && err != ErrKeyNotFound
+}
+
+// compare records the values found for a sampled key by both caches
+func (s *ShadowCache) compare(key string, primary, shadow []byte, primaryHit, shadowHit bool) {
+	atomic.AddInt64(&s.reads, 1)
+	if primaryHit {
+		atomic.AddInt64(&s.primaryHits, 1)
+	}
+	if shadowHit {
+		atomic.AddInt64(&s.shadowHits, 1)
+	}
+
+	if primaryHit && shadowHit && !bytes.Equal(primary, shadow) {
+		atomic.AddInt64(&s.mismatches, 1)
+		if s.OnMismatch != nil {
+			s.OnMismatch(key, primary, shadow)
+		}
+	}
+}
+
+// Get returns a key from the primary, mirroring the read when key is sampled
+func (s *ShadowCache) Get(key string) ([]byte, error) {
+	start := time.Now()
+	value, err := s.Primary.Get(key)
+	if !s.sampled(key) {
+		return value, err
+	}
+
+	primary := append([]byte{}, value...)
+	s.mirror(time.Since(start), err, func() error {
+		shadow, shadowErr := s.Shadow.Get(key)
+		if !failed(err) && !failed(shadowErr) {
+			s.compare(key, primary, shadow, err == nil, shadowErr == nil)
+		}
+
+		return shadowErr
+	})
+
+	return value, err
+}
+
+// Gets returns cached data for keys from the primary, mirroring the read of
+// the sampled keys
+func (s *ShadowCache) Gets(keys ...string) ([]cacheservice.Result, error) {
+	start := time.Now()
+	results, err := s.Primary.Gets(keys...)
+
+	sampled := []string{}
+	for _, key := range keys {
+		if s.sampled(key) {
+			sampled = append(sampled, key)
+		}
+	}
+	if len(sampled) == 0 {
+		return results, err
+	}
+
+	primary := make(map[string][]byte, len(results))
+	for _, result := range results {
+		primary[result.Key] = append([]byte{}, result.Value...)
+	}
+
+	s.mirror(time.Since(start), err, func() error {
+		reply, shadowErr := s.Shadow.Gets(sampled...)
+		if err != nil || shadowErr != nil {
+			return shadowErr
+		}
+
+		shadow := make(map[string][]byte, len(reply))
+		for _, result := range reply {
+			shadow[result.Key] = result.Value
+		}
+		for _, key := range sampled {
+			primaryValue, primaryHit := primary[s.Primary.HashKey(key)]
+			shadowValue, shadowHit := shadow[s.Shadow.HashKey(key)]
+			s.compare(key, primaryValue, shadowValue, primaryHit, shadowHit)
+		}
+
+		return nil
+	})
+
+	return results, err
+}
+
+// write runs a storage command on the primary, mirroring it when key is sampled
+func (s *ShadowCache) write(key string, command func(cache Cache) (bool, error)) (bool, error) {
+	start := time.Now()
+	ok, err := command(s.Primary)
+	if s.sampled(key) {
+		s.mirror(time.Since(start), err, func() error {
+			_, err := command(s.Shadow)
+			return err
+		})
+	}
+
+	return ok, err
+}
+
+// Set set the value with specified cache key.
+func (s *ShadowCache) Set(key string, flags uint16, timeout uint64, value []byte) (bool, error) {
+	return s.write(key, func(cache Cache) (bool, error) {
+		return cache.Set(key, flags, timeout, value)
+	})
+}
+
+// Add store the value only if it does not already exist.
+func (s *ShadowCache) Add(key string, flags uint16, timeout uint64, value []byte) (bool, error) {
+	return s.write(key, func(cache Cache) (bool, error) {
+		return cache.Add(key, flags, timeout, value)
+	})
+}
+
+// Replace replaces the value, only if the value already exists,
+// for the specified cache key.
+func (s *ShadowCache) Replace(key string, flags uint16, timeout uint64, value []byte) (bool, error) {
+	return s.write(key, func(cache Cache) (bool, error) {
+		return cache.Replace(key, flags, timeout, value)
+	})
+}
+
+// Append appends the value after the last bytes in an existing item.
+func (s *ShadowCache) Append(key string, flags uint16, timeout uint64, value []byte) (bool, error) {
+	return s.write(key, func(cache Cache) (bool, error) {
+		return cache.Append(key, flags, timeout, value)
+	})
+}
+
+// Prepend prepends the value before existing value.
+func (s *ShadowCache) Prepend(key string, flags uint16, timeout uint64, value []byte) (bool, error) {
+	return s.write(key, func(cache Cache) (bool, error) {
+		return cache.Prepend(key, flags, timeout, value)
+	})
+}
+
+// Cas stores the value only if no one else has updated the data since you
+// read it last. The shadow gets a Set when the primary stored the value.
+func (s *ShadowCache) Cas(key string, flags uint16, timeout uint64, value []byte, cas uint64) (bool, error) {
+	start := time.Now()
+	stored, err := s.Primary.Cas(key, flags, timeout, value, cas)
+	if stored && s.sampled(key) {
+		s.mirror(time.Since(start), err, func() error {
+			_, err := s.Shadow.Set(key, flags, timeout, value)
+			return err
+		})
+	}
+
+	return stored, err
+}
+
+// Delete delete the value for the specified cache key.
+func (s *ShadowCache) Delete(key string) (bool, error) {
+	return s.write(key, func(cache Cache) (bool, error) {
+		return cache.Delete(key)
+	})
+}
+
+// FlushAll purges the entire primary cache, and the shadow in the background
+func (s *ShadowCache) FlushAll() []error {
+	start := time.Now()
+	errs := s.Primary.FlushAll()
+
+	var primaryErr error
+	if len(errs) > 0 {
+		primaryErr = errs[0]
+	}
+	// a dropped flush would leave the shadow stale for good
+	s.run(time.Since(start), primaryErr, func() error {
+		if errs := s.Shadow.FlushAll(); len(errs) > 0 {
+			return errs[0]
+		}
+		return nil
+	})
+
+	return errs
+}
+
+// HashKey returns the name key is stored under in the primary
+func (s *ShadowCache) HashKey(key string) string {
+	return s.Primary.HashKey(key)
+}
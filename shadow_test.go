@@ -0,0 +1,216 @@
+package vshard
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ShadowTestSuite struct {
+	suite.Suite
+	Primary *Pool
+	Shadow  *Pool
+}
+
+func (suite *ShadowTestSuite) SetupSuite() {
+	suite.Primary = &Pool{Servers: getTestServers()[:3], IdleTimeout: time.Second * 5}
+	suite.Primary.Start()
+	suite.Shadow = &Pool{
+		Servers:          getTestServers()[3:7],
+		IdleTimeout:      time.Second * 5,
+		HashKeyStrategy:  NoKeyStrategy,
+		TopologyStrategy: KetamaServerStrategy,
+	}
+	suite.Shadow.Start()
+}
+
+func (suite *ShadowTestSuite) TearDownTest() {
+	tearDownPool(suite.T(), suite.Primary)
+	tearDownPool(suite.T(), suite.Shadow)
+}
+
+// blockingCache is a shadow whose reads wait for release
+type blockingCache struct {
+	Cache
+	release chan struct{}
+	flushed int32
+}
+
+func (c *blockingCache) Get(key string) ([]byte, error) {
+	<-c.release
+	return nil, ErrKeyNotFound
+}
+
+func (c *blockingCache) FlushAll() []error {
+	atomic.AddInt32(&c.flushed, 1)
+	return nil
+}
+
+// panickingCache is a shadow failing in the worst way
+type panickingCache struct {
+	Cache
+}
+
+func (c *panickingCache) Get(key string) ([]byte, error) {
+	panic("shadow is broken")
+}
+
+func (suite *ShadowTestSuite) TestMirrorsCommands() {
+	shadow := &ShadowCache{Primary: suite.Primary, Shadow: suite.Shadow, Percent: 100}
+
+	stored, err := shadow.Set("key", 0, 0, []byte("value"))
+	suite.NoError(err)
+	suite.True(stored)
+	shadow.Wait()
+
+	value, err := suite.Shadow.Get("key")
+	suite.NoError(err)
+	suite.Equal("value", string(value))
+
+	results, err := shadow.Gets("key")
+	suite.NoError(err)
+	suite.Len(results, 1)
+	// the mirrored read must not see the mirrored Cas below
+	shadow.Wait()
+
+	stored, err = shadow.Cas("key", 0, 0, []byte("cas"), results[0].Cas)
+	suite.NoError(err)
+	suite.True(stored)
+	shadow.Wait()
+
+	value, err = suite.Shadow.Get("key")
+	suite.NoError(err)
+	suite.Equal("cas", string(value))
+
+	deleted, err := shadow.Delete("key")
+	suite.NoError(err)
+	suite.True(deleted)
+	shadow.Wait()
+
+	_, err = suite.Shadow.Get("key")
+	suite.Equal(ErrKeyNotFound, err)
+
+	report := shadow.Report()
+	suite.Equal(int64(4), report.Mirrored)
+	suite.Equal(int64(1), report.Reads)
+	suite.Equal(int64(0), report.Mismatches)
+	suite.True(report.ShadowLatency > 0)
+}
+
+func (suite *ShadowTestSuite) TestReport() {
+	var lock sync.Mutex
+	mismatched := map[string]string{}
+	shadow := &ShadowCache{
+		Primary: suite.Primary,
+		Shadow:  suite.Shadow,
+		Percent: 100,
+		OnMismatch: func(key string, primary, shadow []byte) {
+			lock.Lock()
+			mismatched[key] = string(primary) + "/" + string(shadow)
+			lock.Unlock()
+		},
+	}
+
+	for _, key := range []string{"same", "different", "primary"} {
+		_, err := suite.Primary.Set(key, 0, 0, []byte("value"))
+		suite.NoError(err)
+	}
+	for _, key := range []string{"same", "different"} {
+		_, err := suite.Shadow.Set(key, 0, 0, []byte(key))
+		suite.NoError(err)
+	}
+	_, err := suite.Shadow.Set("same", 0, 0, []byte("value"))
+	suite.NoError(err)
+
+	value, err := shadow.Get("different")
+	suite.NoError(err)
+	suite.Equal("value", string(value))
+
+	results, err := shadow.Gets("same", "primary", "missing")
+	suite.NoError(err)
+	suite.Len(results, 2)
+	shadow.Wait()
+
+	report := shadow.Report()
+	suite.Equal(int64(4), report.Reads)
+	suite.Equal(int64(3), report.PrimaryHits)
+	suite.Equal(int64(2), report.ShadowHits)
+	suite.Equal(int64(1), report.Mismatches)
+	suite.Equal(0.75, report.PrimaryHitRate())
+	suite.Equal(0.5, report.ShadowHitRate())
+	suite.Equal(map[string]string{"different": "value/different"}, mismatched)
+}
+
+func (suite *ShadowTestSuite) TestSampling() {
+	shadow := &ShadowCache{Primary: suite.Primary, Shadow: suite.Shadow}
+	_, err := shadow.Set("key", 0, 0, []byte("value"))
+	suite.NoError(err)
+	shadow.Wait()
+	suite.Equal(int64(0), shadow.Report().Mirrored)
+
+	shadow.Percent = 25
+	sampled := 0
+	for _, key := range testKeys(10000) {
+		if shadow.sampled(key) {
+			sampled++
+		}
+	}
+	suite.InDelta(2500, sampled, 250)
+}
+
+func (suite *ShadowTestSuite) TestNeverBlocksCaller() {
+	blocking := &blockingCache{release: make(chan struct{})}
+	shadow := &ShadowCache{Primary: suite.Primary, Shadow: blocking, Percent: 100, MaxPending: 2}
+
+	_, err := suite.Primary.Set("key", 0, 0, []byte("value"))
+	suite.NoError(err)
+
+	for i := 0; i < 5; i++ {
+		value, err := shadow.Get("key")
+		suite.NoError(err)
+		suite.Equal("value", string(value))
+	}
+
+	// flushes are never dropped
+	suite.Empty(shadow.FlushAll())
+
+	close(blocking.release)
+	shadow.Wait()
+
+	report := shadow.Report()
+	suite.Equal(int64(3), report.Mirrored)
+	suite.Equal(int64(3), report.Dropped)
+	suite.Equal(int32(1), atomic.LoadInt32(&blocking.flushed))
+}
+
+func (suite *ShadowTestSuite) TestRecoversPanics() {
+	shadow := &ShadowCache{Primary: suite.Primary, Shadow: &panickingCache{}, Percent: 100}
+
+	_, err := suite.Primary.Set("key", 0, 0, []byte("value"))
+	suite.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		value, err := shadow.Get("key")
+		suite.NoError(err)
+		suite.Equal("value", string(value))
+	}
+	shadow.Wait()
+
+	report := shadow.Report()
+	suite.Equal(int64(3), report.Mirrored)
+	suite.Equal(int64(3), report.Panics)
+
+	// the pending slots were given back
+	value, err := shadow.Get("key")
+	suite.NoError(err)
+	suite.Equal("value", string(value))
+	shadow.Wait()
+	suite.Equal(int64(0), shadow.Report().Dropped)
+}
+
+func TestShadowTestSuite(t *testing.T) {
+	suite.Run(t, new(ShadowTestSuite))
+}
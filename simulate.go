@@ -0,0 +1,194 @@
+package vshard
+
+import (
+	"fmt"
+	"math"
+)
+
+// Topology is a candidate topology for Simulate. Unset fields keep the
+// pool's own settings, Weights defaulting to 1 when Servers is set. A
+// ServerStrategy replaces the pool's TopologyStrategy too, so like in a
+// Pool, weights need a TopologyStrategy. Locator, such as a VBucketMap
+// with moved buckets, takes precedence over the strategies. A VBucketMap
+// Locator brings its own Servers when Servers is unset, any other Locator
+// picks among Servers, or the pool's.
+type Topology struct {
+	Servers          []string
+	Weights          []int
+	ServerStrategy   ServerStrategy
+	TopologyStrategy TopologyStrategy
+	HashTagStrategy  HashTagStrategy
+	Locator          ServerLocator
+}
+
+// ServerLoad is the share of the simulated keys a server gets
+type ServerLoad struct {
+	Server string
+	Weight int
+	Keys   int
+	Share  float64
+}
+
+// LoadReport describes how keys spread over the servers of a topology.
+// Mean, StdDev and MaxMeanRatio are computed on the keys per unit of
+// weight, so a server twice as heavy holding twice the keys is balanced.
+type LoadReport struct {
+	Servers      []ServerLoad
+	Mean         float64
+	StdDev       float64
+	MaxMeanRatio float64
+}
+
+// Simulation compares the current topology of a pool with a candidate over
+// a set of keys, usually sampled from production
+type Simulation struct {
+	Current    LoadReport
+	Candidate  LoadReport
+	Moved      []string
+	MovedShare float64
+}
+
+// Simulate reports how keys would spread over a candidate topology
+// compared to the current one, and which keys would change servers. Like
+// UpdateServers, a pool using a vbucket map rebalances its buckets.
+// Servers marked down by the health checker are ignored.
+func (v *Pool) Simulate(keys []string, candidate Topology) (*Simulation, error) {
+	v.RLock()
+	servers, weights, locator := v.Servers, v.weights, v.locator
+	serverStrategy, topologyStrategy, hashTagStrategy := v.ServerStrategy, v.TopologyStrategy, v.HashTagStrategy
+	v.RUnlock()
+
+	current := &simulatedTopology{servers, weights, locator, serverStrategy, hashTagStrategy}
+
+	next := &simulatedTopology{
+		servers:         candidate.Servers,
+		weights:         candidate.Weights,
+		locator:         candidate.Locator,
+		serverStrategy:  serverStrategy,
+		hashTagStrategy: hashTagStrategy,
+	}
+	if m, ok := candidate.Locator.(*VBucketMap); ok && len(next.servers) == 0 {
+		next.servers = m.Servers
+	}
+	if len(next.servers) == 0 {
+		next.servers, next.weights = servers, weights
+	}
+	if err := validateServers(next.servers); err != nil {
+		return nil, err
+	}
+	checked, err := checkWeights(next.servers, next.weights)
+	if err != nil {
+		return nil, err
+	}
+	next.weights = checked
+
+	if candidate.ServerStrategy != nil {
+		next.serverStrategy = candidate.ServerStrategy
+	}
+	if candidate.HashTagStrategy != nil {
+		next.hashTagStrategy = candidate.HashTagStrategy
+	}
+
+	if next.locator == nil {
+		buckets, bucketed := locator.(*VBucketMap)
+		inherit := candidate.ServerStrategy == nil && candidate.TopologyStrategy == nil
+		switch {
+		case candidate.TopologyStrategy != nil:
+			next.locator = candidate.TopologyStrategy(next.servers, next.weights)
+		case inherit && bucketed:
+			if next.locator, err = buckets.Rebalance(next.servers, next.weights); err != nil {
+				return nil, err
+			}
+		case inherit && topologyStrategy != nil:
+			next.locator = topologyStrategy(next.servers, next.weights)
+		case weighted(next.weights):
+			return nil, ErrUnweightedStrategy
+		}
+	}
+
+	simulation := &Simulation{Moved: []string{}}
+	currentKeys := make([]int, len(current.servers))
+	nextKeys := make([]int, len(next.servers))
+	for _, key := range keys {
+		from, to := current.locate(key), next.locate(key)
+		if to < 0 || to >= len(next.servers) {
+			return nil, fmt.Errorf("error: candidate locator placed %q on server %d of %d", key, to, len(next.servers))
+		}
+		currentKeys[from]++
+		nextKeys[to]++
+		if current.servers[from] != next.servers[to] {
+			simulation.Moved = append(simulation.Moved, key)
+		}
+	}
+
+	simulation.Current = loadReport(current.servers, current.weights, currentKeys)
+	simulation.Candidate = loadReport(next.servers, next.weights, nextKeys)
+	if len(keys) > 0 {
+		simulation.MovedShare = float64(len(simulation.Moved)) / float64(len(keys))
+	}
+
+	return simulation, nil
+}
+
+// simulatedTopology locates keys like a pool with these settings would
+type simulatedTopology struct {
+	servers         []string
+	weights         []int
+	locator         ServerLocator
+	serverStrategy  ServerStrategy
+	hashTagStrategy HashTagStrategy
+}
+
+func (t *simulatedTopology) locate(key string) int {
+	if t.hashTagStrategy != nil {
+		key = t.hashTagStrategy(key)
+	}
+	if t.locator != nil {
+		return t.locator.Locate(key)
+	}
+
+	return t.serverStrategy(key, len(t.servers))
+}
+
+// weighted tells if a pool needs a TopologyStrategy for weights
+func weighted(weights []int) bool {
+	for _, weight := range weights {
+		if weight != 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func loadReport(servers []string, weights []int, keys []int) LoadReport {
+	report := LoadReport{Servers: make([]ServerLoad, len(servers))}
+
+	total := 0
+	for _, n := range keys {
+		total += n
+	}
+
+	loads := make([]float64, len(servers))
+	for i, server := range servers {
+		report.Servers[i] = ServerLoad{Server: server, Weight: weights[i], Keys: keys[i]}
+		if total > 0 {
+			report.Servers[i].Share = float64(keys[i]) / float64(total)
+		}
+		loads[i] = float64(keys[i]) / float64(weights[i])
+		report.Mean += loads[i]
+	}
+	report.Mean /= float64(len(servers))
+
+	max := 0.0
+	for _, load := range loads {
+		report.StdDev += (load - report.Mean) * (load - report.Mean)
+		max = math.Max(max, load)
+	}
+	report.StdDev = math.Sqrt(report.StdDev / float64(len(servers)))
+	if report.Mean > 0 {
+		report.MaxMeanRatio = max / report.Mean
+	}
+
+	return report
+}
@@ -0,0 +1,135 @@
+package vshard
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type SimulateTestSuite struct {
+	suite.Suite
+	Pool *Pool
+}
+
+func (suite *SimulateTestSuite) SetupSuite() {
+	suite.Pool = &Pool{Servers: getTestServers()[:4]}
+	suite.Pool.Start()
+}
+
+func (suite *SimulateTestSuite) TearDownSuite() {
+	suite.Pool.Close()
+}
+
+func (suite *SimulateTestSuite) TestAddServer() {
+	keys := testKeys(10000)
+	simulation, err := suite.Pool.Simulate(keys, Topology{Servers: getTestServers()[:5]})
+	suite.Require().NoError(err)
+
+	suite.Len(simulation.Current.Servers, 4)
+	suite.Len(simulation.Candidate.Servers, 5)
+	suite.InDelta(2500, simulation.Current.Mean, 0.001)
+	suite.InDelta(2000, simulation.Candidate.Mean, 0.001)
+	suite.True(simulation.Candidate.MaxMeanRatio < 1.1)
+	suite.True(simulation.Candidate.StdDev < 100)
+
+	// jump hash only moves keys to the new server
+	suite.InDelta(0.2, simulation.MovedShare, 0.02)
+	suite.Equal(simulation.Candidate.Servers[4].Keys, len(simulation.Moved))
+
+	suite.Pool.RLock()
+	defer suite.Pool.RUnlock()
+	moved := 0
+	for _, key := range keys {
+		if suite.Pool.locate(key) != XXH64ShardServerStrategy(key, 5) {
+			moved++
+		}
+	}
+	suite.Equal(moved, len(simulation.Moved))
+}
+
+func (suite *SimulateTestSuite) TestLoadReport() {
+	report := loadReport([]string{"a", "b", "c"}, []int{1, 2, 1}, []int{10, 40, 30})
+
+	suite.Equal([]ServerLoad{
+		{Server: "a", Weight: 1, Keys: 10, Share: 0.125},
+		{Server: "b", Weight: 2, Keys: 40, Share: 0.5},
+		{Server: "c", Weight: 1, Keys: 30, Share: 0.375},
+	}, report.Servers)
+	suite.InDelta(20, report.Mean, 0.001)
+	suite.InDelta(8.165, report.StdDev, 0.001)
+	suite.InDelta(1.5, report.MaxMeanRatio, 0.001)
+}
+
+func (suite *SimulateTestSuite) TestStrategyChange() {
+	keys := testKeys(10000)
+
+	simulation, err := suite.Pool.Simulate(keys, Topology{ServerStrategy: XXH64ShardServerStrategy})
+	suite.NoError(err)
+	suite.Empty(simulation.Moved)
+	suite.Equal(simulation.Current, simulation.Candidate)
+
+	simulation, err = suite.Pool.Simulate(keys, Topology{TopologyStrategy: KetamaServerStrategy})
+	suite.NoError(err)
+	suite.InDelta(0.75, simulation.MovedShare, 0.05)
+
+	// weights of the same servers
+	_, err = suite.Pool.Simulate(keys, Topology{Servers: getTestServers()[:4], Weights: []int{1, 1, 1, 3}})
+	suite.Equal(ErrUnweightedStrategy, err)
+	simulation, err = suite.Pool.Simulate(keys, Topology{
+		Servers:          getTestServers()[:4],
+		Weights:          []int{1, 1, 1, 3},
+		TopologyStrategy: XXH64WeightedServerStrategy,
+	})
+	suite.NoError(err)
+	suite.InDelta(0.5, simulation.Candidate.Servers[3].Share, 0.03)
+	suite.True(simulation.Candidate.MaxMeanRatio < 1.1)
+}
+
+func (suite *SimulateTestSuite) TestVBucketMoves() {
+	pool := &Pool{Servers: getTestServers()[:3], TopologyStrategy: VBucketServerStrategy}
+	pool.Start()
+	defer pool.Close()
+
+	keys := testKeys(5000)
+	current := pool.VBucketMap()
+	moved, err := current.Move(map[int]string{current.Bucket(keys[0]): getTestServers()[3]})
+	suite.Require().NoError(err)
+
+	simulation, err := pool.Simulate(keys, Topology{Servers: moved.Servers, Locator: moved})
+	suite.NoError(err)
+	suite.Contains(simulation.Moved, keys[0])
+	for _, key := range simulation.Moved {
+		suite.Equal(current.Bucket(keys[0]), current.Bucket(key))
+	}
+
+	// the map brings its servers along
+	simulation, err = pool.Simulate(keys, Topology{Locator: moved})
+	suite.NoError(err)
+	suite.Contains(simulation.Moved, keys[0])
+	suite.Len(simulation.Candidate.Servers, 4)
+
+	// locators placing keys past the servers are refused
+	_, err = pool.Simulate(keys, Topology{Servers: getTestServers()[:3], Locator: moved})
+	suite.Error(err)
+
+	// growing a bucketed pool rebalances its buckets
+	simulation, err = pool.Simulate(keys, Topology{Servers: getTestServers()[:4]})
+	suite.NoError(err)
+	suite.InDelta(0.25, simulation.MovedShare, 0.03)
+}
+
+func (suite *SimulateTestSuite) TestErrors() {
+	_, err := suite.Pool.Simulate(testKeys(10), Topology{Servers: []string{"127.0.0.1"}})
+	suite.Error(err)
+	_, err = suite.Pool.Simulate(testKeys(10), Topology{Servers: getTestServers()[:2], Weights: []int{1}})
+	suite.Error(err)
+
+	simulation, err := suite.Pool.Simulate(nil, Topology{})
+	suite.NoError(err)
+	suite.Equal(float64(0), simulation.MovedShare)
+	suite.Equal(float64(0), simulation.Current.MaxMeanRatio)
+}
+
+func TestSimulateTestSuite(t *testing.T) {
+	suite.Run(t, new(SimulateTestSuite))
+}
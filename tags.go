@@ -0,0 +1,236 @@
+package vshard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/youtube/vitess/go/cacheservice"
+)
+
+const (
+	// tagsFlag marks items whose value is prefixed with the versions of their tags
+	tagsFlag = uint16(1 << 14)
+
+	tagKeyPrefix = "vshard:tag:"
+
+	// taggedValueHeader starts tagged values, so items written with bit 14
+	// before it was reserved read back unchanged
+	taggedValueHeader = "\x00vshard-tags\x00"
+)
+
+var (
+	// ErrInvalidTaggedValue defines the error when a tagged item can't be decoded
+	ErrInvalidTaggedValue = errors.New("error: invalid tagged value")
+)
+
+func tagKey(tag string) string {
+	return tagKeyPrefix + tag
+}
+
+func newTagVersion() []byte {
+	return []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+}
+
+// SetWithTags sets the value with specified cache key, recording the current
+// version of each tag. The item counts as a miss once any tag is invalidated.
+// Flags can't use ReservedFlags.
+func (v *Pool) SetWithTags(key string, flags uint16, timeout uint64, value []byte, tags ...string) (bool, error) {
+	if flags&ReservedFlags != 0 {
+		return false, ErrReservedFlags
+	}
+
+	versions, err := v.tagVersions(tags, true)
+	if err != nil {
+		return false, err
+	}
+
+	return v.store(CommandSet, key, storeSet, false, flags|tagsFlag, timeout, encodeTaggedValue(tags, versions, value), 0)
+}
+
+// InvalidateTag bumps the version of tag, dropping every item set with it
+func (v *Pool) InvalidateTag(tag string) (bool, error) {
+	return v.Set(tagKey(tag), 0, 0, newTagVersion())
+}
+
+// tagVersions returns the current version of each tag, creating the missing
+// ones when create is set (a missing tag otherwise has an empty version)
+func (v *Pool) tagVersions(tags []string, create bool) (map[string][]byte, error) {
+	versions := make(map[string][]byte, len(tags))
+	if len(tags) == 0 {
+		return versions, nil
+	}
+
+	hashedTags := make(map[string]string, len(tags))
+	keys := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		key := tagKey(tag)
+		hashedTags[v.HashKeyStrategy(key)] = tag
+		keys = append(keys, key)
+	}
+
+	results, err := v.gets(keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, result := range results {
+		if tag, ok := hashedTags[result.Key]; ok {
+			versions[tag] = result.Value
+		}
+	}
+
+	if !create {
+		return versions, nil
+	}
+
+	for _, tag := range tags {
+		if _, ok := versions[tag]; ok {
+			continue
+		}
+
+		version := newTagVersion()
+		ok, err := v.Add(tagKey(tag), 0, 0, version)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// someone else created or bumped it first
+			result, err := v.get(tagKey(tag))
+			if err != nil {
+				return nil, err
+			}
+			if len(result) < 1 {
+				return nil, ErrKeyNotFound
+			}
+			version = result[0].Value
+		}
+		versions[tag] = version
+	}
+
+	return versions, nil
+}
+
+// isTagged tells if item was set with tags
+func isTagged(item cacheservice.Result) bool {
+	return item.Flags&tagsFlag != 0 && bytes.HasPrefix(item.Value, []byte(taggedValueHeader))
+}
+
+// checkTags strips the tag versions from tagged results, dropping the ones
+// whose tags were invalidated since they were set. The versions of every
+// tag are read in a single multi-get.
+func (v *Pool) checkTags(results []cacheservice.Result) ([]cacheservice.Result, error) {
+	type taggedValue struct {
+		tags     []string
+		versions map[string][]byte
+		value    []byte
+	}
+
+	decoded := make([]*taggedValue, len(results))
+	tags := []string{}
+	seen := make(map[string]bool)
+
+	for i, result := range results {
+		if !isTagged(result) {
+			continue
+		}
+
+		itemTags, versions, value, err := decodeTaggedValue(result.Value)
+		if err != nil {
+			return nil, err
+		}
+		decoded[i] = &taggedValue{itemTags, versions, value}
+
+		for _, tag := range itemTags {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	current, err := v.tagVersions(tags, false)
+	if err != nil {
+		return nil, err
+	}
+
+	valid := results[:0]
+	for i, result := range results {
+		item := decoded[i]
+		if item == nil {
+			valid = append(valid, result)
+			continue
+		}
+
+		stale := false
+		for _, tag := range item.tags {
+			if string(current[tag]) != string(item.versions[tag]) {
+				stale = true
+				break
+			}
+		}
+		if stale {
+			continue
+		}
+
+		result.Value = item.value
+		result.Flags &^= tagsFlag
+		valid = append(valid, result)
+	}
+
+	return valid, nil
+}
+
+func encodeTaggedValue(tags []string, versions map[string][]byte, value []byte) []byte {
+	var buffer [binary.MaxVarintLen64]byte
+	encoded := []byte(taggedValueHeader)
+
+	n := binary.PutUvarint(buffer[:], uint64(len(tags)))
+	encoded = append(encoded, buffer[:n]...)
+
+	for _, tag := range tags {
+		for _, field := range []string{tag, string(versions[tag])} {
+			n = binary.PutUvarint(buffer[:], uint64(len(field)))
+			encoded = append(encoded, buffer[:n]...)
+			encoded = append(encoded, field...)
+		}
+	}
+
+	return append(encoded, value...)
+}
+
+func decodeTaggedValue(encoded []byte) ([]string, map[string][]byte, []byte, error) {
+	if !bytes.HasPrefix(encoded, []byte(taggedValueHeader)) {
+		return nil, nil, nil, ErrInvalidTaggedValue
+	}
+	encoded = encoded[len(taggedValueHeader):]
+
+	count, n := binary.Uvarint(encoded)
+	if n <= 0 || count > uint64(len(encoded)) {
+		return nil, nil, nil, ErrInvalidTaggedValue
+	}
+	encoded = encoded[n:]
+
+	tags := make([]string, 0, count)
+	versions := make(map[string][]byte, count)
+
+	for i := uint64(0); i < count; i++ {
+		var fields [2][]byte
+		for f := range fields {
+			size, n := binary.Uvarint(encoded)
+			if n <= 0 || uint64(len(encoded)-n) < size {
+				return nil, nil, nil, ErrInvalidTaggedValue
+			}
+			fields[f] = encoded[n : n+int(size)]
+			encoded = encoded[n+int(size):]
+		}
+
+		tag := string(fields[0])
+		tags = append(tags, tag)
+		versions[tag] = fields[1]
+	}
+
+	return tags, versions, encoded, nil
+}
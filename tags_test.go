@@ -0,0 +1,169 @@
+package vshard
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TagsTestSuite struct {
+	suite.Suite
+	Pool *Pool
+}
+
+func (suite *TagsTestSuite) SetupSuite() {
+	suite.Pool = setupPool(suite.T())
+}
+
+func (suite *TagsTestSuite) TearDownTest() {
+	tearDownPool(suite.T(), suite.Pool)
+}
+
+func (suite *TagsTestSuite) TestSetWithTagsGet() {
+	ok, err := suite.Pool.SetWithTags("product:1:page", 0, 0, []byte("page"), "product:1", "category:2")
+	suite.True(ok)
+	suite.NoError(err)
+
+	value, err := suite.Pool.Get("product:1:page")
+	suite.NoError(err)
+	suite.Equal("page", string(value))
+}
+
+func (suite *TagsTestSuite) TestInvalidateTag() {
+	suite.Pool.SetWithTags("product:1:page", 0, 0, []byte("page"), "product:1")
+	suite.Pool.SetWithTags("product:1:fragment", 0, 0, []byte("fragment"), "product:1", "fragments")
+	suite.Pool.SetWithTags("product:2:page", 0, 0, []byte("other-page"), "product:2")
+
+	ok, err := suite.Pool.InvalidateTag("product:1")
+	suite.True(ok)
+	suite.NoError(err)
+
+	_, err = suite.Pool.Get("product:1:page")
+	suite.Equal(ErrKeyNotFound, err)
+	_, err = suite.Pool.Get("product:1:fragment")
+	suite.Equal(ErrKeyNotFound, err)
+
+	value, err := suite.Pool.Get("product:2:page")
+	suite.NoError(err)
+	suite.Equal("other-page", string(value))
+
+	suite.Pool.SetWithTags("product:1:page", 0, 0, []byte("new-page"), "product:1")
+	value, err = suite.Pool.Get("product:1:page")
+	suite.NoError(err)
+	suite.Equal("new-page", string(value))
+}
+
+func (suite *TagsTestSuite) TestEvictedTagIsAMiss() {
+	suite.Pool.SetWithTags("evicted-tag-key", 0, 0, []byte("value"), "evicted")
+	suite.Pool.Delete(tagKey("evicted"))
+
+	_, err := suite.Pool.Get("evicted-tag-key")
+	suite.Equal(ErrKeyNotFound, err)
+}
+
+func (suite *TagsTestSuite) TestGets() {
+	suite.Pool.SetWithTags("gets-tagged-1", 0, 0, []byte("one"), "gets-tag")
+	suite.Pool.SetWithTags("gets-tagged-2", 0, 0, []byte("two"), "gets-other-tag")
+	suite.Pool.Set("gets-untagged", 0, 0, []byte("three"))
+	suite.Pool.InvalidateTag("gets-tag")
+
+	results, err := suite.Pool.Gets("gets-tagged-1", "gets-tagged-2", "gets-untagged")
+	suite.NoError(err)
+
+	values := []string{}
+	for _, result := range results {
+		suite.Equal(uint16(0), result.Flags&tagsFlag)
+		values = append(values, string(result.Value))
+	}
+	suite.Len(values, 2)
+	suite.Contains(values, "two")
+	suite.Contains(values, "three")
+}
+
+func (suite *TagsTestSuite) TestTagKeysAreSharded() {
+	tag := "sharded-tag"
+	suite.Pool.SetWithTags("sharded-tag-key", 0, 0, []byte("value"), tag)
+
+	poolNum := suite.Pool.locate(tagKey(tag))
+	resource, err := suite.Pool.GetPoolConnection(poolNum)
+	if err != nil {
+		suite.FailNow("Failure getting specific connection from pool", err)
+	}
+	defer suite.Pool.ReturnConnection(poolNum, resource)
+
+	result, err := resource.Get(suite.Pool.HashKeyStrategy(tagKey(tag)))
+	suite.NoError(err)
+	suite.Len(result, 1)
+}
+
+func (suite *TagsTestSuite) TestReservedFlags() {
+	for _, flags := range []uint16{tagsFlag, leaseFlag, ReservedFlags | 1} {
+		_, err := suite.Pool.Set("reserved-key", flags, 0, []byte("value"))
+		suite.Equal(ErrReservedFlags, err, "flags %d", flags)
+		_, err = suite.Pool.Add("reserved-key", flags, 0, []byte("value"))
+		suite.Equal(ErrReservedFlags, err, "flags %d", flags)
+		_, err = suite.Pool.Replace("reserved-key", flags, 0, []byte("value"))
+		suite.Equal(ErrReservedFlags, err, "flags %d", flags)
+		_, err = suite.Pool.Cas("reserved-key", flags, 0, []byte("value"), 1)
+		suite.Equal(ErrReservedFlags, err, "flags %d", flags)
+		_, err = suite.Pool.SetWithTags("reserved-key", flags, 0, []byte("value"), "tag")
+		suite.Equal(ErrReservedFlags, err, "flags %d", flags)
+	}
+
+	_, err := suite.Pool.Get("reserved-key")
+	suite.Equal(ErrKeyNotFound, err)
+}
+
+func (suite *TagsTestSuite) TestUnreservedBit14() {
+	// an item another client stored with bit 14 isn't a tagged value
+	poolNum := suite.Pool.locate("bit-14-key")
+	resource, err := suite.Pool.GetPoolConnection(poolNum)
+	if err != nil {
+		suite.FailNow("Failure getting specific connection from pool", err)
+	}
+	_, err = resource.Set(suite.Pool.HashKeyStrategy("bit-14-key"), tagsFlag, 0, []byte("raw"))
+	suite.Pool.ReturnConnection(poolNum, resource)
+	suite.Require().NoError(err)
+
+	results, err := suite.Pool.Gets("bit-14-key")
+	suite.NoError(err)
+	suite.Require().Len(results, 1)
+	suite.Equal("raw", string(results[0].Value))
+	suite.Equal(tagsFlag, results[0].Flags)
+}
+
+func (suite *TagsTestSuite) TestSharedTags() {
+	suite.Pool.SetWithTags("shared-1", 0, 0, []byte("one"), "shared-a", "shared-b")
+	suite.Pool.SetWithTags("shared-2", 0, 0, []byte("two"), "shared-b")
+	suite.Pool.SetWithTags("shared-3", 0, 0, []byte("three"), "shared-c")
+	suite.Pool.InvalidateTag("shared-a")
+
+	results, err := suite.Pool.Gets("shared-1", "shared-2", "shared-3")
+	suite.NoError(err)
+
+	values := []string{}
+	for _, result := range results {
+		values = append(values, string(result.Value))
+	}
+	suite.Len(values, 2)
+	suite.Contains(values, "two")
+	suite.Contains(values, "three")
+}
+
+func (suite *TagsTestSuite) TestEncodeDecode() {
+	versions := map[string][]byte{"a": []byte("1"), "b": []byte("22")}
+	encoded := encodeTaggedValue([]string{"a", "b"}, versions, []byte("payload"))
+
+	tags, decoded, value, err := decodeTaggedValue(encoded)
+	suite.NoError(err)
+	suite.Equal([]string{"a", "b"}, tags)
+	suite.Equal(versions, decoded)
+	suite.Equal("payload", string(value))
+
+	_, _, _, err = decodeTaggedValue(encoded[:4])
+	suite.Equal(ErrInvalidTaggedValue, err)
+}
+
+func TestTagsTestSuite(t *testing.T) {
+	suite.Run(t, new(TagsTestSuite))
+}
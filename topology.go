@@ -0,0 +1,247 @@
+package vshard
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/youtube/vitess/go/pools"
+)
+
+var (
+	// ErrNoServers defines the error when a topology has no servers
+	ErrNoServers = errors.New("error: no servers")
+	// ErrUnweightedStrategy defines the error when weighing servers of a pool
+	// placing keys with a ServerStrategy, which spreads them evenly
+	ErrUnweightedStrategy = errors.New("error: weighted servers need a TopologyStrategy")
+)
+
+// UpdateServers replaces the servers of a started pool without a restart.
+// Servers that stay keep their connections and weight, new servers get a
+// weight of 1.
+func (v *Pool) UpdateServers(servers []string) error {
+	v.update.Lock()
+	defer v.update.Unlock()
+
+	return v.updateServers(servers, v.keptWeights(servers))
+}
+
+// keptWeights returns the weights of servers, the current one for servers
+// in use and 1 for new ones
+func (v *Pool) keptWeights(servers []string) []int {
+	v.RLock()
+	current := make(map[string]int, len(v.Servers))
+	for i, server := range v.Servers {
+		current[server] = v.weights[i]
+	}
+	v.RUnlock()
+
+	weights := make([]int, len(servers))
+	for i, server := range servers {
+		weights[i] = 1
+		if weight, ok := current[server]; ok {
+			weights[i] = weight
+		}
+	}
+
+	return weights
+}
+
+// UpdateWeightedServers replaces the servers of a started pool and their weights
+func (v *Pool) UpdateWeightedServers(servers []string, weights []int) error {
+	v.update.Lock()
+	defer v.update.Unlock()
+
+	return v.updateServers(servers, weights)
+}
+
+// topology is a set of servers along with their pools and locator
+type topology struct {
+	servers []string
+	weights []int
+	pools   []*pools.ResourcePool
+	locator ServerLocator
+}
+
+// currentTopology returns the topology in use, callers must hold the lock
+func (v *Pool) currentTopology() *topology {
+	return &topology{
+		servers: v.Servers,
+		weights: v.weights,
+		pools:   v.pool,
+		locator: v.locator,
+	}
+}
+
+// locate returns the slot owning a hash tag in t
+func (t *topology) locate(tag string, strategy ServerStrategy) int {
+	if t.locator != nil {
+		return t.locator.Locate(tag)
+	}
+
+	return strategy(tag, len(t.servers))
+}
+
+// updateServers connects to the new servers and builds the new locator
+// before swapping everything in at once, so requests either see the old or
+// the new topology. Pools of removed servers are closed in the background,
+// once the requests still using them return their connections. With a
+// HealthCheck, unreachable new servers are added as down instead of failing.
+func (v *Pool) updateServers(servers []string, weights []int) error {
+	if v.migration != nil {
+		return ErrMigrating
+	}
+
+	next, err := v.buildTopology(servers, weights)
+	if err != nil {
+		return err
+	}
+
+	removed := v.swapTopology(next, nil)
+	for _, pool := range removed {
+		go pool.Close()
+	}
+
+	return nil
+}
+
+// buildTopology creates the pools of new servers and the locator for
+// servers, reusing the pools of servers already in use. Callers must hold
+// the update lock.
+func (v *Pool) buildTopology(servers []string, weights []int) (*topology, error) {
+	if len(servers) == 0 {
+		return nil, ErrNoServers
+	}
+
+	weights, err := checkWeights(servers, weights)
+	if err != nil {
+		return nil, err
+	}
+
+	v.RLock()
+	current := make(map[string]*pools.ResourcePool, len(v.Servers))
+	for i, server := range v.Servers {
+		current[server] = v.pool[i]
+	}
+	buckets, bucketed := v.locator.(*VBucketMap)
+	v.RUnlock()
+
+	// switching strategies would move nearly every key
+	if !bucketed && v.TopologyStrategy == nil && weighted(weights) {
+		return nil, ErrUnweightedStrategy
+	}
+
+	seen := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		if seen[server] {
+			return nil, fmt.Errorf("error: duplicate server %s", server)
+		}
+		seen[server] = true
+	}
+
+	var rebalanced *VBucketMap
+	if bucketed {
+		// a bucketed pool keeps its buckets where they can stay
+		if rebalanced, err = buckets.Rebalance(servers, weights); err != nil {
+			return nil, err
+		}
+	}
+
+	serverPools := make([]*pools.ResourcePool, len(servers))
+	created := []*pools.ResourcePool{}
+	for i, server := range servers {
+		if pool, ok := current[server]; ok {
+			serverPools[i] = pool
+			continue
+		}
+
+		pool, err := v.newServerPool(server)
+		if err != nil && v.health == nil {
+			pool.Close()
+			for _, pool := range created {
+				pool.Close()
+			}
+			return nil, fmt.Errorf("error: can't connect to memcached %s: %s", server, err)
+		}
+		if err != nil {
+			v.health.eject(server)
+		}
+		serverPools[i] = pool
+		created = append(created, pool)
+	}
+
+	next := &topology{
+		servers: append([]string{}, servers...),
+		weights: weights,
+		pools:   serverPools,
+	}
+	if bucketed {
+		next.locator = rebalanced
+	} else if v.TopologyStrategy != nil {
+		next.locator = v.TopologyStrategy(servers, weights)
+	}
+
+	return next, nil
+}
+
+// swapTopology puts next in use along with migration, returning the pools
+// next doesn't use anymore. Callers must hold the update lock.
+func (v *Pool) swapTopology(next *topology, migration *migration) []*pools.ResourcePool {
+	v.RLock()
+	previous := v.currentTopology()
+	v.RUnlock()
+
+	removed := unusedPools(previous, next)
+	if v.health != nil {
+		for i, server := range previous.servers {
+			if !containsPool(next.pools, previous.pools[i]) {
+				delete(v.health.servers, server)
+			}
+		}
+	}
+	down, liveSlots, liveLocator := v.healthState(next.servers, next.weights, next.locator)
+
+	disruption := v.MaglevDisruption()
+	if table, ok := next.locator.(*MaglevTable); ok {
+		if previousTable, ok := previous.locator.(*MaglevTable); ok {
+			disruption = table.Disruption(previousTable)
+		}
+	}
+
+	v.Lock()
+	v.Servers = next.servers
+	v.Weights = next.weights
+	v.weights = next.weights
+	v.pool = next.pools
+	v.numServers = len(next.servers)
+	v.locator = next.locator
+	v.down = down
+	v.liveSlots = liveSlots
+	v.liveLocator = liveLocator
+	v.migration = migration
+	v.disruption = disruption
+	v.Unlock()
+
+	return removed
+}
+
+// unusedPools returns the pools of previous that next doesn't use
+func unusedPools(previous, next *topology) []*pools.ResourcePool {
+	unused := []*pools.ResourcePool{}
+	for _, pool := range previous.pools {
+		if !containsPool(next.pools, pool) {
+			unused = append(unused, pool)
+		}
+	}
+
+	return unused
+}
+
+func containsPool(serverPools []*pools.ResourcePool, pool *pools.ResourcePool) bool {
+	for _, p := range serverPools {
+		if p == pool {
+			return true
+		}
+	}
+
+	return false
+}
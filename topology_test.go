@@ -0,0 +1,174 @@
+package vshard
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TopologyTestSuite struct {
+	suite.Suite
+	Pool *Pool
+}
+
+func (suite *TopologyTestSuite) SetupTest() {
+	suite.Pool = &Pool{
+		Servers:     getTestServers()[:5],
+		Capacity:    10,
+		MaxCapacity: 10,
+		IdleTimeout: time.Second * 5,
+	}
+	suite.Pool.Start()
+}
+
+func (suite *TopologyTestSuite) TearDownTest() {
+	tearDownPool(suite.T(), suite.Pool)
+}
+
+func (suite *TopologyTestSuite) TestAddServers() {
+	servers := getTestServers()[:7]
+	suite.NoError(suite.Pool.UpdateServers(servers))
+
+	suite.Equal(7, suite.Pool.numServers)
+	suite.Equal(servers, suite.Pool.Servers)
+	suite.Len(suite.Pool.Status(), 7)
+
+	mapping := suite.Pool.GetKeyMapping(testKeys(1000)...)
+	suite.Len(mapping, 7)
+	suite.NotEmpty(mapping[5])
+	suite.NotEmpty(mapping[6])
+
+	for _, key := range testKeys(100) {
+		_, err := suite.Pool.Set(key, 0, 0, []byte(key))
+		suite.NoError(err)
+
+		value, err := suite.Pool.Get(key)
+		suite.NoError(err)
+		suite.Equal(key, string(value))
+	}
+}
+
+func (suite *TopologyTestSuite) TestRemoveServers() {
+	removed := suite.Pool.pool[4]
+	suite.NoError(suite.Pool.UpdateServers(getTestServers()[:4]))
+
+	suite.Equal(4, suite.Pool.numServers)
+	suite.Len(suite.Pool.Status(), 4)
+	suite.True(waitFor(removed.IsClosed))
+
+	mapping := suite.Pool.GetKeyMapping(testKeys(1000)...)
+	suite.Len(mapping, 4)
+}
+
+func (suite *TopologyTestSuite) TestReplaceServer() {
+	kept := suite.Pool.pool[1]
+	servers := getTestServers()[:5]
+	servers[0] = getTestServers()[9]
+
+	suite.NoError(suite.Pool.UpdateServers(servers))
+
+	suite.Equal(servers, suite.Pool.Servers)
+	suite.Equal(kept, suite.Pool.pool[1])
+	suite.Equal(getTestServers()[9], suite.Pool.Status()[0].Server)
+}
+
+func (suite *TopologyTestSuite) TestUpdateKeepsWeights() {
+	servers := getTestServers()[:3]
+
+	// jump hash can't weigh servers, switching would move nearly every key
+	suite.Equal(ErrUnweightedStrategy, suite.Pool.UpdateWeightedServers(servers, []int{1, 4, 2}))
+	suite.Nil(suite.Pool.TopologyStrategy)
+	suite.NoError(suite.Pool.UpdateWeightedServers(servers, []int{1, 1, 1}))
+
+	// weights of 1 along with a ServerStrategy are fine when starting too
+	suite.Pool.Close()
+	suite.Pool = &Pool{Servers: servers, Weights: []int{1, 1, 1}, ServerStrategy: XXH64ShardServerStrategy}
+	suite.Pool.Start()
+	suite.Nil(suite.Pool.TopologyStrategy)
+
+	suite.Pool.Close()
+	suite.Pool = &Pool{Servers: servers, Weights: []int{1, 1, 1}}
+	suite.Pool.Start()
+	suite.NoError(suite.Pool.UpdateWeightedServers(servers, []int{1, 4, 2}))
+	suite.NotNil(suite.Pool.locator)
+
+	servers = append(servers, getTestServers()[3])
+	suite.NoError(suite.Pool.UpdateServers(servers[1:]))
+	suite.Equal([]int{4, 2, 1}, suite.Pool.weights)
+}
+
+func (suite *TopologyTestSuite) TestUpdateErrors() {
+	servers := suite.Pool.Servers
+
+	suite.Equal(ErrNoServers, suite.Pool.UpdateServers(nil))
+	suite.Error(suite.Pool.UpdateServers([]string{servers[0], servers[0]}))
+	suite.Error(suite.Pool.UpdateWeightedServers(servers, []int{1}))
+	suite.Error(suite.Pool.UpdateWeightedServers(servers[:2], []int{1, 0}))
+	suite.Error(suite.Pool.UpdateWeightedServers(servers[:2], []int{1, -1}))
+	suite.Error(suite.Pool.UpdateServers(append(servers, "127.0.0.1:1")))
+
+	suite.Equal(servers, suite.Pool.Servers)
+	suite.Equal(5, suite.Pool.numServers)
+}
+
+func (suite *TopologyTestSuite) TestConnectionOutlivesRemovedServer() {
+	resource, poolNum, err := suite.Pool.GetConnection("key")
+	suite.NoError(err)
+	removed := suite.Pool.pool[poolNum]
+
+	suite.NoError(suite.Pool.UpdateServers(without(suite.Pool.Servers, poolNum)))
+
+	suite.Pool.ReturnConnection(poolNum, resource)
+	suite.True(waitFor(removed.IsClosed))
+}
+
+func (suite *TopologyTestSuite) TestUpdateUnderTraffic() {
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	errs := make(chan error, 100)
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				key := "traffic-" + strconv.Itoa(worker) + "-" + strconv.Itoa(n%50)
+				if _, err := suite.Pool.Set(key, 0, 0, []byte(key)); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := suite.Pool.Gets(key, key+"-other"); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+
+	all := getTestServers()
+	topologies := [][]string{all[:3], all[2:9], all, all[5:6], all[:5]}
+	for i := 0; i < 20; i++ {
+		suite.NoError(suite.Pool.UpdateServers(topologies[i%len(topologies)]))
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		suite.NoError(err)
+	}
+}
+
+func TestTopologyTestSuite(t *testing.T) {
+	suite.Run(t, new(TopologyTestSuite))
+}
@@ -0,0 +1,141 @@
+package vshard
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	defaultUpdateMaxRetries = 10
+	defaultUpdateBackoff    = time.Millisecond
+	defaultUpdateMaxBackoff = time.Millisecond * 100
+)
+
+var (
+	// ErrCasConflict defines the error when a CAS loop gives up after too many conflicts
+	ErrCasConflict = errors.New("error: too many CAS conflicts")
+
+	defaultUpdatePolicy = UpdatePolicy{
+		MaxRetries: defaultUpdateMaxRetries,
+		Backoff:    defaultUpdateBackoff,
+		MaxBackoff: defaultUpdateMaxBackoff,
+	}
+)
+
+// UpdateFunc computes the new value of a key from its current value, exists
+// is false when the key is missing. Returning an error aborts the update.
+type UpdateFunc func(old []byte, exists bool) ([]byte, error)
+
+// UpdatePolicy configures the CAS loop run by Pool.Update. Unset MaxRetries,
+// Backoff and MaxBackoff default to 10 retries waiting from 1ms to 100ms.
+type UpdatePolicy struct {
+	// MaxRetries is how many conflicting writes are retried before giving up
+	MaxRetries int
+	// Backoff is the wait before the first retry, doubling up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// DeleteOnNil deletes the key when UpdateFunc returns a nil value,
+	// otherwise a nil value leaves the key untouched
+	DeleteOnNil bool
+	// Flags are the flags stored with updated values, they can't use
+	// ReservedFlags
+	Flags uint16
+}
+
+// Update atomically replaces the value of key with the one returned by fn,
+// retrying when someone else writes the key in between. Missing keys are
+// created with Add, so concurrent creations conflict too. It returns the
+// value written, or ErrCasConflict once Pool.UpdatePolicy's retries run out.
+func (v *Pool) Update(ctx context.Context, key string, timeout uint64, fn UpdateFunc) ([]byte, error) {
+	policy := v.UpdatePolicy
+	if policy == nil {
+		policy = &defaultUpdatePolicy
+	}
+	if policy.Flags&ReservedFlags != 0 {
+		return nil, ErrReservedFlags
+	}
+	maxRetries, backoff, maxBackoff := policy.MaxRetries, policy.Backoff, policy.MaxBackoff
+	if maxRetries < 1 {
+		maxRetries = defaultUpdateMaxRetries
+	}
+	if backoff == 0 {
+		backoff = defaultUpdateBackoff
+	}
+	if maxBackoff == 0 {
+		maxBackoff = defaultUpdateMaxBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		value, ok, err := v.tryUpdate(key, timeout, policy, fn)
+		if err != nil || ok {
+			return value, err
+		}
+
+		if attempt >= maxRetries {
+			return nil, ErrCasConflict
+		}
+
+		if backoff > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(jitteredBackoff(backoff)):
+			}
+
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		} else if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// tryUpdate runs one read-modify-write round, reporting false on a conflict
+func (v *Pool) tryUpdate(key string, timeout uint64, policy *UpdatePolicy, fn UpdateFunc) ([]byte, bool, error) {
+	raw, err := v.gets(key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// a stale tagged item reads as missing, but still has to be replaced with Cas
+	results, err := v.checkTags(append(raw[:0:0], raw...))
+	if err != nil {
+		return nil, false, err
+	}
+
+	var old []byte
+	exists := len(results) > 0
+	if exists {
+		old = results[0].Value
+	}
+
+	value, err := fn(old, exists)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if value == nil {
+		if !policy.DeleteOnNil || len(raw) < 1 {
+			return old, true, nil
+		}
+
+		// a Cas expiring the item right away is a delete that can conflict
+		ok, err := v.store(CommandUpdate, key, storeCas, true, 0, expireNow, []byte{}, raw[0].Cas)
+		return nil, ok, err
+	}
+
+	var ok bool
+	if len(raw) > 0 {
+		ok, err = v.store(CommandUpdate, key, storeCas, true, policy.Flags, timeout, value, raw[0].Cas)
+	} else {
+		ok, err = v.store(CommandUpdate, key, storeAdd, true, policy.Flags, timeout, value, 0)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return value, ok, nil
+}
@@ -0,0 +1,169 @@
+package vshard
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type UpdateTestSuite struct {
+	suite.Suite
+	Pool *Pool
+}
+
+func (suite *UpdateTestSuite) SetupSuite() {
+	suite.Pool = setupPool(suite.T())
+}
+
+func (suite *UpdateTestSuite) TearDownTest() {
+	suite.Pool.UpdatePolicy = nil
+	tearDownPool(suite.T(), suite.Pool)
+}
+
+func increment(old []byte, exists bool) ([]byte, error) {
+	counter := 0
+	if exists {
+		var err error
+		if counter, err = strconv.Atoi(string(old)); err != nil {
+			return nil, err
+		}
+	}
+
+	return []byte(strconv.Itoa(counter + 1)), nil
+}
+
+func (suite *UpdateTestSuite) TestUpdateMissingKey() {
+	value, err := suite.Pool.Update(context.Background(), "update-missing", 0, func(old []byte, exists bool) ([]byte, error) {
+		suite.False(exists)
+		suite.Nil(old)
+		return []byte("created"), nil
+	})
+	suite.NoError(err)
+	suite.Equal("created", string(value))
+
+	stored, err := suite.Pool.Get("update-missing")
+	suite.NoError(err)
+	suite.Equal("created", string(stored))
+}
+
+func (suite *UpdateTestSuite) TestUpdateExistingKey() {
+	suite.Pool.Set("update-existing", 0, 0, []byte("41"))
+
+	value, err := suite.Pool.Update(context.Background(), "update-existing", 0, increment)
+	suite.NoError(err)
+	suite.Equal("42", string(value))
+}
+
+func (suite *UpdateTestSuite) TestConcurrentUpdates() {
+	suite.Pool.UpdatePolicy = &UpdatePolicy{MaxRetries: 1000, Backoff: time.Microsecond * 100, MaxBackoff: time.Millisecond}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				_, err := suite.Pool.Update(context.Background(), "update-concurrent", 0, increment)
+				suite.NoError(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := suite.Pool.Get("update-concurrent")
+	suite.NoError(err)
+	suite.Equal("100", string(value), "no increment should be lost")
+}
+
+func (suite *UpdateTestSuite) TestDeleteOnNil() {
+	suite.Pool.Set("update-nil", 0, 0, []byte("value"))
+
+	value, err := suite.Pool.Update(context.Background(), "update-nil", 0, func(old []byte, exists bool) ([]byte, error) {
+		return nil, nil
+	})
+	suite.NoError(err)
+	suite.Equal("value", string(value), "nil should leave the key untouched by default")
+
+	suite.Pool.UpdatePolicy = &UpdatePolicy{MaxRetries: 1, DeleteOnNil: true}
+	value, err = suite.Pool.Update(context.Background(), "update-nil", 0, func(old []byte, exists bool) ([]byte, error) {
+		return nil, nil
+	})
+	suite.NoError(err)
+	suite.Nil(value)
+
+	_, err = suite.Pool.Get("update-nil")
+	suite.Equal(ErrKeyNotFound, err)
+}
+
+func (suite *UpdateTestSuite) TestAbort() {
+	suite.Pool.Set("update-abort", 0, 0, []byte("value"))
+	abort := errors.New("abort")
+
+	_, err := suite.Pool.Update(context.Background(), "update-abort", 0, func(old []byte, exists bool) ([]byte, error) {
+		return nil, abort
+	})
+	suite.Equal(abort, err)
+
+	value, _ := suite.Pool.Get("update-abort")
+	suite.Equal("value", string(value))
+}
+
+func (suite *UpdateTestSuite) TestConflicts() {
+	suite.Pool.UpdatePolicy = &UpdatePolicy{MaxRetries: 2}
+	attempts := 0
+
+	_, err := suite.Pool.Update(context.Background(), "update-conflict", 0, func(old []byte, exists bool) ([]byte, error) {
+		attempts++
+		// someone else always writes between our read and our write
+		suite.Pool.Set("update-conflict", 0, 0, []byte(strconv.Itoa(attempts)))
+		return []byte("mine"), nil
+	})
+	suite.Equal(ErrCasConflict, err)
+	suite.Equal(3, attempts)
+}
+
+func (suite *UpdateTestSuite) TestUnsetPolicyFields() {
+	suite.Pool.UpdatePolicy = &UpdatePolicy{DeleteOnNil: true}
+	attempts := 0
+
+	_, err := suite.Pool.Update(context.Background(), "update-defaults", 0, func(old []byte, exists bool) ([]byte, error) {
+		attempts++
+		suite.Pool.Set("update-defaults", 0, 0, []byte(strconv.Itoa(attempts)))
+		return []byte("mine"), nil
+	})
+	suite.Equal(ErrCasConflict, err)
+	suite.Equal(defaultUpdateMaxRetries+1, attempts)
+}
+
+func (suite *UpdateTestSuite) TestContextCanceled() {
+	suite.Pool.UpdatePolicy = &UpdatePolicy{MaxRetries: 100, Backoff: time.Second}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	_, err := suite.Pool.Update(ctx, "update-canceled", 0, func(old []byte, exists bool) ([]byte, error) {
+		suite.Pool.Set("update-canceled", 0, 0, []byte("theirs"))
+		return []byte("mine"), nil
+	})
+	suite.Equal(context.DeadlineExceeded, err)
+}
+
+func (suite *UpdateTestSuite) TestUpdateStaleTaggedKey() {
+	suite.Pool.SetWithTags("update-tagged", 0, 0, []byte("old"), "update-tag")
+	suite.Pool.InvalidateTag("update-tag")
+
+	value, err := suite.Pool.Update(context.Background(), "update-tagged", 0, func(old []byte, exists bool) ([]byte, error) {
+		suite.False(exists)
+		return []byte("new"), nil
+	})
+	suite.NoError(err)
+	suite.Equal("new", string(value))
+}
+
+func TestUpdateTestSuite(t *testing.T) {
+	suite.Run(t, new(UpdateTestSuite))
+}
@@ -0,0 +1,338 @@
+package vshard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// DefaultVBuckets is the number of buckets of maps made by VBucketServerStrategy
+const DefaultVBuckets = 1024
+
+var (
+	// ErrStaleVBucketMap defines the error when applying a map older than the one in use
+	ErrStaleVBucketMap = errors.New("error: vbucket map is not newer than the one in use")
+	// ErrNoVBucketMap defines the error when moving buckets of a pool without a vbucket map
+	ErrNoVBucketMap = errors.New("error: pool doesn't use a vbucket map")
+)
+
+// VBucketMap places keys in two steps, like Couchbase vbuckets: keys hash
+// to one of a fixed number of buckets, and Buckets holds the index in
+// Servers of each bucket's server. Buckets can be moved one by one, say a
+// hot slice of the keyspace to a new machine, and the map is versioned
+// and serializable as JSON so it can be shared through a config store.
+//
+// A map is never changed once in use: Move and Rebalance return a new
+// version.
+type VBucketMap struct {
+	Version uint64   `json:"version"`
+	Servers []string `json:"servers"`
+	Buckets []int    `json:"buckets"`
+}
+
+// VBucketServerStrategy spreads DefaultVBuckets buckets over servers as
+// weights say. A pool using it keeps its map through UpdateServers, which
+// only moves the buckets needed to follow the new servers and weights. It
+// panics on servers or weights NewVBucketMap refuses, which Pool checks
+// beforehand.
+func VBucketServerStrategy(servers []string, weights []int) ServerLocator {
+	m, err := NewVBucketMap(servers, weights, DefaultVBuckets)
+	if err != nil {
+		panic(err)
+	}
+
+	return m
+}
+
+// NewVBucketMap spreads numBuckets buckets over servers as weights say, as
+// version 1
+func NewVBucketMap(servers []string, weights []int, numBuckets int) (*VBucketMap, error) {
+	if numBuckets < 1 {
+		return nil, fmt.Errorf("error: %d vbuckets, expected at least 1", numBuckets)
+	}
+
+	empty := &VBucketMap{Buckets: make([]int, numBuckets)}
+	for i := range empty.Buckets {
+		empty.Buckets[i] = -1
+	}
+
+	return empty.Rebalance(servers, weights)
+}
+
+// ParseVBucketMap reads a JSON map, checking it's valid
+func ParseVBucketMap(data []byte) (*VBucketMap, error) {
+	m := &VBucketMap{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Validate checks every bucket belongs to one of distinct Servers
+func (m *VBucketMap) Validate() error {
+	if len(m.Servers) == 0 {
+		return ErrNoServers
+	}
+	if len(m.Buckets) == 0 {
+		return errors.New("error: vbucket map without buckets")
+	}
+
+	seen := make(map[string]bool, len(m.Servers))
+	for _, server := range m.Servers {
+		if seen[server] {
+			return fmt.Errorf("error: duplicate server %s", server)
+		}
+		seen[server] = true
+	}
+
+	for bucket, slot := range m.Buckets {
+		if slot < 0 || slot >= len(m.Servers) {
+			return fmt.Errorf("error: vbucket %d has unknown server %d", bucket, slot)
+		}
+	}
+
+	return nil
+}
+
+// Bucket returns the bucket of key, 0 for a map without buckets
+func (m *VBucketMap) Bucket(key string) int {
+	if len(m.Buckets) == 0 {
+		return 0
+	}
+
+	return int(xxh64Hash(key) % uint64(len(m.Buckets)))
+}
+
+// Locate returns the server of key's bucket, 0 for a map without buckets
+func (m *VBucketMap) Locate(key string) int {
+	if len(m.Buckets) == 0 {
+		return 0
+	}
+
+	return m.Buckets[m.Bucket(key)]
+}
+
+// LocateReplicas returns the server of key's bucket, followed by the
+// servers of the next buckets, each server once
+func (m *VBucketMap) LocateReplicas(key string, n int) []int {
+	if n > len(m.Servers) {
+		n = len(m.Servers)
+	}
+
+	slots := make([]int, 0, n)
+	seen := make(map[int]bool, n)
+	bucket := m.Bucket(key)
+	for i := 0; i < len(m.Buckets) && len(slots) < n; i++ {
+		slot := m.Buckets[(bucket+i)%len(m.Buckets)]
+		if !seen[slot] {
+			seen[slot] = true
+			slots = append(slots, slot)
+		}
+	}
+
+	return slots
+}
+
+// Move returns the next version of the map with buckets moved to the
+// servers given, which are added to Servers when new
+func (m *VBucketMap) Move(moves map[int]string) (*VBucketMap, error) {
+	next := m.next()
+	slots := make(map[string]int, len(next.Servers))
+	for i, server := range next.Servers {
+		slots[server] = i
+	}
+
+	for bucket, server := range moves {
+		if bucket < 0 || bucket >= len(next.Buckets) {
+			return nil, fmt.Errorf("error: unknown vbucket %d", bucket)
+		}
+		slot, ok := slots[server]
+		if !ok {
+			slot = len(next.Servers)
+			slots[server] = slot
+			next.Servers = append(next.Servers, server)
+		}
+		next.Buckets[bucket] = slot
+	}
+
+	return next, nil
+}
+
+// Rebalance returns the next version of the map for servers and their
+// weights, moving as few buckets as possible: servers that stay keep their
+// buckets up to their new share, and the rest go to the servers short of
+// theirs. Servers left out lose all their buckets.
+func (m *VBucketMap) Rebalance(servers []string, weights []int) (*VBucketMap, error) {
+	if len(servers) == 0 {
+		return nil, ErrNoServers
+	}
+	if len(m.Buckets) == 0 {
+		return nil, errors.New("error: vbucket map without buckets")
+	}
+	weights, err := checkWeights(servers, weights)
+	if err != nil {
+		return nil, err
+	}
+	quotas := bucketQuotas(len(m.Buckets), weights)
+
+	slots := make(map[string]int, len(servers))
+	for i, server := range servers {
+		slots[server] = i
+	}
+
+	next := m.next()
+	next.Servers = append([]string{}, servers...)
+	counts := make([]int, len(servers))
+	unassigned := []int{}
+	for bucket, old := range m.Buckets {
+		slot, ok := -1, false
+		if old >= 0 && old < len(m.Servers) {
+			slot, ok = slots[m.Servers[old]]
+		}
+		if !ok || counts[slot] >= quotas[slot] {
+			unassigned = append(unassigned, bucket)
+			continue
+		}
+		next.Buckets[bucket] = slot
+		counts[slot]++
+	}
+
+	// each bucket goes to the server furthest from its share
+	for _, bucket := range unassigned {
+		best := 0
+		for slot := range servers {
+			if quotas[slot]-counts[slot] > quotas[best]-counts[best] {
+				best = slot
+			}
+		}
+		next.Buckets[bucket] = best
+		counts[best]++
+	}
+
+	// duplicate servers are the only problem left
+	if err := next.Validate(); err != nil {
+		return nil, err
+	}
+
+	return next, nil
+}
+
+// Counts returns the number of buckets of each server
+func (m *VBucketMap) Counts() []int {
+	counts := make([]int, len(m.Servers))
+	for _, slot := range m.Buckets {
+		counts[slot]++
+	}
+
+	return counts
+}
+
+func (m *VBucketMap) clone() *VBucketMap {
+	return &VBucketMap{
+		Version: m.Version,
+		Servers: append([]string{}, m.Servers...),
+		Buckets: append([]int{}, m.Buckets...),
+	}
+}
+
+func (m *VBucketMap) next() *VBucketMap {
+	next := m.clone()
+	next.Version++
+
+	return next
+}
+
+// bucketQuotas splits numBuckets as weights say, handing the buckets left
+// by rounding down to the largest remainders
+func bucketQuotas(numBuckets int, weights []int) []int {
+	total := 0
+	for _, weight := range weights {
+		total += weight
+	}
+
+	quotas := make([]int, len(weights))
+	remainders := make([]int, len(weights))
+	assigned := 0
+	for i, weight := range weights {
+		quotas[i] = numBuckets * weight / total
+		remainders[i] = numBuckets * weight % total
+		assigned += quotas[i]
+	}
+
+	for ; assigned < numBuckets; assigned++ {
+		best := 0
+		for i := range remainders {
+			if remainders[i] > remainders[best] {
+				best = i
+			}
+		}
+		quotas[best]++
+		remainders[best] = -1
+	}
+
+	return quotas
+}
+
+// VBucketMap returns the map of a pool using VBucketServerStrategy or
+// ApplyVBucketMap, or nil
+func (v *Pool) VBucketMap() *VBucketMap {
+	v.RLock()
+	defer v.RUnlock()
+
+	m, _ := v.locator.(*VBucketMap)
+	return m
+}
+
+// ApplyVBucketMap puts m in use, connecting to its new servers and closing
+// the connections of servers no longer in it. Maps must be applied in
+// version order, so an old map read late from a config store can't undo
+// a newer one. Servers already in use keep their weight, new ones get a
+// weight of 1.
+func (v *Pool) ApplyVBucketMap(m *VBucketMap) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+
+	v.update.Lock()
+	defer v.update.Unlock()
+
+	if v.migration != nil {
+		return ErrMigrating
+	}
+	if current := v.VBucketMap(); current != nil && m.Version <= current.Version {
+		return ErrStaleVBucketMap
+	}
+
+	next, err := v.buildTopology(m.Servers, v.keptWeights(m.Servers))
+	if err != nil {
+		return err
+	}
+	next.locator = m.clone()
+
+	for _, pool := range v.swapTopology(next, nil) {
+		go pool.Close()
+	}
+
+	return nil
+}
+
+// MoveBuckets moves buckets of a bucketed pool to the servers given,
+// applying the next version of its map. UpdateServers rebalances buckets
+// by weight, so it takes back the buckets of servers above their share.
+func (v *Pool) MoveBuckets(moves map[int]string) error {
+	current := v.VBucketMap()
+	if current == nil {
+		return ErrNoVBucketMap
+	}
+
+	next, err := current.Move(moves)
+	if err != nil {
+		return err
+	}
+
+	return v.ApplyVBucketMap(next)
+}
@@ -0,0 +1,239 @@
+package vshard
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type VBucketTestSuite struct {
+	suite.Suite
+	Pool *Pool
+}
+
+func (suite *VBucketTestSuite) SetupTest() {
+	suite.Pool = &Pool{
+		Servers:          getTestServers()[:3],
+		IdleTimeout:      time.Second * 5,
+		TopologyStrategy: VBucketServerStrategy,
+	}
+	suite.Pool.Start()
+}
+
+func (suite *VBucketTestSuite) TearDownTest() {
+	tearDownPool(suite.T(), suite.Pool)
+	suite.Pool.Close()
+}
+
+func (suite *VBucketTestSuite) newMap(servers []string, weights []int, numBuckets int) *VBucketMap {
+	m, err := NewVBucketMap(servers, weights, numBuckets)
+	suite.Require().NoError(err)
+
+	return m
+}
+
+func (suite *VBucketTestSuite) TestNewVBucketMap() {
+	m := suite.newMap(testServers(3), []int{1, 2, 1}, 1024)
+
+	suite.NoError(m.Validate())
+	suite.Equal(uint64(1), m.Version)
+	suite.Len(m.Buckets, 1024)
+	suite.Equal([]int{256, 512, 256}, m.Counts())
+
+	suite.Equal([]int{342, 341, 341}, suite.newMap(testServers(3), nil, 1024).Counts())
+}
+
+func (suite *VBucketTestSuite) TestInvalidInputs() {
+	for _, args := range []struct {
+		servers    []string
+		weights    []int
+		numBuckets int
+	}{
+		{nil, nil, 1024},
+		{testServers(3), nil, 0},
+		{testServers(3), []int{1, 2}, 1024},
+		{testServers(3), []int{1, -1, 1}, 1024},
+		{[]string{"a:1", "a:1"}, nil, 1024},
+	} {
+		_, err := NewVBucketMap(args.servers, args.weights, args.numBuckets)
+		suite.Error(err)
+	}
+
+	m := suite.newMap(testServers(3), nil, 16)
+	_, err := m.Rebalance(nil, nil)
+	suite.Equal(ErrNoServers, err)
+	_, err = m.Rebalance(testServers(2), []int{1})
+	suite.Error(err)
+	_, err = (&VBucketMap{}).Rebalance(testServers(2), nil)
+	suite.Error(err)
+
+	// a map without buckets locates every key on the first server
+	suite.Equal(0, (&VBucketMap{}).Locate("key"))
+	suite.Empty((&VBucketMap{}).LocateReplicas("key", 2))
+}
+
+func (suite *VBucketTestSuite) TestRebalanceMovesFewBuckets() {
+	before := suite.newMap(testServers(4), nil, 1024)
+
+	added, err := before.Rebalance(testServers(5), nil)
+	suite.Require().NoError(err)
+	suite.Equal(uint64(2), added.Version)
+	suite.Equal([]int{205, 205, 205, 205, 204}, added.Counts())
+	moved := 0
+	for bucket := range before.Buckets {
+		if before.Servers[before.Buckets[bucket]] != added.Servers[added.Buckets[bucket]] {
+			moved++
+			suite.Equal(4, added.Buckets[bucket])
+		}
+	}
+	suite.Equal(204, moved)
+
+	remaining := without(testServers(4), 1)
+	removed, err := before.Rebalance(remaining, nil)
+	suite.Require().NoError(err)
+	for bucket, slot := range before.Buckets {
+		if slot != 1 {
+			suite.Equal(before.Servers[slot], removed.Servers[removed.Buckets[bucket]])
+		}
+	}
+}
+
+func (suite *VBucketTestSuite) TestMove() {
+	m := suite.newMap(testServers(3), nil, 16)
+
+	moved, err := m.Move(map[int]string{3: "new:11211", 4: testServers(3)[0]})
+	suite.NoError(err)
+	suite.Equal(uint64(2), moved.Version)
+	suite.Equal(append(testServers(3), "new:11211"), moved.Servers)
+	suite.Equal(3, moved.Buckets[3])
+	suite.Equal(0, moved.Buckets[4])
+
+	// the original map is left alone
+	suite.Equal(uint64(1), m.Version)
+	suite.Len(m.Servers, 3)
+
+	_, err = m.Move(map[int]string{16: "new:11211"})
+	suite.Error(err)
+}
+
+func (suite *VBucketTestSuite) TestLocate() {
+	m := suite.newMap(testServers(4), nil, 64)
+
+	for _, key := range testKeys(100) {
+		suite.Equal(m.Buckets[m.Bucket(key)], m.Locate(key))
+
+		replicas := m.LocateReplicas(key, 3)
+		suite.Len(replicas, 3)
+		suite.Equal(m.Locate(key), replicas[0])
+		suite.NotEqual(replicas[0], replicas[1])
+		suite.NotEqual(replicas[1], replicas[2])
+		suite.NotEqual(replicas[0], replicas[2])
+	}
+	suite.Len(m.LocateReplicas("key", 10), 4)
+}
+
+func (suite *VBucketTestSuite) TestSerialization() {
+	m, err := suite.newMap(testServers(3), nil, 32).Move(map[int]string{0: "new:11211"})
+	suite.Require().NoError(err)
+
+	data, err := json.Marshal(m)
+	suite.NoError(err)
+	parsed, err := ParseVBucketMap(data)
+	suite.NoError(err)
+	suite.Equal(m, parsed)
+
+	for _, data := range []string{
+		`{"version": 1, "servers": [], "buckets": [0]}`,
+		`{"version": 1, "servers": ["a:1"], "buckets": []}`,
+		`{"version": 1, "servers": ["a:1"], "buckets": [0, 1]}`,
+		`{"version": 1, "servers": ["a:1", "a:1"], "buckets": [0, 1]}`,
+		`{"version": 1, "servers": ["a:1"], "buckets": {}}`,
+	} {
+		_, err := ParseVBucketMap([]byte(data))
+		suite.Error(err, data)
+	}
+}
+
+func (suite *VBucketTestSuite) TestMoveBuckets() {
+	m := suite.Pool.VBucketMap()
+	suite.Require().NotNil(m)
+	suite.Len(m.Buckets, DefaultVBuckets)
+
+	keys := testKeys(50)
+	for _, key := range keys {
+		_, err := suite.Pool.Set(key, 0, 0, []byte(key))
+		suite.NoError(err)
+	}
+
+	hot := m.Bucket(keys[0])
+	suite.NoError(suite.Pool.MoveBuckets(map[int]string{hot: getTestServers()[5]}))
+
+	moved := suite.Pool.VBucketMap()
+	suite.Equal(m.Version+1, moved.Version)
+	suite.Len(suite.Pool.Status(), 4)
+	suite.Equal(getTestServers()[5], suite.Pool.Status()[3].Server)
+
+	suite.Pool.RLock()
+	suite.Equal(3, suite.Pool.locate(keys[0]))
+	suite.Pool.RUnlock()
+
+	// only the keys of the hot bucket moved
+	for _, key := range keys {
+		value, err := suite.Pool.Get(key)
+		if m.Bucket(key) == hot {
+			suite.Equal(ErrKeyNotFound, err)
+			continue
+		}
+		suite.NoError(err)
+		suite.Equal(key, string(value))
+	}
+
+	suite.Equal(ErrStaleVBucketMap, suite.Pool.ApplyVBucketMap(m))
+
+	plain := setupPool(suite.T())
+	defer plain.Close()
+	suite.Equal(ErrNoVBucketMap, plain.MoveBuckets(map[int]string{0: getTestServers()[0]}))
+}
+
+func (suite *VBucketTestSuite) TestUpdateServersKeepsBuckets() {
+	m := suite.Pool.VBucketMap()
+	suite.NoError(suite.Pool.UpdateServers(getTestServers()[:4]))
+
+	next := suite.Pool.VBucketMap()
+	suite.Equal(m.Version+1, next.Version)
+	suite.Equal([]int{256, 256, 256, 256}, next.Counts())
+
+	moved := 0
+	for bucket := range m.Buckets {
+		if m.Buckets[bucket] != next.Buckets[bucket] {
+			moved++
+		}
+	}
+	suite.Equal(256, moved)
+}
+
+func (suite *VBucketTestSuite) TestApplyKeepsWeights() {
+	servers := getTestServers()[:3]
+	suite.NoError(suite.Pool.UpdateWeightedServers(servers, []int{1, 2, 1}))
+
+	m := suite.Pool.VBucketMap()
+	moved, err := m.Move(map[int]string{0: getTestServers()[3]})
+	suite.Require().NoError(err)
+	suite.NoError(suite.Pool.ApplyVBucketMap(moved))
+
+	weights := []int{}
+	for _, stats := range suite.Pool.Status() {
+		weights = append(weights, stats.Weight)
+	}
+	suite.Equal([]int{1, 2, 1, 1}, weights)
+
+	// a later update still rebalances by weight
+	suite.NoError(suite.Pool.UpdateServers(servers))
+	suite.Equal([]int{256, 512, 256}, suite.Pool.VBucketMap().Counts())
+}
+
+func TestVBucketTestSuite(t *testing.T) {
+	suite.Run(t, new(VBucketTestSuite))
+}
@@ -3,11 +3,12 @@ package vshard
 import (
 	"context"
 	"crypto/md5"
-	"encoding/hex"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"log"
-	"math/big"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,9 +22,15 @@ import (
 var (
 	// ErrKeyNotFound defines the error mensage when key is not found on memcached
 	ErrKeyNotFound = errors.New("error: key not found")
-
-	defaultServerStrategy  = XXH64ShardServerStrategy
-	defaultHashKeyStrategy = XXH64KeyStrategy
+	// ErrUnknownServer defines the error when a server slot is out of range
+	ErrUnknownServer = errors.New("error: unknown server")
+
+	defaultServerStrategy   = XXH64ShardServerStrategy
+	defaultTopologyStrategy = XXH64WeightedServerStrategy
+	// defaultDiscoveryStrategy ranks servers by address, so discovered
+	// servers coming and going only move their own keys
+	defaultDiscoveryStrategy = RendezvousServerStrategy
+	defaultHashKeyStrategy   = XXH64KeyStrategy
 )
 
 const (
@@ -36,6 +43,7 @@ const (
 // VitessResource implements the expected interface for vitess internal pool
 type VitessResource struct {
 	*memcache.Connection
+	pool *pools.ResourcePool
 }
 
 // ServerStrategy defines the signature for the sharding function
@@ -44,6 +52,10 @@ type ServerStrategy func(key string, numServers int) int
 // HashKeyStrategy defines the signature for the key hashing function
 type HashKeyStrategy func(key string) string
 
+// HashTagStrategy defines the signature for the function picking the part of
+// a key that decides its server
+type HashTagStrategy func(key string) string
+
 // Close closes connections in a pool
 func (r VitessResource) Close() {
 	r.Connection.Close()
@@ -55,10 +67,43 @@ type Pool struct {
 	pool                  []*pools.ResourcePool
 	Capacity, MaxCapacity int
 	numServers            int
+	Weights               []int
 	ServerStrategy        ServerStrategy
+	TopologyStrategy      TopologyStrategy
 	HashKeyStrategy       HashKeyStrategy
+	HashTagStrategy       HashTagStrategy
 	IdleTimeout           time.Duration
 	ConnectionTimeout     time.Duration
+	LocalCache            LocalCache
+	InvalidationTransport InvalidationTransport
+	UpdatePolicy          *UpdatePolicy
+	RetryPolicy           *RetryPolicy
+	TTLJitter             float64
+	HealthCheck           *HealthCheck
+	Replicas              int
+	Failover              *Pool
+	FailoverServers       []string
+	FailoverPolicy        FailoverPolicy
+	Discovery             *Discovery
+	origin                string
+	weights               []int
+	locator               ServerLocator
+	health                *healthChecker
+	discovery             *discoveryWatcher
+	down                  []bool
+	liveSlots             []int
+	liveLocator           ServerLocator
+	migration             *migration
+	disruption            float64
+	ownsFailover          bool
+	failovers             map[string]int64
+	failoverLock          sync.Mutex
+	retries               map[string]int64
+	pendingDeletes        map[string]*pendingDeletes
+	pendingLock           sync.Mutex
+	generations           generations
+	retryLock             sync.Mutex
+	update                sync.Mutex
 	sync.RWMutex
 }
 
@@ -66,12 +111,16 @@ type Pool struct {
 type PoolStats struct {
 	Slot        int
 	Server      string
+	Weight      int
 	Capacity    int64
 	Available   int64
 	MaxCap      int64
 	WaitCount   int64
 	WaitTime    time.Duration
 	IdleTimeout time.Duration
+	Down        bool
+	Failovers   int64
+	Retries     int64
 }
 
 // MD5ShardServerStrategy uses md5+jump to pick a server
@@ -80,11 +129,7 @@ func MD5ShardServerStrategy(key string, numServers int) int {
 		return 0
 	}
 
-	hash := md5.Sum([]byte(key))
-	hashInt := big.NewInt(0)
-	hashInt.SetString(hex.EncodeToString(hash[:]), 16)
-
-	return int(jump.Hash(hashInt.Uint64(), numServers))
+	return int(jump.Hash(md5Hash(key), numServers))
 }
 
 // XXH64ShardServerStrategy uses xxhash+jump to pick a server
@@ -93,7 +138,7 @@ func XXH64ShardServerStrategy(key string, numServers int) int {
 		return 0
 	}
 
-	return int(jump.Hash(xxhash.Sum64String(key), numServers))
+	return int(jump.Hash(xxh64Hash(key), numServers))
 }
 
 // FarmhashShardServerStrategy uses farmhash+jump to pick a server
@@ -102,7 +147,21 @@ func FarmhashShardServerStrategy(key string, numServers int) int {
 		return 0
 	}
 
-	return int(jump.Hash(farm.Fingerprint64([]byte(key)), numServers))
+	return int(jump.Hash(farmHash(key), numServers))
+}
+
+// md5Hash returns the lower 64 bits of the key's md5, read as a big endian number
+func md5Hash(key string) uint64 {
+	hash := md5.Sum([]byte(key))
+	return binary.BigEndian.Uint64(hash[8:])
+}
+
+func xxh64Hash(key string) uint64 {
+	return xxhash.Sum64String(key)
+}
+
+func farmHash(key string) uint64 {
+	return farm.Fingerprint64([]byte(key))
 }
 
 // XXH64KeyStrategy uses xxhash XXH64 to normalize key names for storage
@@ -115,37 +174,126 @@ func FarmhashKeyStrategy(key string) string {
 	return strconv.FormatUint(farm.Fingerprint64([]byte(key)), 10)
 }
 
+// MD5KeyStrategy uses md5 to normalize key names for storage
+func MD5KeyStrategy(key string) string {
+	return strconv.FormatUint(md5Hash(key), 10)
+}
+
 // NoKeyStrategy doesn't hash the key
 func NoKeyStrategy(key string) string {
 	return key
 }
 
+// BraceHashTagStrategy shards keys by the part between the first { and the
+// following }, like Redis Cluster and twemproxy's hash_tag "{}", so
+// user:{123}:profile and user:{123}:settings share a server. Keys
+// without a non-empty tag are sharded by the whole key.
+func BraceHashTagStrategy(key string) string {
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return key
+	}
+
+	end := strings.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return key
+	}
+
+	return key[start+1 : start+1+end]
+}
+
 // Start starts the pool
 func (v *Pool) Start() {
+	v.discoverServers()
 	v.initialize()
 
+	unreachable := []string{}
 	for i, server := range v.Servers {
-		func(_v *Pool, _server string, _i int) {
-			_v.Lock()
-			_v.pool = append(_v.pool, pools.NewResourcePool(func() (pools.Resource, error) {
-				c, err := memcache.Connect(_server, _v.ConnectionTimeout)
-				return VitessResource{c}, err
-			}, _v.Capacity, _v.MaxCapacity, _v.IdleTimeout))
-			_v.Unlock()
-
-			conn, err := _v.GetPoolConnection(_i)
-			if err != nil {
-				log.Fatalf("Can't connect to memcached %d (%s): %s", _i, _server, err)
+		pool, err := v.newServerPool(server)
+		if err != nil {
+			if v.HealthCheck == nil {
+				log.Fatalf("Can't connect to memcached %d (%s): %s", i, server, err)
 			}
-			_v.ReturnConnection(_i, conn)
-		}(v, server, i)
+			unreachable = append(unreachable, server)
+		}
+
+		v.Lock()
+		v.pool = append(v.pool, pool)
+		v.Unlock()
+	}
+
+	if v.HealthCheck != nil {
+		v.startHealthCheck(unreachable)
+	}
+	v.startFailover()
+	if v.Discovery != nil {
+		v.startDiscovery()
+	}
+
+	v.subscribeInvalidations()
+}
+
+// Close stops the health checker and server discovery, and closes all
+// connections, waiting for the ones in use to be returned. A Failover
+// started for FailoverServers is closed too, and so is the
+// InvalidationTransport, which belongs to the pool once started.
+func (v *Pool) Close() {
+	v.update.Lock()
+	watcher := v.discovery
+	v.discovery = nil
+	v.update.Unlock()
+
+	if watcher != nil {
+		close(watcher.stop)
+		<-watcher.done
+	}
+
+	v.update.Lock()
+	checker := v.health
+	v.health = nil
+	v.update.Unlock()
+
+	if checker != nil {
+		close(checker.stop)
+		<-checker.done
+	}
+
+	v.RLock()
+	serverPools := append(append([]*pools.ResourcePool{}, v.pool...), v.oldOnlyPools()...)
+	v.RUnlock()
+
+	for _, pool := range serverPools {
+		pool.Close()
+	}
+
+	if v.ownsFailover {
+		v.Failover.Close()
+	}
+
+	if v.InvalidationTransport != nil {
+		v.InvalidationTransport.Close()
 	}
 }
 
 func (v *Pool) initialize() {
 	v.numServers = len(v.Servers)
 	v.pool = []*pools.ResourcePool{}
+	v.origin = newOrigin()
 
+	if !validJitter(v.TTLJitter) {
+		log.Fatalf("Invalid TTLJitter %v: must be at least 0 and below 1", v.TTLJitter)
+	}
+	if v.Discovery != nil && v.ServerStrategy == nil && v.TopologyStrategy == nil {
+		// discovered servers come and go anywhere in the list
+		v.TopologyStrategy = defaultDiscoveryStrategy
+	}
+	if v.TopologyStrategy == nil && len(v.Weights) > 0 {
+		if v.ServerStrategy == nil {
+			v.TopologyStrategy = defaultTopologyStrategy
+		} else if weighted(v.Weights) {
+			log.Fatal(ErrUnweightedStrategy)
+		}
+	}
 	if v.ServerStrategy == nil {
 		v.ServerStrategy = defaultServerStrategy
 	}
@@ -158,33 +306,145 @@ func (v *Pool) initialize() {
 	if v.MaxCapacity == 0 {
 		v.MaxCapacity = defaultMaxCapacity
 	}
+	if v.Capacity < 1 || v.MaxCapacity < v.Capacity {
+		log.Fatalf("Invalid capacity %d and max capacity %d: need 0 < capacity <= max capacity", v.Capacity, v.MaxCapacity)
+	}
 	if v.IdleTimeout == 0 {
 		v.IdleTimeout = defaultIdleTimeout
 	}
 	if v.ConnectionTimeout == 0 {
 		v.ConnectionTimeout = defaultConnectionTimeout
 	}
+
+	v.weights = normalizeWeights(v.Servers, v.Weights)
+	if v.TopologyStrategy != nil {
+		v.locator = v.TopologyStrategy(v.Servers, v.weights)
+	}
 }
 
-// GetConnection returns a connection from the sharding pool, based on the key
-func (v *Pool) GetConnection(key string) (*VitessResource, int, error) {
-	poolNum := v.ServerStrategy(key, v.numServers)
+// newServerPool creates the connection pool for server, checking it's
+// reachable. The pool is returned even when it isn't.
+func (v *Pool) newServerPool(server string) (*pools.ResourcePool, error) {
+	var pool *pools.ResourcePool
+	pool = pools.NewResourcePool(func() (pools.Resource, error) {
+		c, err := memcache.Connect(server, v.ConnectionTimeout)
+		return VitessResource{Connection: c, pool: pool}, err
+	}, v.Capacity, v.MaxCapacity, v.IdleTimeout)
 
-	connection, err := v.GetPoolConnection(poolNum)
+	resource, err := pool.Get(context.Background())
 	if err != nil {
-		return nil, -1, err
+		return pool, err
+	}
+	pool.Put(resource)
+
+	// a server may accept connections and still not answer
+	if v.HealthCheck != nil && !v.probe(server) {
+		return pool, ErrServerDown
 	}
 
-	return connection, poolNum, nil
+	return pool, nil
+}
+
+// normalizeWeights returns the weight of each server, 1 each when there are
+// no weights
+func normalizeWeights(servers []string, weights []int) []int {
+	normalized, err := checkWeights(servers, weights)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return normalized
+}
+
+// checkWeights validates weights, returning the weight of each server.
+// Weights must be positive, servers are drained by removing them.
+func checkWeights(servers []string, weights []int) ([]int, error) {
+	if len(weights) > 0 && len(weights) != len(servers) {
+		return nil, fmt.Errorf("error: %d weights for %d servers", len(weights), len(servers))
+	}
+
+	normalized := make([]int, len(servers))
+	for i := range servers {
+		normalized[i] = 1
+		if len(weights) > 0 {
+			normalized[i] = weights[i]
+		}
+		if normalized[i] <= 0 {
+			return nil, fmt.Errorf("error: weight %d for server %s must be positive", normalized[i], servers[i])
+		}
+	}
+
+	return normalized, nil
+}
+
+// locate returns the server slot owning key, or the live server taking over
+// when it's down and HealthCheck rehashes. Callers must hold the lock.
+func (v *Pool) locate(key string) int {
+	tag := v.hashTag(key)
+	slot := v.locateSlot(tag)
+	if v.liveLocator != nil && v.down[slot] {
+		return v.liveSlots[v.liveLocator.Locate(tag)]
+	}
+
+	return slot
+}
+
+// hashTag returns the part of key deciding its server
+func (v *Pool) hashTag(key string) string {
+	if v.HashTagStrategy == nil {
+		return key
+	}
+
+	return v.HashTagStrategy(key)
+}
+
+func (v *Pool) locateSlot(key string) int {
+	if v.locator != nil {
+		return v.locator.Locate(key)
+	}
+
+	return v.ServerStrategy(key, v.numServers)
+}
+
+// GetConnection returns a connection from the sharding pool, based on the key
+func (v *Pool) GetConnection(key string) (*VitessResource, int, error) {
+	for {
+		v.RLock()
+		poolNum := v.locate(key)
+		pool, down := v.pool[poolNum], v.isDown(poolNum)
+		v.RUnlock()
+		if down {
+			return nil, -1, ErrServerDown
+		}
+
+		connection, err := getConnection(pool)
+		if err == pools.ErrClosed {
+			// the server was just removed by UpdateServers, locate the key again
+			continue
+		}
+		if err != nil {
+			return nil, -1, err
+		}
+
+		return connection, poolNum, nil
+	}
 }
 
 // GetPoolConnection returns a connection from a specific pool number
 func (v *Pool) GetPoolConnection(poolNum int) (*VitessResource, error) {
-	ctx := context.Background()
-
 	v.RLock()
-	resource, err := v.pool[poolNum].Get(ctx)
+	if poolNum < 0 || poolNum >= len(v.pool) {
+		v.RUnlock()
+		return nil, ErrUnknownServer
+	}
+	pool := v.pool[poolNum]
 	v.RUnlock()
+
+	return getConnection(pool)
+}
+
+func getConnection(pool *pools.ResourcePool) (*VitessResource, error) {
+	resource, err := pool.Get(context.Background())
 	if err != nil {
 		return nil, err
 	}
@@ -194,19 +454,40 @@ func (v *Pool) GetPoolConnection(poolNum int) (*VitessResource, error) {
 	return &connection, nil
 }
 
-// ReturnConnection returns a connection to the pool
+// ReturnConnection returns a connection to the pool it was taken from, which
+// is no longer poolNum when UpdateServers changed the topology meanwhile
 func (v *Pool) ReturnConnection(poolNum int, resource *VitessResource) {
-	if poolNum > v.numServers || poolNum < 0 {
-		log.Fatalf("error: invalid server %d (of total %d)", poolNum, v.numServers)
+	resource.pool.Put(*resource)
+}
+
+// release returns a connection to its pool, unless err left it in an
+// unknown state, then it's closed and replaced by a new one on demand
+func (v *Pool) release(resource *VitessResource, err error) {
+	if _, broken := err.(memcache.Error); broken {
+		resource.Close()
+		resource.pool.Put(nil)
+		return
 	}
 
-	v.RLock()
-	v.pool[poolNum].Put(*resource)
-	v.RUnlock()
+	resource.pool.Put(*resource)
 }
 
 // GetKeyMapping returns a mapping of server to a list of keys, useful for Gets()
 func (v *Pool) GetKeyMapping(keys ...string) map[int][]string {
+	mapping, _ := v.keyMapping(keys...)
+	for poolNum, keys := range mapping {
+		mapping[poolNum] = v.hashKeys(keys)
+	}
+
+	return mapping
+}
+
+// keyMapping maps keys to servers, along with the pools of that same
+// topology, down servers have no pool
+func (v *Pool) keyMapping(keys ...string) (map[int][]string, []*pools.ResourcePool) {
+	v.RLock()
+	defer v.RUnlock()
+
 	mapping := make(map[int][]string)
 
 	for i := 0; i < v.numServers; i++ {
@@ -214,9 +495,34 @@ func (v *Pool) GetKeyMapping(keys ...string) map[int][]string {
 	}
 
 	for _, key := range keys {
-		poolNum := v.ServerStrategy(key, v.numServers)
-		mapping[poolNum] = append(mapping[poolNum], v.HashKeyStrategy(key))
+		poolNum := v.locate(key)
+		mapping[poolNum] = append(mapping[poolNum], key)
 	}
 
-	return mapping
+	serverPools := v.pool
+	if v.down != nil {
+		serverPools = make([]*pools.ResourcePool, len(v.pool))
+		for i, pool := range v.pool {
+			if !v.down[i] {
+				serverPools[i] = pool
+			}
+		}
+	}
+
+	return mapping, serverPools
+}
+
+// HashKey normalizes a key name for storage with HashKeyStrategy
+func (v *Pool) HashKey(key string) string {
+	return v.HashKeyStrategy(key)
+}
+
+// hashKeys normalizes key names for storage with HashKeyStrategy
+func (v *Pool) hashKeys(keys []string) []string {
+	hashed := make([]string, len(keys))
+	for i, key := range keys {
+		hashed[i] = v.HashKeyStrategy(key)
+	}
+
+	return hashed
 }
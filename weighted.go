@@ -0,0 +1,154 @@
+package vshard
+
+import "math"
+
+// ServerLocator maps keys to the index of the server owning them
+type ServerLocator interface {
+	Locate(key string) int
+}
+
+// TopologyStrategy builds a ServerLocator for a list of servers and the
+// relative weight of each one. Unlike ServerStrategy, it sees the whole
+// topology, so it can weight servers or precompute lookup tables. Weights
+// are positive, a server is drained by removing it. Pools with Weights and
+// no strategy use XXH64WeightedServerStrategy, while Weights other than 1
+// along with a ServerStrategy alone are refused, as are such weights given
+// later to a pool placing keys with its ServerStrategy.
+type TopologyStrategy func(servers []string, weights []int) ServerLocator
+
+// weightedLocator implements weighted rendezvous hashing: every server seed
+// scores each key and the highest score wins. Changing the weight of one
+// server only moves keys to or from that server.
+type weightedLocator struct {
+	hash   func(key string) uint64
+	seeds  []uint64
+	groups []weightGroup
+}
+
+// weightGroup holds the servers sharing a weight, among them the highest
+// hash always has the highest score, so only one score per group is needed
+type weightGroup struct {
+	weight float64
+	slots  []int
+}
+
+// MD5WeightedServerStrategy uses md5 to pick servers in proportion to their weight
+func MD5WeightedServerStrategy(servers []string, weights []int) ServerLocator {
+	return newWeightedLocator(md5Hash, slotSeeds(len(weights)), weights)
+}
+
+// XXH64WeightedServerStrategy uses xxhash to pick servers in proportion to their weight
+func XXH64WeightedServerStrategy(servers []string, weights []int) ServerLocator {
+	return newWeightedLocator(xxh64Hash, slotSeeds(len(weights)), weights)
+}
+
+// FarmhashWeightedServerStrategy uses farmhash to pick servers in proportion to their weight
+func FarmhashWeightedServerStrategy(servers []string, weights []int) ServerLocator {
+	return newWeightedLocator(farmHash, slotSeeds(len(weights)), weights)
+}
+
+// slotSeeds seeds servers by their position, like jump hash does
+func slotSeeds(numServers int) []uint64 {
+	seeds := make([]uint64, numServers)
+	for i := range seeds {
+		seeds[i] = mix64(uint64(i) + 1)
+	}
+
+	return seeds
+}
+
+func newWeightedLocator(hash func(key string) uint64, seeds []uint64, weights []int) *weightedLocator {
+	locator := &weightedLocator{hash: hash, seeds: seeds}
+	groups := make(map[int]int)
+
+	for slot, weight := range weights {
+		group, ok := groups[weight]
+		if !ok {
+			group = len(locator.groups)
+			groups[weight] = group
+			locator.groups = append(locator.groups, weightGroup{weight: float64(weight)})
+		}
+		locator.groups[group].slots = append(locator.groups[group].slots, slot)
+	}
+
+	return locator
+}
+
+// Locate returns the slot with the highest weighted score for key
+func (l *weightedLocator) Locate(key string) int {
+	hash := l.hash(key)
+	best, bestScore := 0, math.Inf(-1)
+
+	for _, group := range l.groups {
+		groupBest, groupHash := group.slots[0], mix64(hash^l.seeds[group.slots[0]])
+		for _, slot := range group.slots[1:] {
+			if h := mix64(hash ^ l.seeds[slot]); h > groupHash {
+				groupBest, groupHash = slot, h
+			}
+		}
+
+		if len(l.groups) == 1 {
+			return groupBest
+		}
+
+		if score := weightedScore(groupHash, group.weight); score > bestScore {
+			best, bestScore = groupBest, score
+		}
+	}
+
+	return best
+}
+
+// weightedScore turns a uniform hash into -weight/ln(u), u in (0, 1), whose
+// maximum across servers is won by each one in proportion to its weight
+func weightedScore(hash uint64, weight float64) float64 {
+	u := (float64(hash>>11) + 0.5) / (1 << 53)
+	return -weight / math.Log(u)
+}
+
+// mix64 is the splitmix64 finalizer, spreading every input bit over the output
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
+
+// LocateReplicas returns the n slots with the highest weighted scores for key
+func (l *weightedLocator) LocateReplicas(key string, n int) []int {
+	hash := l.hash(key)
+	slots := []int{}
+	scores := []float64{}
+
+	for _, group := range l.groups {
+		for _, slot := range group.slots {
+			slots = append(slots, slot)
+			scores = append(scores, weightedScore(mix64(hash^l.seeds[slot]), group.weight))
+		}
+	}
+
+	return topSlots(slots, scores, n)
+}
+
+// topSlots partially sorts slots by descending score, returning the first n
+func topSlots(slots []int, scores []float64, n int) []int {
+	if n > len(slots) {
+		n = len(slots)
+	}
+
+	for i := 0; i < n; i++ {
+		best := i
+		for j := i + 1; j < len(slots); j++ {
+			if scores[j] > scores[best] {
+				best = j
+			}
+		}
+		slots[i], slots[best] = slots[best], slots[i]
+		scores[i], scores[best] = scores[best], scores[i]
+	}
+
+	return slots[:n]
+}
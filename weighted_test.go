@@ -0,0 +1,143 @@
+package vshard
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type WeightedTestSuite struct {
+	suite.Suite
+	Pool *Pool
+}
+
+func (suite *WeightedTestSuite) SetupSuite() {
+	suite.Pool = &Pool{
+		Servers: getTestServers(),
+		Weights: []int{1, 2, 1, 4, 1, 1, 1, 1, 1, 3},
+	}
+	suite.Pool.Start()
+}
+
+func (suite *WeightedTestSuite) TearDownTest() {
+	tearDownPool(suite.T(), suite.Pool)
+}
+
+func testKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i)
+	}
+
+	return keys
+}
+
+func (suite *WeightedTestSuite) testDistribution(strategy TopologyStrategy) {
+	weights := []int{1, 2, 4, 1}
+	locator := strategy(make([]string, len(weights)), weights)
+	keys := testKeys(80000)
+
+	counts := make([]int, len(weights))
+	for _, key := range keys {
+		counts[locator.Locate(key)]++
+	}
+
+	for i, weight := range weights {
+		expected := float64(len(keys)) * float64(weight) / 8
+		suite.InEpsilon(expected, float64(counts[i]), 0.05, "server %d should get its weight's share", i)
+	}
+}
+
+func (suite *WeightedTestSuite) TestDistributionMD5() {
+	suite.testDistribution(MD5WeightedServerStrategy)
+}
+
+func (suite *WeightedTestSuite) TestDistributionXXH64() {
+	suite.testDistribution(XXH64WeightedServerStrategy)
+}
+
+func (suite *WeightedTestSuite) TestDistributionFarmhash() {
+	suite.testDistribution(FarmhashWeightedServerStrategy)
+}
+
+func (suite *WeightedTestSuite) TestWeightChangeRemapsMinimally() {
+	servers := make([]string, 5)
+	before := XXH64WeightedServerStrategy(servers, []int{1, 1, 1, 1, 1})
+	after := XXH64WeightedServerStrategy(servers, []int{1, 1, 2, 1, 1})
+	keys := testKeys(60000)
+
+	moved := 0
+	for _, key := range keys {
+		oldSlot, newSlot := before.Locate(key), after.Locate(key)
+		if oldSlot != newSlot {
+			moved++
+			suite.Equal(2, newSlot, "keys should only move to the server that gained weight")
+		}
+	}
+
+	// server 2 goes from 1/5 to 2/6 of the keys, so 2/15 of them move
+	suite.InEpsilon(float64(len(keys))*2/15, float64(moved), 0.05)
+}
+
+func (suite *WeightedTestSuite) TestWeightsArePositive() {
+	suite.Equal([]int{1, 1, 1}, normalizeWeights(make([]string, 3), nil))
+	suite.Equal([]int{1, 3, 1}, normalizeWeights(make([]string, 3), []int{1, 3, 1}))
+
+	// a zero weight doesn't drain a server
+	_, err := checkWeights(make([]string, 3), []int{0, 3, 1})
+	suite.Error(err)
+	_, err = checkWeights(make([]string, 3), []int{1, -3, 1})
+	suite.Error(err)
+}
+
+func (suite *WeightedTestSuite) TestPoolRoutesByWeight() {
+	suite.NotNil(suite.Pool.locator)
+
+	mapping := suite.Pool.GetKeyMapping(testKeys(17000)...)
+	suite.InEpsilon(4000, len(mapping[3]), 0.1)
+	suite.InEpsilon(1000, len(mapping[0]), 0.15)
+
+	for i, status := range suite.Pool.Status() {
+		suite.Equal(suite.Pool.Weights[i], status.Weight)
+	}
+}
+
+func (suite *WeightedTestSuite) TestSetGet() {
+	for _, key := range testKeys(100) {
+		ok, err := suite.Pool.Set(key, 0, 0, []byte(key))
+		suite.True(ok)
+		suite.NoError(err)
+	}
+
+	for _, key := range testKeys(100) {
+		value, err := suite.Pool.Get(key)
+		suite.NoError(err)
+		suite.Equal(key, string(value))
+	}
+}
+
+func TestWeightedTestSuite(t *testing.T) {
+	suite.Run(t, new(WeightedTestSuite))
+}
+
+func benchmarkWeightedServerStrategy(b *testing.B, strategy TopologyStrategy) {
+	weights := []int{1, 2, 1, 4, 1, 1, 1, 1, 1, 3}
+	locator := strategy(make([]string, len(weights)), weights)
+
+	for n := 0; n < b.N; n++ {
+		_ = locator.Locate("a")
+	}
+}
+
+func BenchmarkWeightedServerStrategyMD5(b *testing.B) {
+	benchmarkWeightedServerStrategy(b, MD5WeightedServerStrategy)
+}
+
+func BenchmarkWeightedServerStrategyFarmHash(b *testing.B) {
+	benchmarkWeightedServerStrategy(b, FarmhashWeightedServerStrategy)
+}
+
+func BenchmarkWeightedServerStrategyXXH64(b *testing.B) {
+	benchmarkWeightedServerStrategy(b, XXH64WeightedServerStrategy)
+}